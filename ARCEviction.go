@@ -0,0 +1,163 @@
+package cache
+
+import (
+    "container/list"
+)
+
+// ARCEviction is an Adaptive Replacement Cache policy measured in bytes. It
+// keeps records read once apart from records read again, and remembers the
+// keys it recently evicted from each. A write of a key evicted from either
+// list shows that list was too short, and shifts the target share of the
+// cache between them, so that a scan of one time reads cannot flush records
+// which are read repeatedly.
+type ARCEviction struct {
+    capacity int64
+    entries  map[*DataRecord]*list.Element
+    frequent *sizedList // records read more than once
+    ghosts   map[string]*list.Element
+    recent   *sizedList // records read once
+    staleF   *sizedList // keys recently evicted from frequent
+    staleR   *sizedList // keys recently evicted from recent
+    target   int64      // the share of capacity recent aims for
+}
+
+// NewARCEviction returns an ARC policy, sized to the Scavenger's maxSize
+// once set as its policy.
+func NewARCEviction() *ARCEviction {
+    return &ARCEviction{
+        entries:  make(map[*DataRecord]*list.Element),
+        frequent: newSizedList(),
+        ghosts:   make(map[string]*list.Element),
+        recent:   newSizedList(),
+        staleF:   newSizedList(),
+        staleR:   newSizedList(),
+    }
+}
+
+func (arc *ARCEviction) Add(val *DataRecord) {
+    e, ok := arc.entries[val]
+    if ok {
+        ee := e.Value.(*evictionEntry)
+        ee.list.resize(ee, val.Size)
+        arc.Access(val)
+        return
+    }
+
+    ee := &evictionEntry{
+        size: val.Size,
+        val:  val,
+    }
+
+    ghost, ok := arc.ghosts[val.Key]
+    if !ok {
+        arc.entries[val] = arc.recent.push(ee)
+        arc.trimGhosts()
+        return
+    }
+
+    // the key was evicted too soon, so the list it was evicted from grows
+    stale := ghost.Value.(*evictionEntry).list
+    if stale == arc.staleR {
+        arc.target += ee.size * arcRatio(arc.staleF.size, arc.staleR.size)
+        if arc.target > arc.capacity {
+            arc.target = arc.capacity
+        }
+    } else {
+        arc.target -= ee.size * arcRatio(arc.staleR.size, arc.staleF.size)
+        if arc.target < 0 {
+            arc.target = 0
+        }
+    }
+
+    stale.remove(ghost)
+    delete(arc.ghosts, val.Key)
+
+    arc.entries[val] = arc.frequent.push(ee)
+    arc.trimGhosts()
+}
+
+func (arc *ARCEviction) Access(val *DataRecord) {
+    e, ok := arc.entries[val]
+    if !ok {
+        return
+    }
+
+    ee := e.Value.(*evictionEntry)
+    ee.list.remove(e)
+    arc.entries[val] = arc.frequent.push(ee)
+}
+
+func (arc *ARCEviction) Evict() *DataRecord {
+    from, stale := arc.frequent, arc.staleF
+    if arc.recent.entries.Len() > 0 && (arc.recent.size > arc.target || arc.frequent.entries.Len() == 0) {
+        from, stale = arc.recent, arc.staleR
+    }
+
+    e := from.oldest()
+    if e == nil {
+        return nil
+    }
+
+    ee := from.remove(e)
+    delete(arc.entries, ee.val)
+
+    arc.ghosts[ee.val.Key] = stale.push(&evictionEntry{
+        size: ee.size,
+        val:  &DataRecord{Key: ee.val.Key},
+    })
+    arc.trimGhosts()
+
+    return ee.val
+}
+
+func (arc *ARCEviction) Remove(val *DataRecord) {
+    e, ok := arc.entries[val]
+    if !ok {
+        return
+    }
+
+    ee := e.Value.(*evictionEntry)
+    ee.list.remove(e)
+    delete(arc.entries, val)
+}
+
+func (arc *ARCEviction) setCapacity(capacity int64) {
+    arc.capacity = capacity
+    if arc.target > capacity {
+        arc.target = capacity
+    }
+
+    arc.trimGhosts()
+}
+
+// trimGhosts forgets the oldest evicted keys once recent and its ghosts
+// outgrow the capacity, or everything held and remembered outgrows twice
+// the capacity.
+func (arc *ARCEviction) trimGhosts() {
+    for arc.recent.size+arc.staleR.size > arc.capacity && arc.staleR.entries.Len() > 0 {
+        arc.forget(arc.staleR)
+    }
+
+    total := arc.recent.size + arc.frequent.size + arc.staleR.size + arc.staleF.size
+    for total > 2*arc.capacity && arc.staleF.entries.Len() > 0 {
+        total -= arc.forget(arc.staleF)
+    }
+}
+
+// forget drops the oldest key from stale, returning its size.
+func (arc *ARCEviction) forget(stale *sizedList) int64 {
+    ee := stale.remove(stale.oldest())
+    delete(arc.ghosts, ee.val.Key)
+
+    return ee.size
+}
+
+// arcRatio is how much faster a list's target grows on a ghost hit: the
+// ratio of the other list's ghosts to its own, and at least 1.
+func arcRatio(other, own int64) int64 {
+    if own == 0 || other <= own {
+        return 1
+    }
+
+    return other / own
+}
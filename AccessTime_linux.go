@@ -0,0 +1,18 @@
+package cache
+
+import (
+    "os"
+    "syscall"
+    "time"
+)
+
+// accessTime returns when fi was last read, or its modification time if
+// that is unknown.
+func accessTime(fi os.FileInfo) time.Time {
+    st, ok := fi.Sys().(*syscall.Stat_t)
+    if !ok {
+        return fi.ModTime()
+    }
+
+    return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+
+package cache
+
+import (
+    "os"
+    "time"
+)
+
+// accessTime returns fi's modification time, as access times are not read
+// on this platform.
+func accessTime(fi os.FileInfo) time.Time {
+    return fi.ModTime()
+}
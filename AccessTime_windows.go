@@ -0,0 +1,18 @@
+package cache
+
+import (
+    "os"
+    "syscall"
+    "time"
+)
+
+// accessTime returns when fi was last read, or its modification time if
+// that is unknown.
+func accessTime(fi os.FileInfo) time.Time {
+    attrs, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+    if !ok {
+        return fi.ModTime()
+    }
+
+    return time.Unix(0, attrs.LastAccessTime.Nanoseconds())
+}
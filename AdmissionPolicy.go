@@ -0,0 +1,219 @@
+package cache
+
+import (
+    "hash/fnv"
+    "strings"
+    "sync"
+)
+
+// frequencyRows is the number of hashed counters FrequencyAdmission keeps
+// for each key.
+const frequencyRows = 4
+
+var (
+    AdmitAlways AdmissionPolicy = AdmissionFunc(func(string, int64) bool { return true })
+    AdmitNever  AdmissionPolicy = AdmissionFunc(func(string, int64) bool { return false })
+)
+
+// AdmissionPolicy decides whether an entry read from a lower tier is stored
+// in the tiers above it. size is the entry's length, or GetLengthUnknown.
+// Admit is called once for every such read, so policies may count them.
+type AdmissionPolicy interface {
+    Admit(key string, size int64) bool
+}
+
+// AdmissionFunc adapts a function to an AdmissionPolicy.
+type AdmissionFunc func(key string, size int64) bool
+
+// AdmissionChain admits an entry only if every one of its policies does.
+// Policies after the first to refuse are not consulted.
+type AdmissionChain []AdmissionPolicy
+
+// FrequencyAdmission admits an entry once it has been read minHits times,
+// in the manner of TinyLFU. Reads are counted approximately in a count-min
+// sketch behind a doorkeeper filter, so that keys read only once take no
+// counter space, and every count is halved periodically so that old
+// popularity fades.
+type FrequencyAdmission struct {
+    additions  int
+    counters   []uint8
+    doorkeeper []uint64
+    lock       sync.Mutex
+    mask       uint64
+    minHits    int
+    sampleSize int
+}
+
+// MaxSizeAdmission admits entries up to MaxSize bytes. Entries of unknown
+// size are admitted unless RejectUnknown is set.
+type MaxSizeAdmission struct {
+    MaxSize       int64
+    RejectUnknown bool
+}
+
+// PrefixAdmission applies the policy of the longest prefix in Rules that the
+// key starts with, or Default if none does. A nil policy admits everything.
+type PrefixAdmission struct {
+    Default AdmissionPolicy
+    Rules   map[string]AdmissionPolicy
+}
+
+// NewFrequencyAdmission returns a policy admitting keys on their minHits'th
+// read, sized to track about capacity distinct keys.
+func NewFrequencyAdmission(minHits, capacity int) *FrequencyAdmission {
+    width := uint64(64)
+    for width < uint64(capacity) {
+        width <<= 1
+    }
+
+    return &FrequencyAdmission{
+        counters:   make([]uint8, frequencyRows*width),
+        doorkeeper: make([]uint64, width/64),
+        mask:       width - 1,
+        minHits:    minHits,
+        sampleSize: 10 * int(width),
+    }
+}
+
+func (af AdmissionFunc) Admit(key string, size int64) bool {
+    return af(key, size)
+}
+
+func (ac AdmissionChain) Admit(key string, size int64) bool {
+    for i := range ac {
+        if !ac[i].Admit(key, size) {
+            return false
+        }
+    }
+
+    return true
+}
+
+func (fa *FrequencyAdmission) Admit(key string, size int64) bool {
+    fa.lock.Lock()
+    defer fa.lock.Unlock()
+
+    hits := fa.increment(key)
+
+    fa.additions++
+    if fa.additions >= fa.sampleSize {
+        fa.age()
+    }
+
+    return hits >= fa.minHits
+}
+
+// Estimate returns roughly how many times key has been read recently.
+func (fa *FrequencyAdmission) Estimate(key string) int {
+    fa.lock.Lock()
+    defer fa.lock.Unlock()
+
+    indexes := fa.indexes(key)
+    if !fa.seen(indexes) {
+        return 0
+    }
+
+    return 1 + fa.count(indexes)
+}
+
+func (msa *MaxSizeAdmission) Admit(key string, size int64) bool {
+    if size < 0 {
+        return !msa.RejectUnknown
+    }
+
+    return size <= msa.MaxSize
+}
+
+func (pa *PrefixAdmission) Admit(key string, size int64) bool {
+    policy := pa.Default
+    longest := -1
+
+    for prefix := range pa.Rules {
+        if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+            policy = pa.Rules[prefix]
+            longest = len(prefix)
+        }
+    }
+
+    if policy == nil {
+        return true
+    }
+
+    return policy.Admit(key, size)
+}
+
+// age halves every counter and clears the doorkeeper.
+func (fa *FrequencyAdmission) age() {
+    for i := range fa.counters {
+        fa.counters[i] >>= 1
+    }
+
+    for i := range fa.doorkeeper {
+        fa.doorkeeper[i] = 0
+    }
+
+    fa.additions = 0
+}
+
+// count returns the smallest of key's counters.
+func (fa *FrequencyAdmission) count(indexes [frequencyRows]uint64) int {
+    least := uint8(255)
+    for row := range indexes {
+        c := fa.counters[uint64(row)*(fa.mask+1)+indexes[row]]
+        if c < least {
+            least = c
+        }
+    }
+
+    return int(least)
+}
+
+// increment counts a read of key and returns the new estimate. The first
+// read only sets the doorkeeper's bits.
+func (fa *FrequencyAdmission) increment(key string) int {
+    indexes := fa.indexes(key)
+
+    if !fa.seen(indexes) {
+        for _, index := range indexes {
+            fa.doorkeeper[index/64] |= 1 << (index % 64)
+        }
+
+        return 1
+    }
+
+    for row := range indexes {
+        i := uint64(row)*(fa.mask+1) + indexes[row]
+        if fa.counters[i] < 255 {
+            fa.counters[i]++
+        }
+    }
+
+    return 1 + fa.count(indexes)
+}
+
+// indexes returns key's counter in each row, by double hashing.
+func (fa *FrequencyAdmission) indexes(key string) [frequencyRows]uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(key))
+    sum := h.Sum64()
+
+    lo := sum & 0xffffffff
+    hi := sum>>32 | 1
+
+    var indexes [frequencyRows]uint64
+    for row := range indexes {
+        indexes[row] = (lo + uint64(row)*hi) & fa.mask
+    }
+
+    return indexes
+}
+
+func (fa *FrequencyAdmission) seen(indexes [frequencyRows]uint64) bool {
+    for _, index := range indexes {
+        if fa.doorkeeper[index/64]&(1<<(index%64)) == 0 {
+            return false
+        }
+    }
+
+    return true
+}
@@ -1,7 +1,12 @@
 package cache
 
 import (
+    "context"
+    "crypto/md5"
+    "encoding/base64"
+    "fmt"
     "io"
+    "net/http"
     "strings"
     "time"
 
@@ -38,6 +43,10 @@ func NewAzureReadCache(account, key, container string) (*AzureReadCache, error)
 }
 
 func (arc *AzureReadCache) Get(path string, metadata interface{}) (int64, io.Reader, error) {
+    return arc.GetContext(context.Background(), path, metadata)
+}
+
+func (arc *AzureReadCache) GetContext(ctx context.Context, path string, metadata interface{}) (int64, io.Reader, error) {
     Log.Debug("AzureReadCache::Get %s", path)
 
     var err error
@@ -45,25 +54,30 @@ func (arc *AzureReadCache) Get(path string, metadata interface{}) (int64, io.Rea
     var srcSize int64
 
     var props *storage.BlobProperties
+    var checksum []byte
     for i := 0; i < HttpMaxRetries; i++ {
         props, err = arc.cli.GetBlobProperties(arc.container, path)
         if err == nil {
             srcSize = props.ContentLength
+            checksum, _ = base64.StdEncoding.DecodeString(props.ContentMD5)
             break
         }
 
         storErr, ok := err.(storage.AzureStorageServiceError)
         if ok {
             if storErr.StatusCode == 404 {
-                return arc.lcGet(strings.ToLower(path), metadata)
+                return arc.lcGet(ctx, strings.ToLower(path), metadata)
             }
         } else if strings.Contains(err.Error(), "404") {
-            return arc.lcGet(strings.ToLower(path), metadata)
+            return arc.lcGet(ctx, strings.ToLower(path), metadata)
         } else {
             Log.Debug("AzureReadCache get error (%s): %T %v", path, err, err)
         }
 
-        <-time.After(HttpRetryIntervalSec * time.Second)
+        serr := sleepContext(ctx, HttpRetryIntervalSec*time.Second)
+        if serr != nil {
+            return GetLengthUnknown, nil, azureError("Get", path, serr)
+        }
     }
 
     for i := 0; i < HttpMaxRetries; i++ {
@@ -75,27 +89,30 @@ func (arc *AzureReadCache) Get(path string, metadata interface{}) (int64, io.Rea
         storErr, ok := err.(storage.AzureStorageServiceError)
         if ok {
             if storErr.StatusCode == 404 {
-                return arc.lcGet(strings.ToLower(path), metadata)
+                return arc.lcGet(ctx, strings.ToLower(path), metadata)
             }
         } else if strings.Contains(err.Error(), "404") {
-            return arc.lcGet(strings.ToLower(path), metadata)
+            return arc.lcGet(ctx, strings.ToLower(path), metadata)
         } else {
             Log.Debug("AzureReadCache get error (%s): %T %v", path, err, err)
         }
 
-        <-time.After(HttpRetryIntervalSec * time.Second)
+        serr := sleepContext(ctx, HttpRetryIntervalSec*time.Second)
+        if serr != nil {
+            return GetLengthUnknown, nil, azureError("Get", path, serr)
+        }
     }
 
     if err != nil {
-        return GetLengthUnknown, nil, err
+        return GetLengthUnknown, nil, azureError("Get", path, err)
     }
 
     Log.Debug("Returning reader for %s (len %d)", path, srcSize)
 
-    return srcSize, NewSafeReader(srcSize, reader, nil), nil
+    return srcSize, newAzureReader(srcSize, reader, checksum), nil
 }
 
-func (arc *AzureReadCache) lcGet(path string, metadata interface{}) (int64, io.Reader, error) {
+func (arc *AzureReadCache) lcGet(ctx context.Context, path string, metadata interface{}) (int64, io.Reader, error) {
     Log.Debug("AzureReadCache::lcGet %s", path)
 
     var err error
@@ -103,10 +120,12 @@ func (arc *AzureReadCache) lcGet(path string, metadata interface{}) (int64, io.R
     var srcSize int64
 
     var props *storage.BlobProperties
+    var checksum []byte
     for i := 0; i < HttpMaxRetries; i++ {
         props, err = arc.cli.GetBlobProperties(arc.container, path)
         if err == nil {
             srcSize = props.ContentLength
+            checksum, _ = base64.StdEncoding.DecodeString(props.ContentMD5)
             break
         }
 
@@ -121,11 +140,14 @@ func (arc *AzureReadCache) lcGet(path string, metadata interface{}) (int64, io.R
             Log.Debug("AzureReadCache get error (%s): %T %v", path, err, err)
         }
 
-        <-time.After(HttpRetryIntervalSec * time.Second)
+        serr := sleepContext(ctx, HttpRetryIntervalSec*time.Second)
+        if serr != nil {
+            return GetLengthUnknown, nil, azureError("Get", path, serr)
+        }
     }
 
     if err != nil {
-        return GetLengthUnknown, nil, err
+        return GetLengthUnknown, nil, azureError("Get", path, err)
     }
 
     for i := 0; i < HttpMaxRetries; i++ {
@@ -145,12 +167,176 @@ func (arc *AzureReadCache) lcGet(path string, metadata interface{}) (int64, io.R
             Log.Debug("AzureReadCache get error (%s): %T %v", path, err, err)
         }
 
-        <-time.After(HttpRetryIntervalSec * time.Second)
+        serr := sleepContext(ctx, HttpRetryIntervalSec*time.Second)
+        if serr != nil {
+            return GetLengthUnknown, nil, azureError("Get", path, serr)
+        }
     }
 
     if err != nil {
-        return GetLengthUnknown, nil, err
+        return GetLengthUnknown, nil, azureError("Get", path, err)
+    }
+
+    return srcSize, newAzureReader(srcSize, reader, checksum), nil
+}
+
+func (arc *AzureReadCache) GetRange(path string, metadata interface{}, offset, length int64) (int64, io.Reader, error) {
+    return arc.GetRangeContext(context.Background(), path, metadata, offset, length)
+}
+
+func (arc *AzureReadCache) GetRangeContext(
+    ctx context.Context,
+    path string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    Log.Debug("AzureReadCache::GetRange %s (%d, %d)", path, offset, length)
+
+    path, props, err := arc.getProperties(ctx, path)
+    if err != nil {
+        return GetLengthUnknown, nil, azureError("GetRange", path, err)
+    }
+
+    c, err := rangeLength(props.ContentLength, offset, length)
+    if err != nil {
+        return GetLengthUnknown, nil, azureError("GetRange", path, err)
+    }
+
+    if c == 0 {
+        return 0, NewSafeReader(0, strings.NewReader(""), nil), nil
+    }
+
+    bytesRange := fmt.Sprintf("%d-%d", offset, offset+c-1)
+
+    var reader io.ReadCloser
+    for i := 0; i < HttpMaxRetries; i++ {
+        reader, err = arc.cli.GetBlobRange(arc.container, path, bytesRange, nil)
+        if err == nil {
+            break
+        }
+
+        Log.Debug("AzureReadCache range error (%s): %T %v", path, err, err)
+
+        serr := sleepContext(ctx, HttpRetryIntervalSec*time.Second)
+        if serr != nil {
+            return GetLengthUnknown, nil, azureError("GetRange", path, serr)
+        }
+    }
+
+    if err != nil {
+        return GetLengthUnknown, nil, azureError("GetRange", path, err)
+    }
+
+    Log.Debug("Returning range reader for %s (len %d)", path, c)
+
+    return c, NewSafeReader(c, reader, nil), nil
+}
+
+func (arc *AzureReadCache) Stat(path string, metadata interface{}) (*CacheStat, error) {
+    return arc.StatContext(context.Background(), path, metadata)
+}
+
+// StatContext returns the blob's properties. The *storage.BlobProperties are
+// returned as the stat's Metadata.
+func (arc *AzureReadCache) StatContext(ctx context.Context, path string, metadata interface{}) (*CacheStat, error) {
+    Log.Debug("AzureReadCache::Stat %s", path)
+
+    _, props, err := arc.getProperties(ctx, path)
+    if err != nil {
+        return nil, azureError("Stat", path, err)
+    }
+
+    modTime, _ := http.ParseTime(props.LastModified)
+
+    return &CacheStat{
+        Metadata:   props,
+        ModTime:    modTime,
+        Size:       props.ContentLength,
+        StoredSize: props.ContentLength,
+    }, nil
+}
+
+// getProperties looks up a blob's properties, falling back to the lower-case
+// name as Get does. It returns the name which was found.
+func (arc *AzureReadCache) getProperties(ctx context.Context, path string) (string, *storage.BlobProperties, error) {
+    var err error
+    var props *storage.BlobProperties
+
+    names := []string{path}
+    if strings.ToLower(path) != path {
+        names = append(names, strings.ToLower(path))
+    }
+
+    for _, name := range names {
+        for i := 0; i < HttpMaxRetries; i++ {
+            props, err = arc.cli.GetBlobProperties(arc.container, name)
+            if err == nil {
+                return name, props, nil
+            }
+
+            if isAzureNotFound(err) {
+                break
+            }
+
+            Log.Debug("AzureReadCache get error (%s): %T %v", name, err, err)
+
+            serr := sleepContext(ctx, HttpRetryIntervalSec*time.Second)
+            if serr != nil {
+                return name, nil, serr
+            }
+        }
+
+        if !isAzureNotFound(err) {
+            break
+        }
+    }
+
+    return path, nil, err
+}
+
+func isAzureNotFound(err error) bool {
+    storErr, ok := err.(storage.AzureStorageServiceError)
+    if ok {
+        return storErr.StatusCode == 404
+    }
+
+    return strings.Contains(err.Error(), "404")
+}
+
+// azureError gives storage service errors the kind of their HTTP status.
+func azureError(op, path string, err error) error {
+    if err == nil {
+        return nil
+    }
+
+    storErr, ok := err.(storage.AzureStorageServiceError)
+    if ok {
+        return &CacheError{
+            Err:  err,
+            Key:  path,
+            Kind: statusKind(storErr.StatusCode),
+            Op:   op,
+        }
+    }
+
+    if isAzureNotFound(err) {
+        return &CacheError{
+            Err:  err,
+            Key:  path,
+            Kind: ErrDataNotFound,
+            Op:   op,
+        }
+    }
+
+    return classifyError(op, path, err)
+}
+
+// newAzureReader verifies the blob against its stored Content-MD5, when the
+// blob has one.
+func newAzureReader(srcSize int64, reader io.ReadCloser, checksum []byte) io.Reader {
+    if len(checksum) != md5.Size {
+        return NewSafeReader(srcSize, reader, nil)
     }
 
-    return srcSize, NewSafeReader(srcSize, reader, nil), nil
+    return NewSafeReaderChecksum(srcSize, reader, nil, md5.New(), checksum)
 }
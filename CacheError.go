@@ -0,0 +1,245 @@
+package cache
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "syscall"
+)
+
+// Error kinds. Errors returned by the caches in this package match at most
+// one of these, or ErrDataNotFound, with errors.Is.
+var (
+    ErrCorrupt    = errors.New("Cached data is corrupt")
+    ErrPermission = errors.New("Permission denied by cache")
+    ErrTimeout    = errors.New("Cache operation timed out")
+    ErrTransient  = errors.New("Temporary cache failure")
+)
+
+// CacheError is a failed cache operation. It matches its Kind with errors.Is
+// and unwraps to the backend's own error.
+type CacheError struct {
+    Err  error
+    Key  string
+    Kind error // ErrCorrupt, ErrDataNotFound, ErrPermission, ErrTimeout or ErrTransient
+    Op   string
+}
+
+// TierError is returned by HierarchicalCache when no tier could serve a
+// request. Errs holds each tier's error, the parent's first and then each
+// child's in order; tiers which cannot take part, such as those without Stat
+// support, are left out. It matches ErrDataNotFound if every tier missed, and
+// otherwise any kind which one of the tiers' errors matches.
+type TierError struct {
+    Errs []error
+    Key  string
+    Op   string
+}
+
+// ReplicationError is returned by HierarchicalCache when a Put or Delete
+// reached too few children for its consistency mode. Errs holds each child's
+// error in order, nil for the children which succeeded. It matches any kind
+// which one of the children's errors matches.
+type ReplicationError struct {
+    Errs []error
+    Key  string
+    Op   string
+}
+
+func (ce *CacheError) Error() string {
+    if ce.Op == "" {
+        return ce.Err.Error()
+    }
+
+    return fmt.Sprintf("%s %s: %v", ce.Op, ce.Key, ce.Err)
+}
+
+func (ce *CacheError) Is(target error) bool {
+    return ce.Kind != nil && target == ce.Kind
+}
+
+func (ce *CacheError) Unwrap() error {
+    return ce.Err
+}
+
+func (te *TierError) Error() string {
+    msgs := make([]string, len(te.Errs))
+    for i := range te.Errs {
+        msgs[i] = fmt.Sprintf("tier %d: %v", i, te.Errs[i])
+    }
+
+    return fmt.Sprintf("%s %s: %s", te.Op, te.Key, strings.Join(msgs, "; "))
+}
+
+func (te *TierError) Is(target error) bool {
+    if target == ErrDataNotFound {
+        for i := range te.Errs {
+            if !errors.Is(te.Errs[i], ErrDataNotFound) {
+                return false
+            }
+        }
+
+        return len(te.Errs) > 0
+    }
+
+    for i := range te.Errs {
+        if errors.Is(te.Errs[i], target) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (te *TierError) As(target interface{}) bool {
+    for i := range te.Errs {
+        if errors.As(te.Errs[i], target) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (re *ReplicationError) Error() string {
+    msgs := make([]string, 0, len(re.Errs))
+    for _, i := range re.Failed() {
+        msgs = append(msgs, fmt.Sprintf("child %d: %v", i, re.Errs[i]))
+    }
+
+    return fmt.Sprintf("%s %s: %d of %d children failed: %s", re.Op, re.Key, len(msgs), len(re.Errs), strings.Join(msgs, "; "))
+}
+
+// Failed returns the indexes of the children which failed.
+func (re *ReplicationError) Failed() []int {
+    failed := make([]int, 0, len(re.Errs))
+    for i := range re.Errs {
+        if re.Errs[i] != nil {
+            failed = append(failed, i)
+        }
+    }
+
+    return failed
+}
+
+func (re *ReplicationError) Is(target error) bool {
+    for i := range re.Errs {
+        if re.Errs[i] != nil && errors.Is(re.Errs[i], target) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (re *ReplicationError) As(target interface{}) bool {
+    for i := range re.Errs {
+        if re.Errs[i] != nil && errors.As(re.Errs[i], target) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// newTierError aggregates the errors of every tier. A plain miss on every
+// tier is reported as ErrDataNotFound itself.
+func newTierError(op, key string, errs []error) error {
+    plain := true
+    for i := range errs {
+        if errs[i] != ErrDataNotFound {
+            plain = false
+        }
+    }
+
+    if plain {
+        return ErrDataNotFound
+    }
+
+    return &TierError{
+        Errs: errs,
+        Key:  key,
+        Op:   op,
+    }
+}
+
+// classifyError wraps err in a CacheError of the kind it represents. Errors
+// which already have a kind, cancellations and errors of no known kind are
+// returned unchanged.
+func classifyError(op, key string, err error) error {
+    if err == nil || errors.Is(err, context.Canceled) {
+        return err
+    }
+
+    for _, kind := range []error{ErrCorrupt, ErrDataNotFound, ErrPermission, ErrTimeout, ErrTransient} {
+        if errors.Is(err, kind) {
+            return err
+        }
+    }
+
+    kind := errorKind(err)
+    if kind == nil {
+        return err
+    }
+
+    return &CacheError{
+        Err:  err,
+        Key:  key,
+        Kind: kind,
+        Op:   op,
+    }
+}
+
+func errorKind(err error) error {
+    var netErr net.Error
+
+    switch {
+    case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+        return ErrTimeout
+    case errors.Is(err, os.ErrNotExist):
+        return ErrDataNotFound
+    case errors.Is(err, os.ErrPermission):
+        return ErrPermission
+    case errors.As(err, &netErr) && netErr.Timeout():
+        return ErrTimeout
+    case errors.As(err, &netErr),
+        errors.Is(err, io.ErrUnexpectedEOF),
+        errors.Is(err, syscall.ECONNRESET),
+        errors.Is(err, syscall.ECONNREFUSED),
+        errors.Is(err, syscall.EPIPE):
+        return ErrTransient
+    }
+
+    return nil
+}
+
+// statusKind returns the kind of error an HTTP status represents. Client
+// errors without a more specific kind are treated as misses.
+func statusKind(status int) error {
+    switch {
+    case status == http.StatusUnauthorized, status == http.StatusForbidden:
+        return ErrPermission
+    case status == http.StatusRequestTimeout, status == http.StatusGatewayTimeout:
+        return ErrTimeout
+    case status == http.StatusTooManyRequests, status >= 500:
+        return ErrTransient
+    }
+
+    return ErrDataNotFound
+}
+
+// statusError returns the error for an unsuccessful HTTP status. It also
+// matches http.ErrMissingFile.
+func statusError(op, key string, status int, text string) error {
+    return &CacheError{
+        Err:  fmt.Errorf("%w (%s)", http.ErrMissingFile, text),
+        Key:  key,
+        Kind: statusKind(status),
+        Op:   op,
+    }
+}
@@ -1,21 +1,59 @@
 package cache
 
 import (
-    "bytes"
+    "context"
+    "errors"
+    "fmt"
     "io"
-    "time"
+    "io/ioutil"
+    "sync"
 
     "github.com/xaevman/crash"
 )
 
+const (
+    FillOnClose    FillClosePolicy = iota // finish reading the child in the background and fill
+    DiscardOnClose                        // stop reading the child and abandon the fill
+)
+
+var ErrFillAborted = errors.New("cache fill aborted")
+
+type FillClosePolicy int
+
+// CacheFiller tees a child stream into a Spool as it is read, then fills the
+// parent cache from the spool once the stream reaches EOF. Streams which end
+// in an error, or whose length differs from the expected size, are never
+// committed. Additional readers over the same bytes can be taken with
+// NewReader. Details the child reader learned about the entry, such as HTTP
+// validators, are stored with the fill, and entries it marks NoStore are
+// never filled.
 type CacheFiller struct {
-    buffer       bytes.Buffer
-    cache        WriteCache
-    data         io.Reader
-    fillComplete chan int64
-    metadata     interface{}
-    path         string
-    tee          io.Reader
+    aborted  bool
+    cache    WriteCache
+    policy   FillClosePolicy
+    cond     *sync.Cond
+    ctx      context.Context
+    data     io.Reader
+    done     bool
+    err      error
+    expected int64
+    fill     int64
+    fillDone chan struct{}
+    lock     sync.Mutex
+    metadata interface{}
+    path     string
+    open     int
+    reading  bool // a Read of the child is under way
+    refs     int
+    skip     bool // share the child stream, but never fill
+    spool    *Spool
+    spoolErr error
+}
+
+type cacheFillerReader struct {
+    filler   *CacheFiller
+    offset   int64
+    released bool
 }
 
 func NewCacheFiller(
@@ -23,56 +61,339 @@ func NewCacheFiller(
     metadata interface{},
     parent WriteCache,
     child io.Reader,
+) *CacheFiller {
+    return NewCacheFillerContext(context.Background(), path, metadata, parent, child)
+}
+
+// NewCacheFillerContext is like NewCacheFiller, but the fill into parent is
+// abandoned if ctx is done before it completes.
+func NewCacheFillerContext(
+    ctx context.Context,
+    path string,
+    metadata interface{},
+    parent WriteCache,
+    child io.Reader,
 ) *CacheFiller {
     cr := &CacheFiller{
-        cache:        parent,
-        data:         child,
-        fillComplete: make(chan int64, 0),
-        metadata:     metadata,
-        path:         path,
+        cache:    parent,
+        ctx:      ctx,
+        data:     child,
+        expected: GetLengthUnknown,
+        fillDone: make(chan struct{}),
+        metadata: mergeEntryMetadata(metadata, readerMetadata(child)),
+        path:     path,
+        refs:     1,
+        spool:    NewSpool("", DefaultSpoolThreshold),
     }
 
-    cr.tee = io.TeeReader(cr.data, &cr.buffer)
+    cr.cond = sync.NewCond(&cr.lock)
 
     return cr
 }
 
 func WaitForCacheFill(reader io.Reader) int64 {
-    cf, ok := reader.(*CacheFiller)
+    cf, ok := reader.(cacheFillWaiter)
     if !ok {
         return 0
     }
 
-    return <-cf.fillComplete
+    return cf.waitForCacheFill()
+}
+
+// cacheFillWaiter is implemented by readers which fill a cache as they are
+// consumed.
+type cacheFillWaiter interface {
+    waitForCacheFill() int64
+}
+
+// Close stops reading from the CacheFiller. Under FillOnClose the rest of the
+// child stream is read in the background so that the fill can complete; under
+// DiscardOnClose the child is closed and the fill abandoned.
+func (cf *CacheFiller) Close() error {
+    cf.lock.Lock()
+    done := cf.done
+    cf.lock.Unlock()
+
+    if done {
+        return nil
+    }
+
+    if cf.policy == DiscardOnClose {
+        cf.abort()
+        return nil
+    }
+
+    go func() {
+        defer crash.HandleAll()
+        io.Copy(ioutil.Discard, cf)
+    }()
+
+    return nil
+}
+
+// NewReader returns an independent reader over the child stream. It only
+// sees data as the CacheFiller itself is read, so something must drive Read
+// to completion. Under DiscardOnClose, closing the last open reader before
+// the stream completes aborts the fill.
+func (cf *CacheFiller) NewReader() io.ReadCloser {
+    cf.lock.Lock()
+    defer cf.lock.Unlock()
+
+    cf.open++
+    cf.refs++
+
+    return &cacheFillerReader{
+        filler: cf,
+    }
 }
 
 func (cf *CacheFiller) Read(p []byte) (int, error) {
-    c, err := cf.tee.Read(p)
-    if err == io.EOF {
-        Log.Debug("EOF reached after %d bytes", cf.buffer.Len())
-
-        go func() {
-            defer crash.HandleAll()
-            defer close(cf.fillComplete)
-
-            c, err := cf.cache.Put(cf.path, cf.metadata, &cf.buffer)
-            if err != nil {
-                Log.Debug("CacheFiller fill error %s: %v", cf.path, err)
-                cf.fillComplete <- CacheFillError
-                return
-            }
-
-            select {
-            case cf.fillComplete <- c:
-                Log.Debug("fillComplete %s: %d bytes", cf.path, c)
-                break
-            case <-time.After(3 * time.Minute):
-                Log.Debug("fillComplete timeout (%s)", cf.path)
-                cf.fillComplete <- CacheFillTimeout
-                break
-            }
-        }()
+    cf.lock.Lock()
+    if cf.aborted {
+        cf.lock.Unlock()
+        return 0, ErrFillAborted
+    }
+    cf.reading = true
+    cf.lock.Unlock()
+
+    c, err := cf.data.Read(p)
+
+    cf.lock.Lock()
+    cf.reading = false
+    if cf.aborted {
+        // abort left the child for this Read to close
+        cf.lock.Unlock()
+        cf.closeChild()
+        return 0, ErrFillAborted
+    }
+    if c > 0 {
+        if cf.spoolErr == nil {
+            _, cf.spoolErr = cf.spool.Write(p[:c])
+        }
+        cf.cond.Broadcast()
+    }
+    cf.lock.Unlock()
+
+    if err == io.EOF && cf.expected > -1 && cf.spool.Size() != cf.expected {
+        err = fmt.Errorf(
+            "%w (%d != %d)",
+            ErrReadSizeMismatch,
+            cf.spool.Size(),
+            cf.expected,
+        )
+    }
+
+    if err != nil {
+        cf.finish(err)
     }
 
     return c, err
 }
+
+// SetClosePolicy sets what happens to the fill when the CacheFiller, or the
+// last of its readers, is closed before the child stream is complete.
+func (cf *CacheFiller) SetClosePolicy(policy FillClosePolicy) {
+    cf.policy = policy
+}
+
+// SetExpectedSize sets the length the child stream must have for the fill to
+// be committed. It must be called before the first Read.
+func (cf *CacheFiller) SetExpectedSize(size int64) {
+    cf.expected = size
+}
+
+// SetSpool sets where the child stream is staged. Streams larger than
+// threshold bytes are written to a temp file in dir. It must be called
+// before the first Read.
+func (cf *CacheFiller) SetSpool(dir string, threshold int64) {
+    cf.spool = NewSpool(dir, threshold)
+}
+
+func (cf *CacheFiller) finish(err error) {
+    cf.lock.Lock()
+    if cf.done {
+        cf.lock.Unlock()
+        return
+    }
+
+    cf.done = true
+    cf.err = err
+    aborted := cf.aborted
+    spoolErr := cf.spoolErr
+    cf.cond.Broadcast()
+    cf.lock.Unlock()
+
+    if err != io.EOF || spoolErr != nil {
+        Log.Debug("CacheFiller not filling %s: %v %v", cf.path, err, spoolErr)
+
+        switch {
+        case aborted:
+            cf.setFill(CacheFillAborted)
+        case spoolErr != nil:
+            cf.setFill(CacheFillError)
+        case errors.Is(err, ErrChecksumMismatch):
+            cf.setFill(CacheFillCorrupt)
+        default:
+            cf.setFill(CacheFillIncomplete)
+        }
+
+        cf.release()
+        return
+    }
+
+    Log.Debug("EOF reached after %d bytes", cf.spool.Size())
+
+    em := GetEntryMetadata(cf.metadata)
+    if cf.skip || (em != nil && em.NoStore) {
+        Log.Debug("CacheFiller not filling %s: not to be stored", cf.path)
+        cf.setFill(CacheFillSkipped)
+        cf.release()
+        return
+    }
+
+    go func() {
+        defer crash.HandleAll()
+        defer cf.release()
+
+        c, err := WithWriteContext(cf.cache).PutContext(cf.ctx, cf.path, cf.metadata, cf.spool.NewReader())
+        if err != nil {
+            Log.Debug("CacheFiller fill error %s: %v", cf.path, err)
+            cf.setFill(CacheFillError)
+            return
+        }
+
+        Log.Debug("fillComplete %s: %d bytes", cf.path, c)
+        cf.setFill(c)
+    }()
+}
+
+// abort abandons the fill. The child is closed at once if nothing is
+// reading it, or else by the Read under way once it returns, since most
+// readers cannot be closed during a Read.
+func (cf *CacheFiller) abort() {
+    Log.Debug("CacheFiller aborting fill %s", cf.path)
+
+    cf.lock.Lock()
+    aborted := cf.aborted
+    reading := cf.reading
+    cf.aborted = true
+    cf.lock.Unlock()
+
+    if !aborted && !reading {
+        cf.closeChild()
+    }
+
+    cf.finish(ErrFillAborted)
+}
+
+func (cf *CacheFiller) closeChild() {
+    rc, ok := cf.data.(io.Closer)
+    if ok {
+        rc.Close()
+    }
+}
+
+func (cf *CacheFiller) release() {
+    cf.lock.Lock()
+    defer cf.lock.Unlock()
+
+    cf.refs--
+    if cf.refs == 0 {
+        cf.spool.Close()
+    }
+}
+
+func (cf *CacheFiller) retain() {
+    cf.lock.Lock()
+    defer cf.lock.Unlock()
+
+    cf.refs++
+}
+
+func (cf *CacheFiller) setFill(c int64) {
+    cf.fill = c
+    close(cf.fillDone)
+}
+
+func (cf *CacheFiller) waitForCacheFill() int64 {
+    <-cf.fillDone
+    return cf.fill
+}
+
+func (cfr *cacheFillerReader) Read(p []byte) (int, error) {
+    cf := cfr.filler
+
+    cf.lock.Lock()
+    defer cf.lock.Unlock()
+
+    if cfr.released {
+        return 0, io.EOF
+    }
+
+    for cfr.offset >= cf.spool.Size() && !cf.done && cf.spoolErr == nil {
+        cf.cond.Wait()
+    }
+
+    if cf.spoolErr != nil {
+        return 0, cf.spoolErr
+    }
+
+    available := cf.spool.Size() - cfr.offset
+    if available > 0 {
+        if int64(len(p)) > available {
+            p = p[:available]
+        }
+
+        c, err := cf.spool.ReadAt(p, cfr.offset)
+        cfr.offset += int64(c)
+        if err == io.EOF && c > 0 {
+            err = nil
+        }
+
+        return c, err
+    }
+
+    // all data consumed
+    cfr.released = true
+    cf.open--
+    cf.refs--
+    if cf.refs == 0 {
+        cf.spool.Close()
+    }
+
+    return 0, cf.err
+}
+
+func (cfr *cacheFillerReader) Close() error {
+    cf := cfr.filler
+
+    cf.lock.Lock()
+    if cfr.released {
+        cf.lock.Unlock()
+        return nil
+    }
+
+    cfr.released = true
+    cf.open--
+    cf.refs--
+    if cf.refs == 0 {
+        cf.spool.Close()
+    }
+
+    abort := !cf.done && cf.open == 0 && cf.policy == DiscardOnClose
+    cf.lock.Unlock()
+
+    if abort {
+        cf.abort()
+    }
+
+    return nil
+}
+
+func (cfr *cacheFillerReader) entryMetadata() *EntryMetadata {
+    return GetEntryMetadata(cfr.filler.metadata)
+}
+
+func (cfr *cacheFillerReader) waitForCacheFill() int64 {
+    return cfr.filler.waitForCacheFill()
+}
@@ -0,0 +1,458 @@
+package cache
+
+import (
+    "bytes"
+    "compress/zlib"
+    "encoding/binary"
+    "errors"
+    "io"
+    "io/ioutil"
+)
+
+// Compressed cache entries are written as a magic header followed by a
+// sequence of independently compressed frames:
+//
+//   [rawLen uint32][compLen uint32][compLen bytes of zlib data]
+//
+// then an empty frame header marking the end of the frames, an index of
+// every frame and a footer:
+//
+//   [rawOffset uint64][fileOffset uint64] for each frame
+//   [size uint64][frames uint64]
+//
+// The footer gives the decompressed size, and the index the frame holding
+// any offset, with a few small reads however large the entry. Entries
+// written with chunkedMagicV1 have no index, and their frame headers are
+// walked instead.
+const (
+    chunkedMagic     = "XCZ2"
+    chunkedMagicV1   = "XCZ1" // frames only
+    chunkedChunkSize = 1024 * 1024
+    chunkedFooterLen = 16
+    chunkedHeaderLen = 8
+    chunkedIndexLen  = 16 // per frame
+)
+
+// ErrCorruptChunk matches ErrCorrupt.
+var ErrCorruptChunk error = &CacheError{Err: errors.New("Corrupt compressed chunk"), Kind: ErrCorrupt}
+
+type chunkedWriter struct {
+    buffer  bytes.Buffer
+    dst     io.Writer
+    frame   bytes.Buffer
+    header  bool
+    index   []byte // an index entry for each frame written
+    offset  int64  // bytes written to dst
+    rawSize int64
+}
+
+// chunkedIndex is where the index of an entry's frames starts, and what the
+// footer says of it.
+type chunkedIndex struct {
+    frames int64
+    offset int64
+    size   int64
+}
+
+type chunkedReader struct {
+    current io.ReadCloser
+    src     io.Reader
+}
+
+func newChunkedWriter(dst io.Writer) *chunkedWriter {
+    return &chunkedWriter{
+        dst: dst,
+    }
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+    written := 0
+
+    for len(p) > 0 {
+        c := chunkedChunkSize - cw.buffer.Len()
+        if c > len(p) {
+            c = len(p)
+        }
+
+        cw.buffer.Write(p[:c])
+        written += c
+        p = p[c:]
+
+        if cw.buffer.Len() >= chunkedChunkSize {
+            err := cw.flush()
+            if err != nil {
+                return written, err
+            }
+        }
+    }
+
+    return written, nil
+}
+
+// Close flushes any buffered data, then writes the index and footer. It does
+// not close the destination.
+func (cw *chunkedWriter) Close() error {
+    err := cw.flush()
+    if err != nil {
+        return err
+    }
+
+    frames := int64(len(cw.index) / chunkedIndexLen)
+
+    tail := make([]byte, chunkedHeaderLen, chunkedHeaderLen+len(cw.index)+chunkedFooterLen)
+    tail = append(tail, cw.index...)
+    tail = binary.BigEndian.AppendUint64(tail, uint64(cw.rawSize))
+    tail = binary.BigEndian.AppendUint64(tail, uint64(frames))
+
+    return cw.write(tail)
+}
+
+func (cw *chunkedWriter) flush() error {
+    if !cw.header {
+        err := cw.write([]byte(chunkedMagic))
+        if err != nil {
+            return err
+        }
+
+        cw.header = true
+    }
+
+    if cw.buffer.Len() == 0 {
+        return nil
+    }
+
+    cw.frame.Reset()
+    zw := zlib.NewWriter(&cw.frame)
+    zw.Write(cw.buffer.Bytes())
+    err := zw.Close()
+    if err != nil {
+        return err
+    }
+
+    cw.index = binary.BigEndian.AppendUint64(cw.index, uint64(cw.rawSize))
+    cw.index = binary.BigEndian.AppendUint64(cw.index, uint64(cw.offset))
+
+    header := make([]byte, chunkedHeaderLen)
+    binary.BigEndian.PutUint32(header[0:4], uint32(cw.buffer.Len()))
+    binary.BigEndian.PutUint32(header[4:8], uint32(cw.frame.Len()))
+
+    err = cw.write(header)
+    if err != nil {
+        return err
+    }
+
+    err = cw.write(cw.frame.Bytes())
+    if err != nil {
+        return err
+    }
+
+    cw.rawSize += int64(cw.buffer.Len())
+    cw.buffer.Reset()
+
+    return nil
+}
+
+func (cw *chunkedWriter) write(p []byte) error {
+    c, err := cw.dst.Write(p)
+    cw.offset += int64(c)
+
+    return err
+}
+
+// newChunkedReader decompresses frames from src, which must be positioned at
+// a frame header (i.e. past the magic).
+func newChunkedReader(src io.Reader) *chunkedReader {
+    return &chunkedReader{
+        src: src,
+    }
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+    for {
+        if cr.current == nil {
+            rawLen, compLen, err := readChunkHeader(cr.src)
+            if err != nil {
+                return 0, err
+            }
+
+            zr, err := zlib.NewReader(io.LimitReader(cr.src, compLen))
+            if err != nil {
+                return 0, ErrCorruptChunk
+            }
+
+            cr.current = zr
+            Log.Debug("chunkedReader frame %d -> %d bytes", compLen, rawLen)
+        }
+
+        c, err := cr.current.Read(p)
+        if err == io.EOF {
+            cr.current.Close()
+            cr.current = nil
+            if c == 0 {
+                continue
+            }
+
+            err = nil
+        }
+
+        return c, err
+    }
+}
+
+func (cr *chunkedReader) Close() error {
+    if cr.current != nil {
+        return cr.current.Close()
+    }
+
+    return nil
+}
+
+// isChunked reports whether src starts with either chunked magic, consuming
+// it if so and rewinding otherwise.
+func isChunked(src io.ReadSeeker) (bool, error) {
+    magic := make([]byte, len(chunkedMagic))
+
+    _, err := io.ReadFull(src, magic)
+    if err == nil && (string(magic) == chunkedMagic || string(magic) == chunkedMagicV1) {
+        return true, nil
+    }
+
+    _, serr := src.Seek(0, io.SeekStart)
+    if serr != nil {
+        return false, serr
+    }
+
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        err = nil
+    }
+
+    return false, err
+}
+
+// readChunkHeader reads a frame header, returning io.EOF at the end of the
+// frames.
+func readChunkHeader(src io.Reader) (int64, int64, error) {
+    header := make([]byte, chunkedHeaderLen)
+
+    _, err := io.ReadFull(src, header)
+    if err == io.ErrUnexpectedEOF {
+        return 0, 0, ErrCorruptChunk
+    }
+    if err != nil {
+        return 0, 0, err
+    }
+
+    rawLen := int64(binary.BigEndian.Uint32(header[0:4]))
+    compLen := int64(binary.BigEndian.Uint32(header[4:8]))
+
+    // frames are never empty, so an empty header ends them
+    if rawLen == 0 && compLen == 0 {
+        return 0, 0, io.EOF
+    }
+
+    return rawLen, compLen, nil
+}
+
+// readChunkedIndex returns the index of src, which must be just past the
+// magic, leaving it positioned there again. It returns nil for entries
+// written without one.
+func readChunkedIndex(src io.ReadSeeker) (*chunkedIndex, error) {
+    _, err := src.Seek(0, io.SeekStart)
+    if err != nil {
+        return nil, err
+    }
+
+    magic := make([]byte, len(chunkedMagic))
+    _, err = io.ReadFull(src, magic)
+    if err != nil {
+        return nil, err
+    }
+
+    if string(magic) != chunkedMagic {
+        return nil, nil
+    }
+
+    end, err := src.Seek(-chunkedFooterLen, io.SeekEnd)
+    if err != nil {
+        return nil, ErrCorruptChunk
+    }
+
+    footer := make([]byte, chunkedFooterLen)
+    _, err = io.ReadFull(src, footer)
+    if err != nil {
+        return nil, ErrCorruptChunk
+    }
+
+    ci := &chunkedIndex{
+        frames: int64(binary.BigEndian.Uint64(footer[8:16])),
+        size:   int64(binary.BigEndian.Uint64(footer[0:8])),
+    }
+    ci.offset = end - ci.frames*chunkedIndexLen
+
+    if ci.frames < 0 || ci.size < 0 || ci.offset < int64(len(chunkedMagic)) {
+        return nil, ErrCorruptChunk
+    }
+
+    _, err = src.Seek(int64(len(chunkedMagic)), io.SeekStart)
+    if err != nil {
+        return nil, err
+    }
+
+    return ci, nil
+}
+
+// entry returns the decompressed offset at which frame i starts, and where
+// its header is in src.
+func (ci *chunkedIndex) entry(src io.ReadSeeker, i int64) (int64, int64, error) {
+    _, err := src.Seek(ci.offset+i*chunkedIndexLen, io.SeekStart)
+    if err != nil {
+        return 0, 0, err
+    }
+
+    entry := make([]byte, chunkedIndexLen)
+    _, err = io.ReadFull(src, entry)
+    if err != nil {
+        return 0, 0, ErrCorruptChunk
+    }
+
+    return int64(binary.BigEndian.Uint64(entry[0:8])), int64(binary.BigEndian.Uint64(entry[8:16])), nil
+}
+
+// seek positions src at the start of the frame containing offset, by a
+// binary search of the index. It returns how many decompressed bytes of that
+// frame precede offset.
+func (ci *chunkedIndex) seek(src io.ReadSeeker, offset int64) (int64, error) {
+    if offset > ci.size {
+        return 0, ErrInvalidRange
+    }
+
+    // the end of the data is where the frames end
+    if offset == ci.size {
+        _, err := src.Seek(ci.offset-chunkedHeaderLen, io.SeekStart)
+        return 0, err
+    }
+
+    lo, hi := int64(0), ci.frames-1
+    for lo < hi {
+        mid := lo + (hi-lo+1)/2
+
+        start, _, err := ci.entry(src, mid)
+        if err != nil {
+            return 0, err
+        }
+
+        if start <= offset {
+            lo = mid
+        } else {
+            hi = mid - 1
+        }
+    }
+
+    start, pos, err := ci.entry(src, lo)
+    if err != nil {
+        return 0, err
+    }
+
+    if start > offset || pos >= ci.offset {
+        return 0, ErrCorruptChunk
+    }
+
+    _, err = src.Seek(pos, io.SeekStart)
+    if err != nil {
+        return 0, err
+    }
+
+    return offset - start, nil
+}
+
+// seekChunked positions src, which must be just past the magic, at the start
+// of the frame containing offset. It returns how many decompressed bytes of
+// that frame precede offset.
+func seekChunked(src io.ReadSeeker, offset int64) (int64, error) {
+    ci, err := readChunkedIndex(src)
+    if err != nil {
+        return 0, err
+    }
+
+    if ci != nil {
+        return ci.seek(src, offset)
+    }
+
+    for {
+        rawLen, compLen, err := readChunkHeader(src)
+        if err == io.EOF {
+            if offset == 0 {
+                return 0, nil
+            }
+
+            return 0, ErrInvalidRange
+        }
+        if err != nil {
+            return 0, err
+        }
+
+        if offset < rawLen {
+            _, err = src.Seek(-chunkedHeaderLen, io.SeekCurrent)
+            return offset, err
+        }
+
+        offset -= rawLen
+
+        _, err = src.Seek(compLen, io.SeekCurrent)
+        if err != nil {
+            return 0, err
+        }
+    }
+}
+
+// chunkedSize returns the decompressed length of src, which must be just
+// past the magic, from its footer, or by summing the length of every frame
+// for entries written without one.
+func chunkedSize(src io.ReadSeeker) (int64, error) {
+    ci, err := readChunkedIndex(src)
+    if err != nil {
+        return 0, err
+    }
+
+    if ci != nil {
+        return ci.size, nil
+    }
+
+    size := int64(0)
+
+    for {
+        rawLen, compLen, err := readChunkHeader(src)
+        if err == io.EOF {
+            return size, nil
+        }
+        if err != nil {
+            return 0, err
+        }
+
+        size += rawLen
+
+        _, err = src.Seek(compLen, io.SeekCurrent)
+        if err != nil {
+            return 0, err
+        }
+    }
+}
+
+// openChunkedRange returns a reader over the decompressed data of src from
+// offset onwards. src must be just past the magic.
+func openChunkedRange(src io.ReadSeeker, offset int64) (io.ReadCloser, error) {
+    skip, err := seekChunked(src, offset)
+    if err != nil {
+        return nil, err
+    }
+
+    cr := newChunkedReader(src)
+
+    _, err = io.CopyN(ioutil.Discard, cr, skip)
+    if err != nil {
+        cr.Close()
+        return nil, err
+    }
+
+    return cr, nil
+}
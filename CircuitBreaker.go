@@ -0,0 +1,164 @@
+package cache
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "time"
+)
+
+const (
+    CircuitClosed   CircuitState = iota // the child is healthy and is asked as usual
+    CircuitOpen                         // the child is failing and is skipped
+    CircuitHalfOpen                     // the child is being probed with a single request
+)
+
+// ErrCircuitOpen is returned in place of a child's answer while its circuit
+// is open.
+var ErrCircuitOpen error = &CacheError{
+    Err:  errors.New("Child cache skipped while unhealthy"),
+    Kind: ErrTransient,
+}
+
+type CircuitState int
+
+// ChildHealth is a snapshot of how a HierarchicalCache's child has been
+// answering. Only transient failures and timeouts count against a child;
+// misses and other errors show the child is reachable.
+type ChildHealth struct {
+    Child               ReadCache
+    ConsecutiveFailures int
+    Failures            int64
+    LastError           error
+    LastFailure         time.Time
+    Requests            int64
+    RetryAt             time.Time // when an open circuit next lets a probe through
+    State               CircuitState
+}
+
+// circuitBreaker tracks the health of a single child. Once threshold
+// consecutive requests fail, the circuit opens and the child is skipped for
+// cooldown. A single probe request is then let through: the circuit closes
+// again if it succeeds, and reopens if it fails.
+type circuitBreaker struct {
+    cooldown    time.Duration
+    consecutive int
+    failures    int64
+    lastErr     error
+    lastFailure time.Time
+    lock        sync.Mutex
+    probing     bool
+    requests    int64
+    retryAt     time.Time
+    state       CircuitState
+    threshold   int // zero to never open
+}
+
+func (cs CircuitState) String() string {
+    switch cs {
+    case CircuitClosed:
+        return "closed"
+    case CircuitOpen:
+        return "open"
+    case CircuitHalfOpen:
+        return "half-open"
+    }
+
+    return "unknown"
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+    return &circuitBreaker{
+        cooldown:  cooldown,
+        threshold: threshold,
+    }
+}
+
+// allow reports whether the child may be asked. Every allowed request must
+// be followed by a call to record.
+func (cb *circuitBreaker) allow() bool {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+
+    switch cb.state {
+    case CircuitOpen:
+        if time.Now().Before(cb.retryAt) {
+            return false
+        }
+
+        cb.state = CircuitHalfOpen
+    case CircuitHalfOpen:
+        if cb.probing {
+            return false
+        }
+    }
+
+    cb.probing = cb.state == CircuitHalfOpen
+    cb.requests++
+
+    return true
+}
+
+func (cb *circuitBreaker) configure(threshold int, cooldown time.Duration) {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+
+    cb.cooldown = cooldown
+    cb.threshold = threshold
+
+    if threshold <= 0 {
+        cb.probing = false
+        cb.state = CircuitClosed
+    }
+}
+
+// record notes the outcome of an allowed request.
+func (cb *circuitBreaker) record(err error) {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+
+    cb.probing = false
+
+    // abandoned and unsupported requests say nothing about the child
+    if errors.Is(err, context.Canceled) || err == ErrNotSupported {
+        cb.requests--
+        return
+    }
+
+    if !errors.Is(err, ErrTransient) && !errors.Is(err, ErrTimeout) {
+        cb.consecutive = 0
+        cb.state = CircuitClosed
+        return
+    }
+
+    cb.consecutive++
+    cb.failures++
+    cb.lastErr = err
+    cb.lastFailure = time.Now()
+
+    if cb.threshold > 0 && (cb.state == CircuitHalfOpen || cb.consecutive >= cb.threshold) {
+        cb.state = CircuitOpen
+        cb.retryAt = cb.lastFailure.Add(cb.cooldown)
+    }
+}
+
+func (cb *circuitBreaker) snapshot(child ReadCache) ChildHealth {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+
+    health := ChildHealth{
+        Child:               child,
+        ConsecutiveFailures: cb.consecutive,
+        Failures:            cb.failures,
+        LastError:           cb.lastErr,
+        LastFailure:         cb.lastFailure,
+        Requests:            cb.requests,
+        State:               cb.state,
+    }
+
+    if cb.state == CircuitOpen {
+        health.RetryAt = cb.retryAt
+    }
+
+    return health
+}
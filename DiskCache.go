@@ -2,7 +2,8 @@ package cache
 
 import (
     "compress/zlib"
-    "fmt"
+    "context"
+    "encoding/json"
     "io"
     "io/ioutil"
     "os"
@@ -15,6 +16,10 @@ const (
     FsRetryIntervalSec = 1
 )
 
+// entry metadata (e.g. expiry) is kept in a mirror of the cache tree under
+// this directory of the cache root
+const diskMetaDir = ".cachemeta"
+
 type DiskCache struct {
     compress bool
     root     string // the root directory of the file cache
@@ -22,14 +27,22 @@ type DiskCache struct {
 }
 
 func NewDiskCache(root, tmp string, compress bool) *HierarchicalCache {
-    return NewHierarchicalCache(&DiskCache{
+    hc := NewHierarchicalCache(&DiskCache{
         root:     root,
         tmpRoot:  tmp,
         compress: compress,
     })
+
+    hc.SetSpool(tmp, DefaultSpoolThreshold)
+
+    return hc
 }
 
-func (dc *DiskCache) Delete(path string, metadta interface{}) error {
+func (dc *DiskCache) Delete(path string, metadata interface{}) error {
+    return dc.DeleteContext(context.Background(), path, metadata)
+}
+
+func (dc *DiskCache) DeleteContext(ctx context.Context, path string, metadata interface{}) error {
     fullPath := filepath.Join(dc.root, path)
 
     Log.Debug("DiskCache::Delete %s", fullPath)
@@ -40,65 +53,164 @@ func (dc *DiskCache) Delete(path string, metadta interface{}) error {
     for retries < FsMaxRetries {
         err = os.Remove(fullPath)
         if err == nil || os.IsNotExist(err) {
+            os.Remove(dc.metaPath(path))
             return nil
         }
 
         Log.Debug("Delete %s failed (retry %d): %v", path, retries, err)
         retries++
 
-        <-time.After(time.Duration(FsRetryIntervalSec) * time.Second)
+        serr := sleepContext(ctx, time.Duration(FsRetryIntervalSec)*time.Second)
+        if serr != nil {
+            return classifyError("Delete", path, serr)
+        }
     }
 
-    return err
+    return classifyError("Delete", path, err)
 }
 
 func (dc *DiskCache) Get(path string, metadata interface{}) (int64, io.Reader, error) {
+    return dc.GetContext(context.Background(), path, metadata)
+}
+
+func (dc *DiskCache) GetContext(ctx context.Context, path string, metadata interface{}) (int64, io.Reader, error) {
     Log.Debug("DiskCache::Get %s", path)
 
-    // try getting from this cache
-    fullPath := filepath.Join(dc.root, path)
+    if dc.expired(ctx, path) {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
 
-    retries := 0
+    f, err := dc.open(ctx, path)
+    if err != nil {
+        return GetLengthUnknown, nil, classifyError("Get", path, err)
+    }
 
-    for retries < FsMaxRetries {
-        f, err := os.Open(fullPath)
-        if err == nil || os.IsNotExist(err) {
-            if dc.compress {
-                zr, err := zlib.NewReader(f)
-                if err != nil {
-                    f.Close()
-                    return GetLengthUnknown, nil, fmt.Errorf(
-                        "Cache file found (%s) but decompression failed: %v",
-                        path,
-                        err,
-                    )
-                } else {
-                    return GetLengthUnknown, NewSafeReader(GetLengthUnknown, zr, f), err
-                }
-            } else {
-                fi, err := f.Stat()
-                if err != nil {
-                    f.Close()
-                    return GetLengthUnknown, nil, fmt.Errorf(
-                        "Cache file found (%s) but stat failed: %v",
-                        path,
-                        err,
-                    )
+    if dc.compress {
+        chunked, err := isChunked(f)
+        if err != nil {
+            f.Close()
+            return GetLengthUnknown, nil, classifyError("Get", path, err)
+        }
+
+        if !chunked {
+            // written before the chunked layout existed
+            zr, err := zlib.NewReader(f)
+            if err != nil {
+                f.Close()
+                return GetLengthUnknown, nil, &CacheError{
+                    Err:  err,
+                    Key:  path,
+                    Kind: ErrCorrupt,
+                    Op:   "Get",
                 }
+            }
+
+            return GetLengthUnknown, NewSafeReader(GetLengthUnknown, zr, f), nil
+        }
 
-                Log.Debug("DiskCache data size %d", fi.Size())
-                return fi.Size(), NewSafeReader(fi.Size(), f, nil), err
+        size, err := dc.chunkedSize(f)
+        if err != nil {
+            f.Close()
+            return GetLengthUnknown, nil, &CacheError{
+                Err:  err,
+                Key:  path,
+                Kind: ErrCorrupt,
+                Op:   "Get",
             }
         }
 
-        Log.Debug("Open %s failed (retry %d): %v", path, retries, err)
-        retries++
+        Log.Debug("DiskCache data size %d", size)
+        return size, NewSafeReader(size, newChunkedReader(f), f), nil
+    }
+
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return GetLengthUnknown, nil, classifyError("Get", path, err)
+    }
+
+    Log.Debug("DiskCache data size %d", fi.Size())
+    return fi.Size(), NewSafeReader(fi.Size(), f, nil), nil
+}
+
+func (dc *DiskCache) GetRange(path string, metadata interface{}, offset, length int64) (int64, io.Reader, error) {
+    return dc.GetRangeContext(context.Background(), path, metadata, offset, length)
+}
+
+func (dc *DiskCache) GetRangeContext(
+    ctx context.Context,
+    path string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    Log.Debug("DiskCache::GetRange %s (%d, %d)", path, offset, length)
+
+    if dc.expired(ctx, path) {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
+
+    f, err := dc.open(ctx, path)
+    if err != nil {
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+    }
+
+    if dc.compress {
+        chunked, err := isChunked(f)
+        if err != nil {
+            f.Close()
+            return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+        }
+
+        if !chunked {
+            zr, err := zlib.NewReader(f)
+            if err != nil {
+                f.Close()
+                return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+            }
+
+            return skipRange(GetLengthUnknown, NewSafeReader(GetLengthUnknown, zr, f), offset, length)
+        }
+
+        size, err := dc.chunkedSize(f)
+        if err != nil {
+            f.Close()
+            return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+        }
+
+        c, err := rangeLength(size, offset, length)
+        if err != nil {
+            f.Close()
+            return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+        }
+
+        cr, err := openChunkedRange(f, offset)
+        if err != nil {
+            f.Close()
+            return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+        }
+
+        return c, limitRange(c, NewSafeReader(GetLengthUnknown, cr, f), length), nil
+    }
+
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+    }
 
-        <-time.After(time.Duration(FsRetryIntervalSec) * time.Second)
+    c, err := rangeLength(fi.Size(), offset, length)
+    if err != nil {
+        f.Close()
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+    }
+
+    _, err = f.Seek(offset, io.SeekStart)
+    if err != nil {
+        f.Close()
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
     }
 
-    // not found
-    return GetLengthUnknown, nil, ErrDataNotFound
+    return c, limitRange(c, f, length), nil
 }
 
 func (dc *DiskCache) GetRoot() string {
@@ -110,47 +222,296 @@ func (dc *DiskCache) GetTmpRoot() string {
 }
 
 func (dc *DiskCache) Put(path string, metadata interface{}, data io.Reader) (int64, error) {
+    return dc.PutContext(context.Background(), path, metadata, data)
+}
+
+func (dc *DiskCache) PutContext(ctx context.Context, path string, metadata interface{}, data io.Reader) (int64, error) {
     Log.Debug("DiskCache::Put %s", path)
 
     // write to a tmp file first
     err := os.MkdirAll(dc.tmpRoot, 0770)
     if err != nil {
-        return 0, err
+        return 0, classifyError("Put", path, err)
     }
 
     f, err := ioutil.TempFile(dc.tmpRoot, "")
     if err != nil {
-        return 0, err
+        return 0, classifyError("Put", path, err)
     }
 
     var count int64
+    data = &contextReader{ctx: ctx, source: data}
 
     if dc.compress {
-        writer := zlib.NewWriter(f)
+        writer := newChunkedWriter(f)
 
         count, err = io.Copy(writer, data)
-        if err != nil {
-            writer.Close()
-            f.Close()
-            return 0, err
+        if err == nil {
+            // the last frame and the index are only written now
+            err = writer.Close()
         }
-
-        writer.Close()
-        f.Close()
     } else {
         count, err = io.Copy(f, data)
-        if err != nil {
-            f.Close()
-            return 0, err
+    }
+
+    cerr := f.Close()
+    if err == nil {
+        err = cerr
+    }
+
+    if err != nil {
+        os.Remove(f.Name())
+        return 0, classifyError("Put", path, err)
+    }
+
+    err = dc.commit(ctx, f.Name(), path)
+    if err != nil {
+        return 0, classifyError("Put", path, err)
+    }
+
+    return count, dc.writeMetadata(path, storedMetadata(metadata))
+}
+
+func (dc *DiskCache) Stat(path string, metadata interface{}) (*CacheStat, error) {
+    return dc.StatContext(context.Background(), path, metadata)
+}
+
+func (dc *DiskCache) StatContext(ctx context.Context, path string, metadata interface{}) (*CacheStat, error) {
+    Log.Debug("DiskCache::Stat %s", path)
+
+    em, err := dc.readMetadata(path)
+    if err != nil {
+        return nil, classifyError("Stat", path, err)
+    }
+
+    // stale entries are still reported, so that they can be revalidated
+    if em != nil && em.Expired() && !em.HasValidators() {
+        dc.reclaim(ctx, path)
+        return nil, ErrDataNotFound
+    }
+
+    fi, err := os.Stat(filepath.Join(dc.root, path))
+    if os.IsNotExist(err) {
+        return nil, ErrDataNotFound
+    }
+    if err != nil {
+        return nil, classifyError("Stat", path, err)
+    }
+
+    st := &CacheStat{
+        ModTime:    fi.ModTime(),
+        Size:       fi.Size(),
+        StoredSize: fi.Size(),
+    }
+
+    if em != nil {
+        st.Expires = em.Expires
+        st.Metadata = em
+    }
+
+    if !dc.compress {
+        return st, nil
+    }
+
+    // the frame headers carry the decompressed size
+    f, err := dc.open(ctx, path)
+    if err != nil {
+        return nil, classifyError("Stat", path, err)
+    }
+    defer f.Close()
+
+    chunked, err := isChunked(f)
+    if err != nil {
+        return nil, classifyError("Stat", path, err)
+    }
+
+    if !chunked {
+        st.Size = GetLengthUnknown
+        return st, nil
+    }
+
+    st.Size, err = chunkedSize(f)
+    if err != nil {
+        return nil, classifyError("Stat", path, err)
+    }
+
+    return st, nil
+}
+
+func (dc *DiskCache) UpdateMetadata(path string, metadata interface{}) error {
+    return dc.UpdateMetadataContext(context.Background(), path, metadata)
+}
+
+func (dc *DiskCache) UpdateMetadataContext(ctx context.Context, path string, metadata interface{}) error {
+    Log.Debug("DiskCache::UpdateMetadata %s", path)
+
+    _, err := os.Stat(filepath.Join(dc.root, path))
+    if os.IsNotExist(err) {
+        return ErrDataNotFound
+    }
+    if err != nil {
+        return classifyError("UpdateMetadata", path, err)
+    }
+
+    return dc.writeMetadata(path, storedMetadata(metadata))
+}
+
+// chunkedSize returns the decompressed size of a chunked file positioned just
+// past its magic, leaving it positioned there again.
+func (dc *DiskCache) chunkedSize(f *os.File) (int64, error) {
+    size, err := chunkedSize(f)
+    if err != nil {
+        return 0, err
+    }
+
+    _, err = f.Seek(int64(len(chunkedMagic)), io.SeekStart)
+    if err != nil {
+        return 0, err
+    }
+
+    return size, nil
+}
+
+func (dc *DiskCache) metaPath(path string) string {
+    return filepath.Join(dc.root, diskMetaDir, path)
+}
+
+// readMetadata returns the stored metadata for path, or nil if there is none.
+func (dc *DiskCache) readMetadata(path string) (*EntryMetadata, error) {
+    buffer, err := ioutil.ReadFile(dc.metaPath(path))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    em := &EntryMetadata{}
+    err = json.Unmarshal(buffer, em)
+    if err != nil {
+        return nil, err
+    }
+
+    return em, nil
+}
+
+// expired reports whether path has expired, deleting it unless it can be
+// revalidated.
+func (dc *DiskCache) expired(ctx context.Context, path string) bool {
+    em, err := dc.readMetadata(path)
+    if err != nil {
+        Log.Debug("DiskCache metadata error %s: %v", path, err)
+        return false
+    }
+
+    if em == nil || !em.Expired() {
+        return false
+    }
+
+    if !em.HasValidators() {
+        dc.reclaim(ctx, path)
+    }
+
+    return true
+}
+
+func (dc *DiskCache) reclaim(ctx context.Context, path string) {
+    Log.Debug("DiskCache::reclaim %s", path)
+
+    err := dc.DeleteContext(ctx, path, nil)
+    if err != nil {
+        Log.Debug("DiskCache reclaim error %s: %v", path, err)
+    }
+}
+
+// writeMetadata stores em alongside path, or removes any stored metadata if
+// em is nil.
+func (dc *DiskCache) writeMetadata(path string, em *EntryMetadata) error {
+    metaPath := dc.metaPath(path)
+
+    if em == nil {
+        err := os.Remove(metaPath)
+        if err != nil && !os.IsNotExist(err) {
+            return err
         }
 
-        f.Close()
+        return nil
+    }
+
+    buffer, err := json.Marshal(em)
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(dc.tmpRoot, 0770)
+    if err != nil {
+        return err
+    }
+
+    f, err := ioutil.TempFile(dc.tmpRoot, "")
+    if err != nil {
+        return err
     }
 
-    return count, dc.commit(f.Name(), path)
+    _, err = f.Write(buffer)
+    f.Close()
+    if err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    err = os.MkdirAll(filepath.Dir(metaPath), 0770)
+    if err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    err = os.Rename(f.Name(), metaPath)
+    if err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    return nil
 }
 
-func (dc *DiskCache) commit(tmpPath, path string) error {
+// open opens the cache file for path, retrying transient failures. Missing
+// files are ErrDataNotFound, and permission errors are not retried.
+func (dc *DiskCache) open(ctx context.Context, path string) (*os.File, error) {
+    fullPath := filepath.Join(dc.root, path)
+
+    var err error
+    retries := 0
+
+    for retries < FsMaxRetries {
+        var f *os.File
+
+        f, err = os.Open(fullPath)
+        if err == nil {
+            return f, nil
+        }
+
+        if os.IsNotExist(err) {
+            return nil, ErrDataNotFound
+        }
+
+        if os.IsPermission(err) {
+            break
+        }
+
+        Log.Debug("Open %s failed (retry %d): %v", path, retries, err)
+        retries++
+
+        sleepErr := sleepContext(ctx, time.Duration(FsRetryIntervalSec)*time.Second)
+        if sleepErr != nil {
+            return nil, sleepErr
+        }
+    }
+
+    return nil, classifyError("Get", path, err)
+}
+
+func (dc *DiskCache) commit(ctx context.Context, tmpPath, path string) error {
     fullPath := filepath.Join(dc.root, path)
 
     err := os.MkdirAll(filepath.Dir(fullPath), 0770)
@@ -170,7 +531,10 @@ func (dc *DiskCache) commit(tmpPath, path string) error {
         Log.Debug("Commit %s failed (retry %d): %v", path, retries, err)
         retries++
 
-        <-time.After(time.Duration(FsRetryIntervalSec) * time.Second)
+        serr := sleepContext(ctx, time.Duration(FsRetryIntervalSec)*time.Second)
+        if serr != nil {
+            return serr
+        }
     }
 
     return err
@@ -0,0 +1,167 @@
+package cache
+
+import (
+    "context"
+    "io"
+    "time"
+)
+
+// EntryMetadata wraps the metadata passed to Put with details which caches
+// store alongside the data. Backends which interpret metadata themselves
+// (e.g. HttpReadCache) see the wrapped value via UnwrapMetadata.
+//
+// Expired entries which carry validators (ETag or LastModified) are kept
+// rather than deleted, so that a HierarchicalCache can revalidate them
+// against a child instead of fetching them again.
+type EntryMetadata struct {
+    ETag         string      `json:"etag,omitempty"`
+    Expires      time.Time   `json:"expires"` // zero never expires
+    LastModified time.Time   `json:"lastModified"`
+    Metadata     interface{} `json:"-"`
+    NoStore      bool        `json:"-"` // the origin forbids storing the entry, fills are skipped
+}
+
+// entryMetadataSource is implemented by readers which learn details of the
+// entry they read, such as HTTP validators, that should be stored with it.
+type entryMetadataSource interface {
+    entryMetadata() *EntryMetadata
+}
+
+// entryMetadataStore is implemented by caches which can read the metadata
+// stored with an entry without opening its data. It returns nil if none is
+// stored.
+type entryMetadataStore interface {
+    readMetadata(key string) (*EntryMetadata, error)
+}
+
+// WithExpiry returns metadata wrapped so that the entry expires at expires.
+func WithExpiry(metadata interface{}, expires time.Time) *EntryMetadata {
+    em := &EntryMetadata{}
+
+    existing := GetEntryMetadata(metadata)
+    if existing != nil {
+        *em = *existing
+    } else {
+        em.Metadata = metadata
+    }
+
+    em.Expires = expires
+
+    return em
+}
+
+// WithTTL returns metadata wrapped so that the entry expires ttl from now.
+func WithTTL(metadata interface{}, ttl time.Duration) *EntryMetadata {
+    return WithExpiry(metadata, time.Now().Add(ttl))
+}
+
+// GetEntryMetadata returns the EntryMetadata wrapping metadata, or nil if it
+// is not wrapped.
+func GetEntryMetadata(metadata interface{}) *EntryMetadata {
+    em, ok := metadata.(*EntryMetadata)
+    if !ok {
+        return nil
+    }
+
+    return em
+}
+
+// UnwrapMetadata returns the caller's metadata from inside an EntryMetadata,
+// or metadata itself if it is not wrapped.
+func UnwrapMetadata(metadata interface{}) interface{} {
+    em := GetEntryMetadata(metadata)
+    if em == nil {
+        return metadata
+    }
+
+    return em.Metadata
+}
+
+func (em *EntryMetadata) Expired() bool {
+    return isExpired(em.Expires)
+}
+
+// HasValidators reports whether the entry can be revalidated.
+func (em *EntryMetadata) HasValidators() bool {
+    return em.ETag != "" || !em.LastModified.IsZero()
+}
+
+// stale reports whether the entry has expired but should be kept for
+// revalidation.
+func (em *EntryMetadata) stale() bool {
+    return em.Expired() && em.HasValidators()
+}
+
+// mergeEntryMetadata returns metadata with the details src learned about the
+// entry added. An expiry set by the caller takes precedence over src's.
+func mergeEntryMetadata(metadata interface{}, src *EntryMetadata) interface{} {
+    if src == nil {
+        return metadata
+    }
+
+    em := &EntryMetadata{}
+
+    existing := GetEntryMetadata(metadata)
+    if existing != nil {
+        *em = *existing
+    } else {
+        em.Metadata = metadata
+    }
+
+    em.ETag = src.ETag
+    em.LastModified = src.LastModified
+    em.NoStore = src.NoStore
+
+    if em.Expires.IsZero() {
+        em.Expires = src.Expires
+    }
+
+    return em
+}
+
+// readEntryMetadata returns the metadata stored with key in cache, or nil if
+// there is none. Caches which cannot read it alone are asked for a Stat.
+func readEntryMetadata(ctx context.Context, cache ReadCache, key string, metadata interface{}) (*EntryMetadata, error) {
+    ems, ok := cache.(entryMetadataStore)
+    if ok {
+        return ems.readMetadata(key)
+    }
+
+    st, err := StatContext(ctx, cache, key, metadata)
+    if err != nil {
+        return nil, err
+    }
+
+    em, _ := st.Metadata.(*EntryMetadata)
+
+    return em, nil
+}
+
+// readerMetadata returns the details reader learned about its entry, or nil.
+func readerMetadata(reader io.Reader) *EntryMetadata {
+    src, ok := reader.(entryMetadataSource)
+    if !ok {
+        return nil
+    }
+
+    return src.entryMetadata()
+}
+
+// storedMetadata returns the part of metadata a cache keeps with an entry,
+// or nil if there is nothing to keep.
+func storedMetadata(metadata interface{}) *EntryMetadata {
+    em := GetEntryMetadata(metadata)
+    if em == nil || (em.Expires.IsZero() && !em.HasValidators()) {
+        return nil
+    }
+
+    return &EntryMetadata{
+        ETag:         em.ETag,
+        Expires:      em.Expires,
+        LastModified: em.LastModified,
+    }
+}
+
+func isExpired(expires time.Time) bool {
+    return !expires.IsZero() && !time.Now().Before(expires)
+}
@@ -0,0 +1,333 @@
+package cache
+
+import (
+    "container/heap"
+    "container/list"
+)
+
+// EvictionPolicy decides which of a Scavenger's records are deleted to make
+// room. The Scavenger reports every record as it is added, read and
+// removed, and calls Evict for as long as the cache is over its limit. Calls
+// are serialized by the Scavenger, so policies need no locking of their own.
+type EvictionPolicy interface {
+    // Add records a write of val, which may replace a record already held.
+    Add(val *DataRecord)
+    // Access records a read of a held record.
+    Access(val *DataRecord)
+    // Evict removes the next record to delete from the policy and returns
+    // it, or nil if the policy holds none.
+    Evict() *DataRecord
+    // Remove forgets a record deleted for any reason other than Evict. It
+    // must ignore records the policy does not hold.
+    Remove(val *DataRecord)
+}
+
+// sizedPolicy is an EvictionPolicy which divides the cache between lists by
+// size, and so must know how large the cache is. The Scavenger sets it to
+// maxSize when the policy is set.
+type sizedPolicy interface {
+    setCapacity(capacity int64)
+}
+
+// FIFOEviction evicts records in the order they were first written,
+// however often they are read.
+type FIFOEviction struct {
+    entries map[*DataRecord]*list.Element
+    order   *list.List
+}
+
+// GreedyDualSizeEviction evicts the records which are least valuable to
+// keep for the space they take, in the manner of GreedyDual-Size with a
+// uniform cost. Each record is worth the cache's inflation value when last
+// read plus the inverse of its size, and the inflation value rises to the
+// worth of each record evicted, so that large records go first but records
+// left unread long enough go eventually, whatever their size.
+type GreedyDualSizeEviction struct {
+    entries   map[*DataRecord]*priorityEntry
+    inflation float64
+    queue     priorityHeap
+    seq       uint64
+}
+
+// LFUEviction evicts the records read the fewest times while held, the
+// least recently read first among equals. Counts are dropped with the
+// record, so a record evicted and written again starts from one.
+type LFUEviction struct {
+    entries map[*DataRecord]*priorityEntry
+    queue   priorityHeap
+    seq     uint64
+}
+
+// LRUEviction evicts the records read least recently, by their LastRead
+// time. It is the default, and, being ordered by time rather than arrival,
+// places records restored from an index or a rebuild correctly.
+type LRUEviction struct {
+    records *recordHeap
+}
+
+// evictionEntry is a record held in one of the lists of a list based
+// policy, with the size it was counted at.
+type evictionEntry struct {
+    list *sizedList
+    size int64
+    val  *DataRecord
+}
+
+// priorityEntry is a record in a priorityHeap. Entries of equal priority are
+// ordered by seq, oldest first.
+type priorityEntry struct {
+    index    int
+    priority float64
+    seq      uint64
+    val      *DataRecord
+}
+
+// priorityHeap orders records lowest priority first.
+type priorityHeap []*priorityEntry
+
+// sizedList is an LRU list of evictionEntries, least recent at the front,
+// which keeps the total size of its entries.
+type sizedList struct {
+    entries *list.List
+    size    int64
+}
+
+func NewFIFOEviction() *FIFOEviction {
+    return &FIFOEviction{
+        entries: make(map[*DataRecord]*list.Element),
+        order:   list.New(),
+    }
+}
+
+func NewGreedyDualSizeEviction() *GreedyDualSizeEviction {
+    return &GreedyDualSizeEviction{
+        entries: make(map[*DataRecord]*priorityEntry),
+    }
+}
+
+func NewLFUEviction() *LFUEviction {
+    return &LFUEviction{
+        entries: make(map[*DataRecord]*priorityEntry),
+    }
+}
+
+func NewLRUEviction() *LRUEviction {
+    return &LRUEviction{
+        records: newRecordHeap(
+            func(a, b *DataRecord) bool { return a.LastRead.Before(b.LastRead) },
+            func(val *DataRecord) *int { return &val.readIndex },
+        ),
+    }
+}
+
+func (fe *FIFOEviction) Add(val *DataRecord) {
+    _, ok := fe.entries[val]
+    if ok {
+        return
+    }
+
+    fe.entries[val] = fe.order.PushBack(val)
+}
+
+func (fe *FIFOEviction) Access(val *DataRecord) {}
+
+func (fe *FIFOEviction) Evict() *DataRecord {
+    front := fe.order.Front()
+    if front == nil {
+        return nil
+    }
+
+    val := fe.order.Remove(front).(*DataRecord)
+    delete(fe.entries, val)
+
+    return val
+}
+
+func (fe *FIFOEviction) Remove(val *DataRecord) {
+    e, ok := fe.entries[val]
+    if !ok {
+        return
+    }
+
+    fe.order.Remove(e)
+    delete(fe.entries, val)
+}
+
+func (gds *GreedyDualSizeEviction) Add(val *DataRecord) {
+    gds.Access(val)
+}
+
+func (gds *GreedyDualSizeEviction) Access(val *DataRecord) {
+    size := val.Size
+    if size < 1 {
+        size = 1
+    }
+
+    gds.seq++
+    gds.entries[val] = gds.queue.update(gds.entries[val], val, gds.inflation+1/float64(size), gds.seq)
+}
+
+func (gds *GreedyDualSizeEviction) Evict() *DataRecord {
+    if len(gds.queue) == 0 {
+        return nil
+    }
+
+    pe := heap.Pop(&gds.queue).(*priorityEntry)
+    delete(gds.entries, pe.val)
+    gds.inflation = pe.priority
+
+    return pe.val
+}
+
+func (gds *GreedyDualSizeEviction) Remove(val *DataRecord) {
+    pe, ok := gds.entries[val]
+    if !ok {
+        return
+    }
+
+    heap.Remove(&gds.queue, pe.index)
+    delete(gds.entries, val)
+}
+
+func (lfu *LFUEviction) Add(val *DataRecord) {
+    lfu.Access(val)
+}
+
+func (lfu *LFUEviction) Access(val *DataRecord) {
+    hits := float64(1)
+
+    pe, ok := lfu.entries[val]
+    if ok {
+        hits += pe.priority
+    }
+
+    lfu.seq++
+    lfu.entries[val] = lfu.queue.update(pe, val, hits, lfu.seq)
+}
+
+func (lfu *LFUEviction) Evict() *DataRecord {
+    if len(lfu.queue) == 0 {
+        return nil
+    }
+
+    pe := heap.Pop(&lfu.queue).(*priorityEntry)
+    delete(lfu.entries, pe.val)
+
+    return pe.val
+}
+
+func (lfu *LFUEviction) Remove(val *DataRecord) {
+    pe, ok := lfu.entries[val]
+    if !ok {
+        return
+    }
+
+    heap.Remove(&lfu.queue, pe.index)
+    delete(lfu.entries, val)
+}
+
+func (lru *LRUEviction) Add(val *DataRecord) {
+    lru.records.add(val)
+}
+
+func (lru *LRUEviction) Access(val *DataRecord) {
+    lru.records.add(val)
+}
+
+func (lru *LRUEviction) Evict() *DataRecord {
+    val := lru.records.peek()
+    if val != nil {
+        lru.records.remove(val)
+    }
+
+    return val
+}
+
+func (lru *LRUEviction) Remove(val *DataRecord) {
+    lru.records.remove(val)
+}
+
+func (ph priorityHeap) Len() int { return len(ph) }
+
+func (ph priorityHeap) Less(i, j int) bool {
+    if ph[i].priority != ph[j].priority {
+        return ph[i].priority < ph[j].priority
+    }
+
+    return ph[i].seq < ph[j].seq
+}
+
+func (ph priorityHeap) Swap(i, j int) {
+    ph[i], ph[j] = ph[j], ph[i]
+    ph[i].index = i
+    ph[j].index = j
+}
+
+func (ph *priorityHeap) Push(x interface{}) {
+    pe := x.(*priorityEntry)
+    pe.index = len(*ph)
+    *ph = append(*ph, pe)
+}
+
+func (ph *priorityHeap) Pop() interface{} {
+    old := *ph
+    last := len(old) - 1
+    pe := old[last]
+    old[last] = nil
+    *ph = old[:last]
+
+    return pe
+}
+
+// update sets the priority of pe, adding a new entry for val if pe is nil,
+// and returns the entry.
+func (ph *priorityHeap) update(pe *priorityEntry, val *DataRecord, priority float64, seq uint64) *priorityEntry {
+    if pe == nil {
+        pe = &priorityEntry{
+            priority: priority,
+            seq:      seq,
+            val:      val,
+        }
+        heap.Push(ph, pe)
+
+        return pe
+    }
+
+    pe.priority = priority
+    pe.seq = seq
+    heap.Fix(ph, pe.index)
+
+    return pe
+}
+
+func newSizedList() *sizedList {
+    return &sizedList{
+        entries: list.New(),
+    }
+}
+
+// oldest returns the least recent entry, or nil if the list is empty.
+func (sl *sizedList) oldest() *list.Element {
+    return sl.entries.Front()
+}
+
+// push adds ee as the most recent entry.
+func (sl *sizedList) push(ee *evictionEntry) *list.Element {
+    ee.list = sl
+    sl.size += ee.size
+
+    return sl.entries.PushBack(ee)
+}
+
+func (sl *sizedList) remove(e *list.Element) *evictionEntry {
+    ee := sl.entries.Remove(e).(*evictionEntry)
+    sl.size -= ee.size
+
+    return ee
+}
+
+// resize changes the size ee is counted at.
+func (sl *sizedList) resize(ee *evictionEntry, size int64) {
+    sl.size += size - ee.size
+    ee.size = size
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+    "context"
     "io"
     "os"
 )
@@ -8,20 +9,96 @@ import (
 type FsReadCache struct{}
 
 func (fc *FsReadCache) Get(path string, metadata interface{}) (int64, io.Reader, error) {
+    return fc.GetContext(context.Background(), path, metadata)
+}
+
+func (fc *FsReadCache) GetContext(ctx context.Context, path string, metadata interface{}) (int64, io.Reader, error) {
     Log.Debug("FsCache::Get %s", path)
 
+    err := ctx.Err()
+    if err != nil {
+        return GetLengthUnknown, nil, classifyError("Get", path, err)
+    }
+
     f, err := os.Open(path)
     if err != nil {
-        return GetLengthUnknown, nil, err
+        return GetLengthUnknown, nil, classifyError("Get", path, err)
     }
 
     fi, err := f.Stat()
     if err != nil {
         f.Close()
-        return GetLengthUnknown, nil, err
+        return GetLengthUnknown, nil, classifyError("Get", path, err)
     }
 
     Log.Debug("Returning reader for %s (len %d)", path, fi.Size())
 
     return fi.Size(), NewSafeReader(fi.Size(), f, nil), nil
 }
+
+func (fc *FsReadCache) GetRange(path string, metadata interface{}, offset, length int64) (int64, io.Reader, error) {
+    return fc.GetRangeContext(context.Background(), path, metadata, offset, length)
+}
+
+func (fc *FsReadCache) GetRangeContext(
+    ctx context.Context,
+    path string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    Log.Debug("FsCache::GetRange %s (%d, %d)", path, offset, length)
+
+    err := ctx.Err()
+    if err != nil {
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+    }
+
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+    }
+
+    c, err := rangeLength(fi.Size(), offset, length)
+    if err != nil {
+        f.Close()
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+    }
+
+    _, err = f.Seek(offset, io.SeekStart)
+    if err != nil {
+        f.Close()
+        return GetLengthUnknown, nil, classifyError("GetRange", path, err)
+    }
+
+    return c, limitRange(c, f, length), nil
+}
+
+func (fc *FsReadCache) Stat(path string, metadata interface{}) (*CacheStat, error) {
+    return fc.StatContext(context.Background(), path, metadata)
+}
+
+func (fc *FsReadCache) StatContext(ctx context.Context, path string, metadata interface{}) (*CacheStat, error) {
+    Log.Debug("FsCache::Stat %s", path)
+
+    err := ctx.Err()
+    if err != nil {
+        return nil, classifyError("Stat", path, err)
+    }
+
+    fi, err := os.Stat(path)
+    if err != nil {
+        return nil, classifyError("Stat", path, err)
+    }
+
+    return &CacheStat{
+        ModTime:    fi.ModTime(),
+        Size:       fi.Size(),
+        StoredSize: fi.Size(),
+    }, nil
+}
@@ -1,29 +1,96 @@
 package cache
 
 import (
-    "bytes"
+    "context"
+    "errors"
     "fmt"
     "io"
+    "io/ioutil"
     "sync"
+    "sync/atomic"
+    "time"
 
     "github.com/xaevman/crash"
 )
 
+const (
+    PutSpool PutMode = iota // stage the data once, then write it to each cache
+    PutTee                  // stream the data to every cache concurrently
+)
+
+const (
+    ConsistencyBestEffort Consistency = iota // child failures are only logged
+    ConsistencyAll                           // every child must succeed
+    ConsistencyQuorum                        // more than half the children must succeed
+)
+
+// Consistency is how many children a Put or Delete must reach before
+// HierarchicalCache reports success.
+type Consistency int
+
+type PutMode int
+
+const (
+    ReadSequential ReadPolicy = iota // ask each child in turn until one has the key
+    ReadParallel                     // ask every child at once, take the first to answer
+    ReadHedged                       // ask the next child too whenever one is slow to answer
+)
+
+// ReadPolicy is how HierarchicalCache asks its children for a key the parent
+// does not hold.
+type ReadPolicy int
+
 type HierarchicalCache struct {
-    deletethrough bool
-    parentCache   RWCache
-    readers       []ReadCache
-    readerLock    sync.Mutex
-    writers       []WriteCache
-    writerLock    sync.Mutex
+    admission      AdmissionPolicy
+    closePolicy    FillClosePolicy
+    conditional    atomic.Int32 // children which implement ConditionalReadCache
+    consistency    Consistency
+    deletethrough  bool
+    draining       []*writeQueue // closed write-behind queues not yet flushed
+    flights        map[string]*cacheFlight
+    flightLock     sync.Mutex
+    health         []*circuitBreaker // one per reader
+    negative       *negativeCache
+    parentCache    RWCache
+    breakAfter     int
+    breakCooldown  time.Duration
+    hedgeDelay     time.Duration
+    putMode        PutMode
+    queues         map[WriteCache]*writeQueue
+    readPolicy     ReadPolicy
+    readers        []ReadCache
+    revalidate     bool
+    readerLock     sync.Mutex
+    spoolDir       string
+    spoolThreshold int64
+    writeBehind    *WriteBehindConfig
+    writers        []WriteCache
+    writerLock     sync.Mutex
+}
+
+// cacheFlight is a single child fetch and parent fill shared by every
+// concurrent Get which misses on the same key.
+type cacheFlight struct {
+    count       int64
+    ended       bool
+    err         error
+    filler      *CacheFiller
+    notModified bool // the parent's copy was revalidated, serve it
+    ready       chan struct{}
+    reserved    []io.ReadCloser // filler readers for waiters yet to take one
+    waiters     int
 }
 
 func NewHierarchicalCache(cache RWCache) *HierarchicalCache {
     return &HierarchicalCache{
-        deletethrough: false,
-        parentCache:   cache,
-        readers:       make([]ReadCache, 0),
-        writers:       make([]WriteCache, 0),
+        closePolicy:    FillOnClose,
+        deletethrough:  false,
+        flights:        make(map[string]*cacheFlight),
+        parentCache:    cache,
+        putMode:        PutSpool,
+        readers:        make([]ReadCache, 0),
+        spoolThreshold: DefaultSpoolThreshold,
+        writers:        make([]WriteCache, 0),
     }
 }
 
@@ -42,6 +109,8 @@ func (hc *HierarchicalCache) AddChild(child interface{}) error {
     if ok {
         match = true
         hc.readers = append(hc.readers, reader)
+        hc.health = append(hc.health, newCircuitBreaker(hc.breakAfter, hc.breakCooldown))
+        hc.countConditional()
     }
 
     writer, ok := child.(WriteCache)
@@ -63,23 +132,38 @@ func (hc *HierarchicalCache) RemoveChild(child interface{}) {
     defer hc.readerLock.Unlock()
     defer hc.writerLock.Unlock()
 
+    readers := make([]ReadCache, 0, len(hc.readers))
+    health := make([]*circuitBreaker, 0, len(hc.health))
     for i := range hc.readers {
-        if hc.readers[i] == child {
-            hc.readers = append(hc.readers[:i], hc.readers[i+1:]...)
+        if hc.readers[i] != child {
+            readers = append(readers, hc.readers[i])
+            health = append(health, hc.health[i])
         }
     }
+    hc.readers = readers
+    hc.health = health
+
+    hc.countConditional()
 
+    writers := make([]WriteCache, 0, len(hc.writers))
     for i := range hc.writers {
         if hc.writers[i] == child {
-            hc.writers = append(hc.writers[:i], hc.writers[i+1:]...)
+            hc.closeQueue(hc.writers[i])
+        } else {
+            writers = append(writers, hc.writers[i])
         }
     }
+    hc.writers = writers
 }
 
 func (hc *HierarchicalCache) Delete(key string, metadata interface{}) error {
+    return hc.DeleteContext(context.Background(), key, metadata)
+}
+
+func (hc *HierarchicalCache) DeleteContext(ctx context.Context, key string, metadata interface{}) error {
     Log.Debug("HierarchicalCache::Delete %s", key)
 
-    err := hc.parentCache.Delete(key, metadata)
+    err := WithRWContext(hc.parentCache).DeleteContext(ctx, key, metadata)
     if err != nil {
         return err
     }
@@ -88,6 +172,12 @@ func (hc *HierarchicalCache) Delete(key string, metadata interface{}) error {
         hc.writerLock.Lock()
         defer hc.writerLock.Unlock()
 
+        if hc.writeBehind != nil {
+            return hc.queueWrites(ctx, key, metadata, nil)
+        }
+
+        errs := make([]error, len(hc.writers))
+
         var wg sync.WaitGroup
         wg.Add(len(hc.writers))
 
@@ -95,9 +185,10 @@ func (hc *HierarchicalCache) Delete(key string, metadata interface{}) error {
             go func() {
                 defer crash.HandleAll()
                 Log.Debug("HierarchicalCache::Delete %s, child %d", key, i)
-                err := hc.writers[i].Delete(key, metadata)
-                if err != nil {
+                err := WithWriteContext(hc.writers[i]).DeleteContext(ctx, key, metadata)
+                if err != nil && !errors.Is(err, ErrDataNotFound) {
                     Log.Debug("Cache writethrough DELETE error: %v", err)
+                    errs[i] = err
                 }
 
                 wg.Done()
@@ -105,33 +196,608 @@ func (hc *HierarchicalCache) Delete(key string, metadata interface{}) error {
         }
 
         wg.Wait()
+
+        return hc.replicationError("Delete", key, errs)
     }
 
     return nil
 }
 
 func (hc *HierarchicalCache) Get(key string, metadata interface{}) (int64, io.Reader, error) {
+    return hc.GetContext(context.Background(), key, metadata)
+}
+
+func (hc *HierarchicalCache) GetContext(ctx context.Context, key string, metadata interface{}) (int64, io.Reader, error) {
     Log.Debug("HierarchicalCache::Get %s", key)
 
-    count, data, err := hc.parentCache.Get(key, metadata)
-    if err == nil {
+    // a stale copy counts as a miss until it is revalidated
+    parentErr := ErrDataNotFound
+
+    stale := hc.staleMetadata(ctx, key, metadata)
+    if stale == nil {
+        count, data, err := WithRWContext(hc.parentCache).GetContext(ctx, key, metadata)
+        if err == nil {
+            return count, data, err
+        }
+
+        parentErr = err
+
+        if hc.knownMiss(key) {
+            return GetLengthUnknown, nil, ErrDataNotFound
+        }
+    }
+
+    hc.flightLock.Lock()
+    flight, ok := hc.flights[key]
+    if !ok {
+        flight = &cacheFlight{
+            ready: make(chan struct{}),
+        }
+        hc.flights[key] = flight
+
+        // the fetch is shared, so it must not be cancelled along with
+        // the caller which happened to start it
+        go hc.fetch(context.WithoutCancel(ctx), key, metadata, stale, flight)
+    } else {
+        Log.Debug("HierarchicalCache::Get %s, joining in-flight fetch", key)
+    }
+    flight.waiters++
+    if flight.filler != nil {
+        flight.reserved = append(flight.reserved, flight.filler.NewReader())
+    }
+    hc.flightLock.Unlock()
+
+    claimed := false
+    defer func() {
+        hc.leaveFlight(flight, claimed)
+    }()
+
+    select {
+    case <-flight.ready:
+    case <-ctx.Done():
+        return GetLengthUnknown, nil, ctx.Err()
+    }
+
+    if flight.err != nil {
+        return GetLengthUnknown, nil, withParentError(parentErr, flight.err)
+    }
+
+    if flight.notModified {
+        return WithRWContext(hc.parentCache).GetContext(ctx, key, metadata)
+    }
+
+    claimed = true
+
+    return flight.count, hc.claimReader(flight), nil
+}
+
+// claimReader takes one of the readers reserved for flight's waiters.
+func (hc *HierarchicalCache) claimReader(flight *cacheFlight) io.ReadCloser {
+    hc.flightLock.Lock()
+    defer hc.flightLock.Unlock()
+
+    last := len(flight.reserved) - 1
+    reader := flight.reserved[last]
+    flight.reserved = flight.reserved[:last]
+
+    return reader
+}
+
+// endFlight stops new callers from joining flight. The filler's spool stays
+// alive until every caller already waiting has taken its reader.
+func (hc *HierarchicalCache) endFlight(key string, flight *cacheFlight) {
+    hc.flightLock.Lock()
+    defer hc.flightLock.Unlock()
+
+    if hc.flights[key] == flight {
+        delete(hc.flights, key)
+    }
+
+    flight.ended = true
+    if flight.waiters == 0 {
+        releaseFlight(flight)
+    }
+}
+
+// leaveFlight removes a waiter from flight. A waiter which did not claim its
+// reserved reader closes it.
+func (hc *HierarchicalCache) leaveFlight(flight *cacheFlight, claimed bool) {
+    var unclaimed io.ReadCloser
+
+    hc.flightLock.Lock()
+    if !claimed && len(flight.reserved) > 0 {
+        last := len(flight.reserved) - 1
+        unclaimed = flight.reserved[last]
+        flight.reserved = flight.reserved[:last]
+    }
+
+    flight.waiters--
+    if flight.ended && flight.waiters == 0 {
+        releaseFlight(flight)
+    }
+    hc.flightLock.Unlock()
+
+    if unclaimed != nil {
+        unclaimed.Close()
+    }
+}
+
+// releaseFlight frees what an ended flight holds once no caller is waiting
+// on it. The caller must hold flightLock.
+func releaseFlight(flight *cacheFlight) {
+    if flight.filler != nil {
+        flight.filler.release()
+    }
+}
+
+func (hc *HierarchicalCache) fetch(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    stale *EntryMetadata,
+    flight *cacheFlight,
+) {
+    defer crash.HandleAll()
+
+    count, data, err := hc.getChild(ctx, key, metadata, stale)
+    if errors.Is(err, ErrDataNotFound) {
+        hc.recordMiss(key)
+    }
+    if errors.Is(err, ErrNotModified) {
+        err = hc.refresh(ctx, key, metadata, stale, err)
+        if err == nil {
+            flight.notModified = true
+            close(flight.ready)
+            hc.endFlight(key, flight)
+            return
+        }
+
+        Log.Debug("HierarchicalCache::Get %s, refresh error: %v", key, err)
+        count, data, err = hc.getChild(ctx, key, metadata, nil)
+    }
+    if err != nil {
+        flight.err = err
+        close(flight.ready)
+        hc.endFlight(key, flight)
+        return
+    }
+
+    filler := NewCacheFillerContext(ctx, key, metadata, hc.parentCache, data)
+    filler.SetSpool(hc.spoolDir, hc.spoolThreshold)
+    filler.SetExpectedSize(count)
+    filler.SetClosePolicy(hc.closePolicy)
+
+    // entries kept out of the parent are still shared through the spool
+    if hc.admission != nil && !hc.admission.Admit(key, count) {
+        Log.Debug("HierarchicalCache::Get %s, not admitted to parent", key)
+        filler.skip = true
+    }
+
+    // keep the spool alive for callers which have joined but not yet taken
+    // their reader
+    filler.retain()
+
+    // every waiter gets its reader now, so that one which closes early
+    // cannot abort the fill under DiscardOnClose before the others have
+    // started reading
+    hc.flightLock.Lock()
+    flight.count = count
+    flight.filler = filler
+    for i := 0; i < flight.waiters; i++ {
+        flight.reserved = append(flight.reserved, filler.NewReader())
+    }
+    hc.flightLock.Unlock()
+
+    close(flight.ready)
+
+    // drive the fetch regardless of how fast callers read
+    io.Copy(ioutil.Discard, filler)
+    WaitForCacheFill(filler)
+
+    // later callers can be served by the parent from here on
+    hc.endFlight(key, flight)
+}
+
+// getChild reads key from the first child which holds it. If stale is set,
+// children which can revalidate are asked to do so, and ErrNotModified is
+// returned if the first which answers still matches stale.
+func (hc *HierarchicalCache) getChild(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    stale *EntryMetadata,
+) (int64, io.Reader, error) {
+    hc.readerLock.Lock()
+    defer hc.readerLock.Unlock()
+
+    switch hc.readPolicy {
+    case ReadParallel:
+        return hc.raceChildren(ctx, key, metadata, stale, 0)
+    case ReadHedged:
+        return hc.raceChildren(ctx, key, metadata, stale, hc.hedgeDelay)
+    }
+
+    errs := make([]error, 0, len(hc.readers))
+
+    for i := range hc.readers {
+        count, data, err := readChild(ctx, hc.readers[i], hc.health[i], key, metadata, stale)
+        if err == nil || errors.Is(err, ErrNotModified) {
+            Log.Debug("HierarchicalCache::Get %s, child %d", key, i)
+            return count, data, err
+        }
+
+        if ctx.Err() != nil {
+            return GetLengthUnknown, nil, ctx.Err()
+        }
+
+        errs = append(errs, err)
+    }
+
+    // not found, GetContext adds the parent's error
+    return GetLengthUnknown, nil, &TierError{
+        Errs: errs,
+        Key:  key,
+        Op:   "Get",
+    }
+}
+
+// readChild gets key from child, conditionally if it can revalidate stale,
+// unless the child's circuit is open.
+func readChild(
+    ctx context.Context,
+    child ReadCache,
+    health *circuitBreaker,
+    key string,
+    metadata interface{},
+    stale *EntryMetadata,
+) (int64, io.Reader, error) {
+    if !health.allow() {
+        return GetLengthUnknown, nil, ErrCircuitOpen
+    }
+
+    var count int64
+    var data io.Reader
+    var err error
+
+    crc, ok := child.(ConditionalReadCache)
+    if ok && stale != nil {
+        count, data, err = WithConditionalContext(crc).GetConditionalContext(ctx, key, metadata, stale)
+    } else {
+        count, data, err = WithReadContext(child).GetContext(ctx, key, metadata)
+    }
+
+    health.record(err)
+
+    return count, data, err
+}
+
+// childRead is the answer of child i to raceChildren.
+type childRead struct {
+    count int64
+    data  io.Reader
+    err   error
+    i     int
+}
+
+// raceChildren asks the children for key concurrently and returns the first
+// answer which getChild would accept. The children are asked in order, each
+// one once the last has failed or has not answered within delay. The
+// losers' requests are cancelled and any readers they return are closed,
+// and the winner's request is cancelled once its reader is done. The caller
+// must hold readerLock.
+func (hc *HierarchicalCache) raceChildren(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    stale *EntryMetadata,
+    delay time.Duration,
+) (int64, io.Reader, error) {
+    reads := make(chan childRead, len(hc.readers))
+    cancels := make([]context.CancelFunc, 0, len(hc.readers))
+    errs := make([]error, len(hc.readers))
+    pending := 0
+
+    ask := func() {
+        i := len(cancels)
+        child := hc.readers[i]
+        health := hc.health[i]
+        childCtx, cancel := context.WithCancel(ctx)
+        cancels = append(cancels, cancel)
+        pending++
+
+        // losers may still be running once readerLock is released
+        go func() {
+            defer crash.HandleAll()
+
+            count, data, err := readChild(childCtx, child, health, key, metadata, stale)
+            reads <- childRead{count: count, data: data, err: err, i: i}
+        }()
+    }
+
+    // abandon cancels every request but the winner's and closes whatever
+    // the others still return
+    abandon := func(winner int) {
+        for i := range cancels {
+            if i != winner {
+                cancels[i]()
+            }
+        }
+
+        go func(pending int) {
+            defer crash.HandleAll()
+
+            for ; pending > 0; pending-- {
+                read := <-reads
+                if read.data != nil {
+                    AsReadCloser(read.data).Close()
+                }
+            }
+        }(pending)
+    }
+
+    for len(cancels) < len(hc.readers) || pending > 0 {
+        var hedge <-chan time.Time
+        if len(cancels) < len(hc.readers) {
+            if pending == 0 || delay <= 0 {
+                ask()
+                continue
+            }
+
+            hedge = time.After(delay)
+        }
+
+        select {
+        case read := <-reads:
+            pending--
+            if read.err == nil || errors.Is(read.err, ErrNotModified) {
+                Log.Debug("HierarchicalCache::Get %s, child %d", key, read.i)
+                abandon(read.i)
+
+                if read.data == nil {
+                    cancels[read.i]()
+                    return read.count, nil, read.err
+                }
+
+                return read.count, &cancelReader{cancel: cancels[read.i], data: read.data}, read.err
+            }
+
+            errs[read.i] = read.err
+        case <-hedge:
+            Log.Debug("HierarchicalCache::Get %s, hedging after %v", key, delay)
+            ask()
+        case <-ctx.Done():
+            abandon(-1)
+            return GetLengthUnknown, nil, ctx.Err()
+        }
+    }
+
+    for i := range cancels {
+        cancels[i]()
+    }
+
+    // not found, GetContext adds the parent's error
+    return GetLengthUnknown, nil, &TierError{
+        Errs: errs,
+        Key:  key,
+        Op:   "Get",
+    }
+}
+
+// withParentError adds the parent's error to the children's errors from
+// getChild. Any other error is returned as is.
+func withParentError(parentErr, err error) error {
+    te, ok := err.(*TierError)
+    if !ok {
+        return err
+    }
+
+    errs := append([]error{parentErr}, te.Errs...)
+
+    return newTierError(te.Op, te.Key, errs)
+}
+
+// refresh replaces the metadata of the parent's copy of key once a child has
+// confirmed it is unchanged. Validators are carried over unless the child
+// sent new ones, and the new expiry is whatever the child's answer gave.
+func (hc *HierarchicalCache) refresh(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    stale *EntryMetadata,
+    notModified error,
+) error {
+    fresh := &EntryMetadata{
+        ETag:         stale.ETag,
+        LastModified: stale.LastModified,
+    }
+
+    var nme *NotModifiedError
+    if errors.As(notModified, &nme) && nme.Metadata != nil {
+        if nme.Metadata.ETag != "" {
+            fresh.ETag = nme.Metadata.ETag
+        }
+
+        if !nme.Metadata.LastModified.IsZero() {
+            fresh.LastModified = nme.Metadata.LastModified
+        }
+
+        fresh.Expires = nme.Metadata.Expires
+    }
+
+    return UpdateMetadataContext(ctx, hc.parentCache, key, mergeEntryMetadata(metadata, fresh))
+}
+
+// staleMetadata returns the stored metadata of the parent's copy of key if it
+// should be revalidated before being served: because it has expired, or
+// because SetRevalidate is enabled. Otherwise it returns nil.
+func (hc *HierarchicalCache) staleMetadata(ctx context.Context, key string, metadata interface{}) *EntryMetadata {
+    if hc.conditional.Load() == 0 {
+        return nil
+    }
+
+    // only the stored metadata is read, as a Stat of a compressed entry
+    // would walk its data
+    em, err := readEntryMetadata(ctx, hc.parentCache, key, metadata)
+    if err != nil || em == nil || !em.HasValidators() {
+        return nil
+    }
+
+    if !hc.revalidate && !em.Expired() {
+        return nil
+    }
+
+    return em
+}
+
+// countConditional records how many children can revalidate entries, so
+// that Get can check without waiting on readerLock. The caller must hold
+// readerLock.
+func (hc *HierarchicalCache) countConditional() {
+    count := int32(0)
+
+    for i := range hc.readers {
+        _, ok := hc.readers[i].(ConditionalReadCache)
+        if ok {
+            count++
+        }
+    }
+
+    hc.conditional.Store(count)
+}
+
+// knownMiss reports whether a recent lookup for key missed every tier.
+func (hc *HierarchicalCache) knownMiss(key string) bool {
+    return hc.negative != nil && hc.negative.contains(key)
+}
+
+func (hc *HierarchicalCache) recordMiss(key string) {
+    if hc.negative != nil {
+        hc.negative.add(key)
+    }
+}
+
+func (hc *HierarchicalCache) forgetMiss(key string) {
+    if hc.negative != nil {
+        hc.negative.remove(key)
+    }
+}
+
+func (hc *HierarchicalCache) GetRange(key string, metadata interface{}, offset, length int64) (int64, io.Reader, error) {
+    return hc.GetRangeContext(context.Background(), key, metadata, offset, length)
+}
+
+// GetRangeContext serves a range from the parent if it holds key, otherwise
+// from the first child which does. Partial reads never fill the parent.
+func (hc *HierarchicalCache) GetRangeContext(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    Log.Debug("HierarchicalCache::GetRange %s (%d, %d)", key, offset, length)
+
+    count, data, err := GetRangeContext(ctx, hc.parentCache, key, metadata, offset, length)
+    if err == nil || errors.Is(err, ErrInvalidRange) {
         return count, data, err
     }
 
+    if hc.knownMiss(key) {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
+
     hc.readerLock.Lock()
     defer hc.readerLock.Unlock()
 
-    // failed - try children
+    errs := []error{err}
+
     for i := range hc.readers {
-        count, data, err := hc.readers[i].Get(key, metadata)
+        if !hc.health[i].allow() {
+            errs = append(errs, ErrCircuitOpen)
+            continue
+        }
+
+        count, data, err := GetRangeContext(ctx, hc.readers[i], key, metadata, offset, length)
+        hc.health[i].record(err)
+        if err == nil || errors.Is(err, ErrInvalidRange) {
+            Log.Debug("HierarchicalCache::GetRange %s, child %d", key, i)
+            return count, data, err
+        }
+
+        if ctx.Err() != nil {
+            return GetLengthUnknown, nil, ctx.Err()
+        }
+
+        errs = append(errs, err)
+    }
+
+    // not found
+    return GetLengthUnknown, nil, newTierError("GetRange", key, errs)
+}
+
+func (hc *HierarchicalCache) Stat(key string, metadata interface{}) (*CacheStat, error) {
+    return hc.StatContext(context.Background(), key, metadata)
+}
+
+// StatContext stats the tier Get would read key from: the parent if it holds
+// key, otherwise the first child which does. Level reports which tier that
+// was, counting nested hierarchies. Tiers which cannot Stat are skipped.
+func (hc *HierarchicalCache) StatContext(ctx context.Context, key string, metadata interface{}) (*CacheStat, error) {
+    Log.Debug("HierarchicalCache::Stat %s", key)
+
+    errs := make([]error, 0)
+
+    st, err := StatContext(ctx, hc.parentCache, key, metadata)
+    if err == nil {
+        return st, nil
+    }
+
+    if err != ErrNotSupported {
+        errs = append(errs, err)
+    }
+
+    if hc.knownMiss(key) {
+        return nil, ErrDataNotFound
+    }
+
+    hc.readerLock.Lock()
+    defer hc.readerLock.Unlock()
+
+    for i := range hc.readers {
+        if !hc.health[i].allow() {
+            errs = append(errs, ErrCircuitOpen)
+            continue
+        }
+
+        st, err := StatContext(ctx, hc.readers[i], key, metadata)
+        hc.health[i].record(err)
         if err == nil {
-            Log.Debug("HierarchicalCache::Get %s, child %d", key, i)
-            return count, NewCacheFiller(key, metadata, hc.parentCache, data), nil
+            st.Level += i + 1
+            return st, nil
+        }
+
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+
+        if err != ErrNotSupported {
+            errs = append(errs, err)
         }
     }
 
     // not found
-    return GetLengthUnknown, nil, ErrDataNotFound
+    return nil, newTierError("Stat", key, errs)
+}
+
+func (hc *HierarchicalCache) UpdateMetadata(key string, metadata interface{}) error {
+    return hc.UpdateMetadataContext(context.Background(), key, metadata)
+}
+
+// UpdateMetadataContext replaces the metadata stored with the parent's copy
+// of key.
+func (hc *HierarchicalCache) UpdateMetadataContext(ctx context.Context, key string, metadata interface{}) error {
+    Log.Debug("HierarchicalCache::UpdateMetadata %s", key)
+
+    return UpdateMetadataContext(ctx, hc.parentCache, key, metadata)
 }
 
 func (hc *HierarchicalCache) GetParent() RWCache {
@@ -139,22 +805,41 @@ func (hc *HierarchicalCache) GetParent() RWCache {
 }
 
 func (hc *HierarchicalCache) Put(key string, metadata interface{}, data io.Reader) (int64, error) {
+    return hc.PutContext(context.Background(), key, metadata, data)
+}
+
+func (hc *HierarchicalCache) PutContext(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error) {
     Log.Debug("HierarchicalCache::Put %s", key)
 
+    defer hc.forgetMiss(key)
+
     hc.writerLock.Lock()
     defer hc.writerLock.Unlock()
 
-    var buffer bytes.Buffer
-    _, err := io.Copy(&buffer, data)
+    if hc.putMode == PutTee && hc.writeBehind == nil {
+        return hc.putTee(ctx, key, metadata, data)
+    }
+
+    spool := NewSpool(hc.spoolDir, hc.spoolThreshold)
+    shared := &sharedSpool{refs: 1, spool: spool}
+    defer shared.release()
+
+    _, err := io.Copy(spool, &contextReader{ctx: ctx, source: data})
     if err != nil {
         return 0, err
     }
 
-    c, err := hc.parentCache.Put(key, metadata, bytes.NewReader(buffer.Bytes()))
+    c, err := WithRWContext(hc.parentCache).PutContext(ctx, key, metadata, spool.NewReader())
     if err != nil {
         return 0, err
     }
 
+    if hc.writeBehind != nil {
+        return c, hc.queueWrites(ctx, key, metadata, shared)
+    }
+
+    errs := make([]error, len(hc.writers))
+
     var wg sync.WaitGroup
     wg.Add(len(hc.writers))
 
@@ -163,9 +848,9 @@ func (hc *HierarchicalCache) Put(key string, metadata interface{}, data io.Reade
             defer crash.HandleAll()
 
             Log.Debug("HierarchicalCache::Put %s, child %d", key, i)
-            hc.writers[i].Put(key, metadata, bytes.NewReader(buffer.Bytes()))
-            if err != nil {
-                Log.Debug("Cache writethrough PUT error: %v", err)
+            _, errs[i] = WithWriteContext(hc.writers[i]).PutContext(ctx, key, metadata, spool.NewReader())
+            if errs[i] != nil {
+                Log.Debug("Cache writethrough PUT error: %v", errs[i])
             }
 
             wg.Done()
@@ -174,5 +859,343 @@ func (hc *HierarchicalCache) Put(key string, metadata interface{}, data io.Reade
 
     wg.Wait()
 
-    return c, nil
+    return c, hc.replicationError("Put", key, errs)
+}
+
+// Flush waits until every write queued for the children in write-behind mode
+// has been made or given up on. Puts and Deletes wait for the Flush.
+func (hc *HierarchicalCache) Flush() error {
+    return hc.FlushContext(context.Background())
+}
+
+func (hc *HierarchicalCache) FlushContext(ctx context.Context) error {
+    hc.writerLock.Lock()
+    defer hc.writerLock.Unlock()
+
+    for _, q := range hc.queues {
+        err := q.wait(ctx)
+        if err != nil {
+            return err
+        }
+    }
+
+    for i := range hc.draining {
+        err := hc.draining[i].wait(ctx)
+        if err != nil {
+            return err
+        }
+    }
+
+    hc.draining = nil
+
+    return nil
+}
+
+// ChildHealth reports the health of each child reader, in the order they are
+// asked.
+func (hc *HierarchicalCache) ChildHealth() []ChildHealth {
+    hc.readerLock.Lock()
+    defer hc.readerLock.Unlock()
+
+    health := make([]ChildHealth, len(hc.readers))
+    for i := range hc.readers {
+        health[i] = hc.health[i].snapshot(hc.readers[i])
+    }
+
+    return health
+}
+
+// SetAdmissionPolicy sets which entries read from the children are filled
+// into the parent. Entries the policy refuses are still shared between the
+// callers waiting on them, but never filled. A nil policy admits everything.
+func (hc *HierarchicalCache) SetAdmissionPolicy(policy AdmissionPolicy) {
+    hc.admission = policy
+}
+
+// SetCircuitBreaker makes Get, GetRange and Stat skip a child for cooldown
+// once threshold requests in a row to it have failed with a transient error
+// or a timeout. After cooldown a single request probes the child, closing
+// the circuit again if it succeeds. A zero threshold turns circuit breaking
+// off; health is still tracked.
+func (hc *HierarchicalCache) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+    hc.readerLock.Lock()
+    defer hc.readerLock.Unlock()
+
+    hc.breakAfter = threshold
+    hc.breakCooldown = cooldown
+
+    for i := range hc.health {
+        hc.health[i].configure(threshold, cooldown)
+    }
+}
+
+// SetConsistency sets how many children a Put, or a Delete under
+// SetDeleteThrough, must reach before it succeeds. When too few do, the
+// parent keeps the change and a ReplicationError naming the failed children
+// is returned. Children written in write-behind mode are not counted; their
+// failures are only logged.
+func (hc *HierarchicalCache) SetConsistency(mode Consistency) {
+    hc.writerLock.Lock()
+    defer hc.writerLock.Unlock()
+
+    hc.consistency = mode
+}
+
+// SetFillClosePolicy sets what happens to a parent fill when every reader
+// sharing a child fetch is closed before the fetch completes.
+func (hc *HierarchicalCache) SetFillClosePolicy(policy FillClosePolicy) {
+    hc.closePolicy = policy
+}
+
+// SetNegativeCache makes Get remember, for ttl, keys which no tier held, and
+// answer further lookups for them with ErrDataNotFound without asking the
+// children. At most maxEntries keys are remembered; Putting a key forgets
+// it. A zero ttl disables negative caching.
+func (hc *HierarchicalCache) SetNegativeCache(ttl time.Duration, maxEntries int) {
+    if ttl <= 0 || maxEntries <= 0 {
+        hc.negative = nil
+        return
+    }
+
+    hc.negative = newNegativeCache(ttl, maxEntries)
+}
+
+func (hc *HierarchicalCache) SetPutMode(mode PutMode) {
+    hc.writerLock.Lock()
+    defer hc.writerLock.Unlock()
+
+    hc.putMode = mode
+}
+
+// SetReadPolicy sets how children are asked for keys the parent does not
+// hold. Under ReadHedged the next child is asked whenever none has answered
+// within hedgeDelay; it is otherwise ignored.
+func (hc *HierarchicalCache) SetReadPolicy(policy ReadPolicy, hedgeDelay time.Duration) {
+    hc.readerLock.Lock()
+    defer hc.readerLock.Unlock()
+
+    hc.readPolicy = policy
+    hc.hedgeDelay = hedgeDelay
+}
+
+// SetRevalidate makes Get revalidate every entry the parent holds against the
+// children before serving it, rather than only once it has expired. Only
+// entries stored with validators, and children which implement
+// ConditionalReadCache, take part.
+func (hc *HierarchicalCache) SetRevalidate(enabled bool) {
+    hc.revalidate = enabled
+}
+
+// SetWriteBehind switches Put, and Delete under SetDeleteThrough, to
+// write-behind mode, in which they return once the parent is written and the
+// children's writes are queued. Data is always spooled in this mode,
+// whatever the PutMode. A nil config switches back to writing the children
+// before returning; writes already queued are still made.
+func (hc *HierarchicalCache) SetWriteBehind(config *WriteBehindConfig) {
+    hc.writerLock.Lock()
+    defer hc.writerLock.Unlock()
+
+    for writer := range hc.queues {
+        hc.closeQueue(writer)
+    }
+
+    hc.writeBehind = nil
+    if config != nil {
+        cfg := *config
+        hc.writeBehind = &cfg
+    }
+}
+
+// SetSpool configures where PutSpool mode stages data. Data up to threshold
+// bytes is held in memory, anything larger is written to a temp file in dir.
+func (hc *HierarchicalCache) SetSpool(dir string, threshold int64) {
+    hc.writerLock.Lock()
+    defer hc.writerLock.Unlock()
+
+    hc.spoolDir = dir
+    hc.spoolThreshold = threshold
+}
+
+// replicationError returns a ReplicationError if errs, one per child, hold
+// more failures than the consistency mode allows.
+func (hc *HierarchicalCache) replicationError(op, key string, errs []error) error {
+    failed := 0
+    for i := range errs {
+        if errs[i] != nil {
+            failed++
+        }
+    }
+
+    if failed == 0 || hc.consistency == ConsistencyBestEffort {
+        return nil
+    }
+
+    if hc.consistency == ConsistencyQuorum && len(errs)-failed > len(errs)/2 {
+        return nil
+    }
+
+    return &ReplicationError{
+        Errs: errs,
+        Key:  key,
+        Op:   op,
+    }
+}
+
+// queueWrites queues a write of key to every child, or a delete if spool is
+// nil. The caller must hold writerLock.
+func (hc *HierarchicalCache) queueWrites(ctx context.Context, key string, metadata interface{}, spool *sharedSpool) error {
+    for i := range hc.writers {
+        q, ok := hc.queues[hc.writers[i]]
+        if !ok {
+            q = newWriteQueue(hc.writers[i], hc.writeBehind)
+            if hc.queues == nil {
+                hc.queues = make(map[WriteCache]*writeQueue)
+            }
+            hc.queues[hc.writers[i]] = q
+        }
+
+        if spool != nil {
+            spool.retain()
+        }
+
+        err := q.enqueue(ctx, &writeJob{
+            // queued writes outlive the caller
+            ctx:      context.WithoutCancel(ctx),
+            key:      key,
+            metadata: metadata,
+            spool:    spool,
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// closeQueue stops writer's write-behind queue once it drains. The caller
+// must hold writerLock.
+func (hc *HierarchicalCache) closeQueue(writer WriteCache) {
+    q, ok := hc.queues[writer]
+    if !ok {
+        return
+    }
+
+    q.close()
+    delete(hc.queues, writer)
+    hc.draining = append(hc.draining, q)
+}
+
+// putTee streams data to the parent and every child concurrently through a
+// pipe per writer, so nothing is buffered beyond the copy in flight. A child
+// which fails is dropped from the fan-out; a parent failure aborts the Put.
+func (hc *HierarchicalCache) putTee(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error) {
+    targets := make([]WriteCache, 0, len(hc.writers)+1)
+    targets = append(targets, hc.parentCache)
+    targets = append(targets, hc.writers...)
+
+    pipes := make([]*io.PipeWriter, len(targets))
+    counts := make([]int64, len(targets))
+    errs := make([]error, len(targets))
+
+    var wg sync.WaitGroup
+    wg.Add(len(targets))
+
+    for i := range targets {
+        pr, pw := io.Pipe()
+        pipes[i] = pw
+
+        go func() {
+            defer crash.HandleAll()
+            defer wg.Done()
+
+            Log.Debug("HierarchicalCache::Put %s, target %d", key, i)
+            counts[i], errs[i] = WithWriteContext(targets[i]).PutContext(ctx, key, metadata, pr)
+
+            // unblock the fan-out if this writer stopped reading early
+            pr.CloseWithError(io.ErrClosedPipe)
+        }()
+    }
+
+    // the teeWriter forgets failed writers, but every pipe must still be closed
+    tee := &teeWriter{writers: append([]*io.PipeWriter(nil), pipes...)}
+
+    _, err := io.Copy(tee, &contextReader{ctx: ctx, source: data})
+    for i := range pipes {
+        pipes[i].CloseWithError(err)
+    }
+
+    wg.Wait()
+
+    if errs[0] != nil {
+        return 0, errs[0]
+    }
+
+    if err != nil {
+        return 0, err
+    }
+
+    for i := 1; i < len(errs); i++ {
+        if errs[i] != nil {
+            Log.Debug("Cache writethrough PUT error: %v", errs[i])
+        }
+    }
+
+    return counts[0], hc.replicationError("Put", key, errs[1:])
+}
+
+// teeWriter duplicates writes to each of its writers. The first writer is
+// required; any other which fails is skipped from then on.
+type teeWriter struct {
+    writers []*io.PipeWriter
+}
+
+func (tw *teeWriter) Write(p []byte) (int, error) {
+    for i := range tw.writers {
+        if tw.writers[i] == nil {
+            continue
+        }
+
+        _, err := tw.writers[i].Write(p)
+        if err != nil {
+            if i == 0 {
+                return 0, err
+            }
+
+            Log.Debug("teeWriter dropping writer %d: %v", i, err)
+            tw.writers[i] = nil
+        }
+    }
+
+    return len(p), nil
+}
+
+// cancelReader is the winning reader of raceChildren, which cancels its
+// request once it is closed or read to the end.
+type cancelReader struct {
+    cancel context.CancelFunc
+    data   io.Reader
+}
+
+func (cr *cancelReader) Close() error {
+    defer cr.cancel()
+
+    return AsReadCloser(cr.data).Close()
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+    c, err := cr.data.Read(p)
+    if err == io.EOF {
+        cr.cancel()
+    }
+
+    return c, err
+}
+
+func (cr *cancelReader) entryMetadata() *EntryMetadata {
+    return readerMetadata(cr.data)
+}
+
+func (cr *cancelReader) waitForCacheFill() int64 {
+    return WaitForCacheFill(cr.data)
 }
@@ -1,10 +1,15 @@
 package cache
 
 import (
+    "context"
+    "crypto/md5"
+    "encoding/base64"
     "errors"
     "fmt"
     "io"
     "net/http"
+    "strconv"
+    "strings"
     "time"
 )
 
@@ -17,39 +22,222 @@ var (
     ErrInvalidHttpRequest = errors.New("Unable to cast metadata to valid HttpCacheRequest")
 )
 
-type HttpReadCache struct{}
+// HttpReadCache reads entries from HTTP origins. The zero value uses
+// http.DefaultClient and DefaultRetryPolicy.
+type HttpReadCache struct {
+    client *http.Client
+    retry  RetryPolicy
+}
+
+// NewHttpReadCache returns an HttpReadCache which issues its requests through
+// client, so that timeouts, TLS and proxy settings can be configured. A nil
+// client means http.DefaultClient.
+func NewHttpReadCache(client *http.Client) *HttpReadCache {
+    return &HttpReadCache{
+        client: client,
+    }
+}
 
 func (hc *HttpReadCache) Get(path string, metadata interface{}) (int64, io.Reader, error) {
+    return hc.GetContext(context.Background(), path, metadata)
+}
+
+func (hc *HttpReadCache) GetContext(ctx context.Context, path string, metadata interface{}) (int64, io.Reader, error) {
     Log.Debug("HttpReadCache::Get %s", path)
 
-    header, ok := metadata.(http.Header)
+    header, ok := UnwrapMetadata(metadata).(http.Header)
     if !ok {
         return GetLengthUnknown, nil, ErrInvalidHttpRequest
     }
 
-    retryTxt := ""
-    var resp *http.Response
-    var err error
+    return hc.get(ctx, path, header)
+}
+
+func (hc *HttpReadCache) GetConditional(path string, metadata interface{}, em *EntryMetadata) (int64, io.Reader, error) {
+    return hc.GetConditionalContext(context.Background(), path, metadata, em)
+}
+
+// GetConditionalContext issues a GET with If-None-Match and If-Modified-Since
+// set from em, failing with a NotModifiedError if the origin responds 304.
+func (hc *HttpReadCache) GetConditionalContext(
+    ctx context.Context,
+    path string,
+    metadata interface{},
+    em *EntryMetadata,
+) (int64, io.Reader, error) {
+    Log.Debug("HttpReadCache::GetConditional %s", path)
+
+    header, ok := UnwrapMetadata(metadata).(http.Header)
+    if !ok {
+        return GetLengthUnknown, nil, ErrInvalidHttpRequest
+    }
+
+    header = header.Clone()
+    if header == nil {
+        header = http.Header{}
+    }
+
+    if em != nil && em.ETag != "" {
+        header.Set("If-None-Match", em.ETag)
+    }
+
+    if em != nil && !em.LastModified.IsZero() {
+        header.Set("If-Modified-Since", em.LastModified.UTC().Format(http.TimeFormat))
+    }
+
+    return hc.get(ctx, path, header)
+}
+
+func (hc *HttpReadCache) GetRange(path string, metadata interface{}, offset, length int64) (int64, io.Reader, error) {
+    return hc.GetRangeContext(context.Background(), path, metadata, offset, length)
+}
+
+func (hc *HttpReadCache) GetRangeContext(
+    ctx context.Context,
+    path string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    Log.Debug("HttpReadCache::GetRange %s (%d, %d)", path, offset, length)
+
+    header, ok := UnwrapMetadata(metadata).(http.Header)
+    if !ok {
+        return GetLengthUnknown, nil, ErrInvalidHttpRequest
+    }
+
+    if offset < 0 {
+        return GetLengthUnknown, nil, ErrInvalidRange
+    }
+
+    header = header.Clone()
+    if header == nil {
+        header = http.Header{}
+    }
+
+    if length > -1 {
+        header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+    } else {
+        header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+
+    resp, err := hc.do(ctx, "GET", path, header)
+    if err != nil {
+        return GetLengthUnknown, nil, err
+    }
+
+    switch {
+    case resp.StatusCode == http.StatusPartialContent:
+        Log.Debug("Returning range reader for %s (len %d)", path, resp.ContentLength)
+        return resp.ContentLength, NewSafeReader(resp.ContentLength, resp.Body, nil), nil
+    case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+        resp.Body.Close()
+        return GetLengthUnknown, nil, ErrInvalidRange
+    case resp.StatusCode >= 400:
+        Log.Debug("HTTP error %d (%s)", resp.StatusCode, resp.Status)
+        resp.Body.Close()
+        return GetLengthUnknown, nil, statusError("GetRange", path, resp.StatusCode, resp.Status)
+    }
+
+    // the origin ignored the Range header and sent everything
+    return skipRange(resp.ContentLength, hc.newReader(ctx, path, header, resp), offset, length)
+}
+
+func (hc *HttpReadCache) Stat(path string, metadata interface{}) (*CacheStat, error) {
+    return hc.StatContext(context.Background(), path, metadata)
+}
+
+// StatContext issues a HEAD request for path. The response headers are
+// returned as the stat's Metadata.
+func (hc *HttpReadCache) StatContext(ctx context.Context, path string, metadata interface{}) (*CacheStat, error) {
+    Log.Debug("HttpReadCache::Stat %s", path)
+
+    header, ok := UnwrapMetadata(metadata).(http.Header)
+    if !ok {
+        return nil, ErrInvalidHttpRequest
+    }
 
-    proxyReq, err := http.NewRequest("GET", path, nil)
+    resp, err := hc.do(ctx, "HEAD", path, header)
+    if err != nil {
+        return nil, err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode >= 400 {
+        Log.Debug("HTTP error %d (%s)", resp.StatusCode, resp.Status)
+        return nil, statusError("Stat", path, resp.StatusCode, resp.Status)
+    }
+
+    modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+    expires, _ := freshness(resp.Header, time.Now())
+
+    return &CacheStat{
+        Expires:    expires,
+        Metadata:   resp.Header,
+        ModTime:    modTime,
+        Size:       resp.ContentLength,
+        StoredSize: resp.ContentLength,
+    }, nil
+}
+
+func (hc *HttpReadCache) get(ctx context.Context, path string, header http.Header) (int64, io.Reader, error) {
+    resp, err := hc.do(ctx, "GET", path, header)
     if err != nil {
         return GetLengthUnknown, nil, err
     }
 
+    if resp.StatusCode == http.StatusNotModified {
+        Log.Debug("HTTP not modified: %s", path)
+        resp.Body.Close()
+        return GetLengthUnknown, nil, &NotModifiedError{Metadata: responseMetadata(resp)}
+    }
+
+    if resp.StatusCode >= 400 {
+        Log.Debug("HTTP error %d (%s)", resp.StatusCode, resp.Status)
+        resp.Body.Close()
+        return GetLengthUnknown, nil, statusError("Get", path, resp.StatusCode, resp.Status)
+    }
+
+    Log.Debug("Returning reader for %s (len %d)", path, resp.ContentLength)
+
+    return resp.ContentLength, hc.newReader(ctx, path, header, resp), nil
+}
+
+// SetRetryPolicy sets when failed requests, and responses which fail part
+// way through their body, are retried. A nil policy means
+// DefaultRetryPolicy.
+func (hc *HttpReadCache) SetRetryPolicy(policy RetryPolicy) {
+    hc.retry = policy
+}
+
+// do issues a request, retrying transport errors, 429 and 5xx responses as
+// the retry policy allows. The caller owns the returned response body.
+func (hc *HttpReadCache) do(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+    retryTxt := ""
+    policy := hc.retryPolicy()
+
+    proxyReq, err := http.NewRequestWithContext(ctx, method, path, nil)
+    if err != nil {
+        return nil, err
+    }
+
     for k, v := range header {
         proxyReq.Header[k] = v
     }
 
-    for i := 0; i < HttpMaxRetries; i++ {
-        if i > 0 {
-            retryTxt = fmt.Sprintf(" (retry %d)", i)
+    for attempt := 1; ; attempt++ {
+        if attempt > 1 {
+            retryTxt = fmt.Sprintf(" (retry %d)", attempt-1)
         }
 
-        Log.Debug("HTTP GET: %s%s", path, retryTxt)
+        Log.Debug("HTTP %s: %s%s", method, path, retryTxt)
+
+        resp, err := hc.httpClient().Do(proxyReq)
+        if err == nil && !retryableStatus(resp.StatusCode) {
+            return resp, nil
+        }
 
-        resp, err = http.DefaultClient.Do(proxyReq)
-        if err == nil && resp.StatusCode < 500 {
-            break
+        if ctx.Err() != nil {
+            return nil, classifyError(method, path, ctx.Err())
         }
 
         if err != nil {
@@ -58,20 +246,307 @@ func (hc *HttpReadCache) Get(path string, metadata interface{}) (int64, io.Reade
             Log.Debug("HTTP error %d (%s)", resp.StatusCode, resp.Status)
         }
 
-        <-time.After(HttpRetryIntervalSec * time.Second)
+        wait, retry := policy.Retry(attempt, resp, err)
+        if !retry {
+            if resp == nil {
+                Log.Debug("HTTP %s %s: nil response received", method, path)
+                return nil, classifyError(method, path, err)
+            }
+
+            return resp, nil
+        }
+
+        if resp != nil {
+            resp.Body.Close()
+        }
+
+        serr := sleepContext(ctx, wait)
+        if serr != nil {
+            return nil, classifyError(method, path, serr)
+        }
     }
+}
 
-    if resp == nil {
-        Log.Debug("HTTP GET %s: nil response received", path)
-        return GetLengthUnknown, nil, http.ErrMissingFile
+func (hc *HttpReadCache) httpClient() *http.Client {
+    if hc.client == nil {
+        return http.DefaultClient
     }
 
-    if resp.StatusCode >= 400 {
-        Log.Debug("HTTP error %d (%s)", resp.StatusCode, resp.Status)
-        return GetLengthUnknown, nil, http.ErrMissingFile
+    return hc.client
+}
+
+func (hc *HttpReadCache) retryPolicy() RetryPolicy {
+    if hc.retry == nil {
+        return DefaultRetryPolicy()
     }
 
-    Log.Debug("Returning reader for %s (len %d)", path, resp.ContentLength)
+    return hc.retry
+}
+
+func retryableStatus(status int) bool {
+    return status == http.StatusTooManyRequests || status >= 500
+}
+
+// newReader returns a reader over a full response body, verified against its
+// Content-MD5 when the origin sends one. If the body fails part way through,
+// the rest is requested with a ranged GET as the retry policy allows.
+func (hc *HttpReadCache) newReader(ctx context.Context, path string, header http.Header, resp *http.Response) io.Reader {
+    var reader io.Reader
+
+    body := &httpBody{
+        body:      resp.Body,
+        cache:     hc,
+        ctx:       ctx,
+        header:    header,
+        path:      path,
+        validator: rangeValidator(resp.Header),
+    }
+
+    checksum, _ := base64.StdEncoding.DecodeString(resp.Header.Get("Content-MD5"))
+    if len(checksum) == md5.Size {
+        reader = NewSafeReaderChecksum(resp.ContentLength, body, nil, md5.New(), checksum)
+    } else {
+        reader = NewSafeReader(resp.ContentLength, body, nil)
+    }
+
+    em := responseMetadata(resp)
+    if em == nil {
+        return reader
+    }
+
+    return &httpReader{
+        metadata: em,
+        source:   reader,
+    }
+}
+
+// httpBody reads a response body, resuming it from where it failed with a
+// ranged request. The validator is sent as If-Range so that a resumed body
+// is never spliced onto a different version of the entry.
+type httpBody struct {
+    attempt   int
+    body      io.ReadCloser
+    cache     *HttpReadCache
+    ctx       context.Context
+    failed    error
+    header    http.Header
+    offset    int64
+    path      string
+    validator string
+}
+
+func (hb *httpBody) Read(p []byte) (int, error) {
+    for {
+        if hb.failed != nil {
+            err := hb.resume()
+            if err != nil {
+                return 0, classifyError("Get", hb.path, err)
+            }
+        }
+
+        c, err := hb.body.Read(p)
+        hb.offset += int64(c)
+
+        if err == nil || err == io.EOF || hb.ctx.Err() != nil {
+            return c, err
+        }
+
+        hb.failed = err
+        if c > 0 {
+            return c, nil
+        }
+    }
+}
+
+func (hb *httpBody) Close() error {
+    return hb.body.Close()
+}
+
+func (hb *httpBody) resume() error {
+    cause := hb.failed
+    hb.failed = nil
+    hb.attempt++
+
+    if hb.validator == "" {
+        return cause
+    }
+
+    wait, retry := hb.cache.retryPolicy().Retry(hb.attempt, nil, cause)
+    if !retry {
+        return cause
+    }
+
+    Log.Debug("HTTP resuming %s at %d: %v", hb.path, hb.offset, cause)
+
+    err := sleepContext(hb.ctx, wait)
+    if err != nil {
+        return err
+    }
+
+    header := hb.header.Clone()
+    if header == nil {
+        header = http.Header{}
+    }
+
+    header.Set("Range", fmt.Sprintf("bytes=%d-", hb.offset))
+    header.Set("If-Range", hb.validator)
+
+    resp, err := hb.cache.do(hb.ctx, "GET", hb.path, header)
+    if err != nil {
+        return err
+    }
+
+    // anything but the rest of the same entity cannot be resumed from
+    start := fmt.Sprintf("bytes %d-", hb.offset)
+    if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Range"), start) {
+        Log.Debug("HTTP unable to resume %s: %d (%s)", hb.path, resp.StatusCode, resp.Status)
+        resp.Body.Close()
+        return cause
+    }
+
+    hb.body.Close()
+    hb.body = resp.Body
+
+    return nil
+}
+
+// rangeValidator returns a validator usable with If-Range: a strong ETag, or
+// failing that Last-Modified.
+func rangeValidator(header http.Header) string {
+    etag := header.Get("ETag")
+    if etag != "" && !strings.HasPrefix(etag, "W/") {
+        return etag
+    }
+
+    return header.Get("Last-Modified")
+}
+
+// httpReader carries what the response it reads said about caching, so that
+// it is applied when the entry fills a cache.
+type httpReader struct {
+    metadata *EntryMetadata
+    source   io.Reader
+}
+
+func (hr *httpReader) Read(p []byte) (int, error) {
+    return hr.source.Read(p)
+}
+
+func (hr *httpReader) Close() error {
+    return AsReadCloser(hr.source).Close()
+}
+
+func (hr *httpReader) entryMetadata() *EntryMetadata {
+    return hr.metadata
+}
+
+// responseMetadata returns the validators and caching directives of resp, or
+// nil if it has none.
+func responseMetadata(resp *http.Response) *EntryMetadata {
+    em := &EntryMetadata{
+        ETag: resp.Header.Get("ETag"),
+    }
+    em.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+    em.Expires, em.NoStore = freshness(resp.Header, time.Now())
+
+    if !em.HasValidators() && em.Expires.IsZero() && !em.NoStore {
+        return nil
+    }
+
+    return em
+}
+
+// freshness returns when a response stops being fresh in a shared cache, and
+// whether a shared cache may store it at all. s-maxage takes precedence over
+// max-age, which takes precedence over Expires. A zero time means the origin
+// gave no lifetime.
+func freshness(header http.Header, now time.Time) (time.Time, bool) {
+    cc := parseCacheControl(header)
+
+    _, noStore := cc["no-store"]
+    _, private := cc["private"]
+    if noStore || private {
+        return time.Time{}, true
+    }
+
+    _, noCache := cc["no-cache"]
+    if noCache {
+        return now, false
+    }
+
+    lifetime, ok := deltaSeconds(cc, "s-maxage")
+    if !ok {
+        lifetime, ok = deltaSeconds(cc, "max-age")
+    }
+
+    if !ok {
+        expires := header.Get("Expires")
+        if expires == "" {
+            return time.Time{}, false
+        }
+
+        // an invalid Expires, such as "0", means already expired
+        exp, err := http.ParseTime(expires)
+        if err != nil {
+            return now, false
+        }
+
+        date, err := http.ParseTime(header.Get("Date"))
+        if err != nil {
+            date = now
+        }
+
+        lifetime = exp.Sub(date)
+    }
+
+    age, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+    if err == nil && age > 0 {
+        lifetime -= time.Duration(age) * time.Second
+    }
+
+    if lifetime < 0 {
+        lifetime = 0
+    }
+
+    return now.Add(lifetime), false
+}
+
+// parseCacheControl returns the directives of every Cache-Control header,
+// keyed by lowercase name with any quotes removed from their values.
+func parseCacheControl(header http.Header) map[string]string {
+    cc := make(map[string]string)
+
+    for _, value := range header.Values("Cache-Control") {
+        for _, directive := range strings.Split(value, ",") {
+            directive = strings.TrimSpace(directive)
+            if directive == "" {
+                continue
+            }
+
+            name, arg, _ := strings.Cut(directive, "=")
+            name = strings.ToLower(strings.TrimSpace(name))
+            cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+        }
+    }
+
+    return cc
+}
+
+func deltaSeconds(cc map[string]string, name string) (time.Duration, bool) {
+    arg, ok := cc[name]
+    if !ok {
+        return 0, false
+    }
+
+    seconds, err := strconv.ParseInt(arg, 10, 64)
+    if err != nil {
+        return 0, false
+    }
+
+    // RFC 9111 caps delta-seconds at 2^31
+    if seconds > 1<<31 {
+        seconds = 1 << 31
+    }
 
-    return resp.ContentLength, NewSafeReader(resp.ContentLength, resp.Body, nil), nil
+    return time.Duration(seconds) * time.Second, true
 }
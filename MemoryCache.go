@@ -2,25 +2,34 @@ package cache
 
 import (
     "bytes"
-    "compress/zlib"
+    "context"
     "io"
     "sync"
+    "time"
 )
 
 type MemoryCache struct {
     data     map[string]*bytes.Buffer
     dataSize map[string]int64
     lock     sync.RWMutex
+    metadata map[string]*EntryMetadata
+    modTime  map[string]time.Time
 }
 
 func NewMemoryCache() *HierarchicalCache {
     return NewHierarchicalCache(&MemoryCache{
         data:     make(map[string]*bytes.Buffer),
         dataSize: make(map[string]int64),
+        metadata: make(map[string]*EntryMetadata),
+        modTime:  make(map[string]time.Time),
     })
 }
 
 func (mc *MemoryCache) Delete(key string, metadata interface{}) error {
+    return mc.DeleteContext(context.Background(), key, metadata)
+}
+
+func (mc *MemoryCache) DeleteContext(ctx context.Context, key string, metadata interface{}) error {
     Log.Debug("MemoryCache::Delete %s", key)
 
     mc.lock.Lock()
@@ -28,13 +37,66 @@ func (mc *MemoryCache) Delete(key string, metadata interface{}) error {
 
     delete(mc.data, key)
     delete(mc.dataSize, key)
+    delete(mc.metadata, key)
+    delete(mc.modTime, key)
 
     return nil
 }
 
 func (mc *MemoryCache) Get(key string, metadata interface{}) (int64, io.Reader, error) {
+    return mc.GetContext(context.Background(), key, metadata)
+}
+
+func (mc *MemoryCache) GetContext(ctx context.Context, key string, metadata interface{}) (int64, io.Reader, error) {
     Log.Debug("MemoryCache::Get %s", key)
 
+    if mc.reclaimExpired(key) || mc.isStale(key) {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
+
+    mc.lock.RLock()
+    defer mc.lock.RUnlock()
+
+    data, ok := mc.data[key]
+    if !ok {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
+
+    dataSize, ok := mc.dataSize[key]
+    if !ok {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
+
+    dst := make([]byte, data.Len())
+    copy(dst, data.Bytes())
+
+    src := bytes.NewReader(dst)
+    chunked, err := isChunked(src)
+    if err != nil || !chunked {
+        return GetLengthUnknown, nil, ErrCorruptChunk
+    }
+
+    Log.Debug("Returning reader for %s (len %d)", key, dataSize)
+
+    return dataSize, NewSafeReader(dataSize, newChunkedReader(src), nil), nil
+}
+
+func (mc *MemoryCache) GetRange(key string, metadata interface{}, offset, length int64) (int64, io.Reader, error) {
+    return mc.GetRangeContext(context.Background(), key, metadata, offset, length)
+}
+
+func (mc *MemoryCache) GetRangeContext(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    Log.Debug("MemoryCache::GetRange %s (%d, %d)", key, offset, length)
+
+    if mc.reclaimExpired(key) || mc.isStale(key) {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
+
     mc.lock.RLock()
     defer mc.lock.RUnlock()
 
@@ -48,25 +110,73 @@ func (mc *MemoryCache) Get(key string, metadata interface{}) (int64, io.Reader,
         return GetLengthUnknown, nil, ErrDataNotFound
     }
 
+    c, err := rangeLength(dataSize, offset, length)
+    if err != nil {
+        return GetLengthUnknown, nil, err
+    }
+
     dst := make([]byte, data.Len())
     copy(dst, data.Bytes())
 
-    zr, err := zlib.NewReader(bytes.NewReader(dst))
+    src := bytes.NewReader(dst)
+    chunked, err := isChunked(src)
+    if err != nil || !chunked {
+        return GetLengthUnknown, nil, ErrCorruptChunk
+    }
+
+    cr, err := openChunkedRange(src, offset)
     if err != nil {
         return GetLengthUnknown, nil, err
     }
 
-    Log.Debug("Returning reader for %s (len %d)", key, dataSize)
+    return c, limitRange(c, cr, length), nil
+}
 
-    return dataSize, NewSafeReader(dataSize, zr, nil), nil
+func (mc *MemoryCache) Stat(key string, metadata interface{}) (*CacheStat, error) {
+    return mc.StatContext(context.Background(), key, metadata)
+}
+
+func (mc *MemoryCache) StatContext(ctx context.Context, key string, metadata interface{}) (*CacheStat, error) {
+    Log.Debug("MemoryCache::Stat %s", key)
+
+    // stale entries are still reported, so that they can be revalidated
+    if mc.reclaimExpired(key) {
+        return nil, ErrDataNotFound
+    }
+
+    mc.lock.RLock()
+    defer mc.lock.RUnlock()
+
+    data, ok := mc.data[key]
+    if !ok {
+        return nil, ErrDataNotFound
+    }
+
+    st := &CacheStat{
+        ModTime:    mc.modTime[key],
+        Size:       mc.dataSize[key],
+        StoredSize: int64(data.Len()),
+    }
+
+    em := mc.metadata[key]
+    if em != nil {
+        st.Expires = em.Expires
+        st.Metadata = em
+    }
+
+    return st, nil
 }
 
 func (mc *MemoryCache) Put(key string, metadata interface{}, data io.Reader) (int64, error) {
+    return mc.PutContext(context.Background(), key, metadata, data)
+}
+
+func (mc *MemoryCache) PutContext(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error) {
     Log.Debug("MemoryCache::Put %s", key)
 
     var buffer bytes.Buffer
-    writer := zlib.NewWriter(&buffer)
-    c, err := io.Copy(writer, data)
+    writer := newChunkedWriter(&buffer)
+    c, err := io.Copy(writer, &contextReader{ctx: ctx, source: data})
     writer.Close()
 
     if err != nil {
@@ -78,6 +188,77 @@ func (mc *MemoryCache) Put(key string, metadata interface{}, data io.Reader) (in
 
     mc.data[key] = &buffer
     mc.dataSize[key] = c
+    mc.metadata[key] = storedMetadata(metadata)
+    mc.modTime[key] = time.Now()
 
     return c, nil
 }
+
+func (mc *MemoryCache) UpdateMetadata(key string, metadata interface{}) error {
+    return mc.UpdateMetadataContext(context.Background(), key, metadata)
+}
+
+func (mc *MemoryCache) UpdateMetadataContext(ctx context.Context, key string, metadata interface{}) error {
+    Log.Debug("MemoryCache::UpdateMetadata %s", key)
+
+    mc.lock.Lock()
+    defer mc.lock.Unlock()
+
+    _, ok := mc.data[key]
+    if !ok {
+        return ErrDataNotFound
+    }
+
+    mc.metadata[key] = storedMetadata(metadata)
+
+    return nil
+}
+
+// readMetadata returns the metadata stored with key, or nil if there is
+// none.
+func (mc *MemoryCache) readMetadata(key string) (*EntryMetadata, error) {
+    mc.lock.RLock()
+    defer mc.lock.RUnlock()
+
+    return mc.metadata[key], nil
+}
+
+// isStale reports whether key has expired but is being kept for
+// revalidation.
+func (mc *MemoryCache) isStale(key string) bool {
+    mc.lock.RLock()
+    defer mc.lock.RUnlock()
+
+    em := mc.metadata[key]
+    return em != nil && em.stale()
+}
+
+// reclaimExpired deletes key if it has expired and cannot be revalidated,
+// reporting whether it did.
+func (mc *MemoryCache) reclaimExpired(key string) bool {
+    mc.lock.RLock()
+    em := mc.metadata[key]
+    mc.lock.RUnlock()
+
+    if em == nil || !em.Expired() || em.HasValidators() {
+        return false
+    }
+
+    Log.Debug("MemoryCache::reclaimExpired %s", key)
+
+    mc.lock.Lock()
+    defer mc.lock.Unlock()
+
+    // re-check, it may have been replaced in the meantime
+    em = mc.metadata[key]
+    if em == nil || !em.Expired() || em.HasValidators() {
+        return false
+    }
+
+    delete(mc.data, key)
+    delete(mc.dataSize, key)
+    delete(mc.metadata, key)
+    delete(mc.modTime, key)
+
+    return true
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+// negativeCache remembers keys which no tier held, for up to ttl, so that
+// repeated lookups for them do not reach the children. Beyond maxEntries the
+// oldest entries are dropped.
+type negativeCache struct {
+    entries    map[string]*list.Element
+    lock       sync.Mutex
+    maxEntries int
+    order      *list.List
+    ttl        time.Duration
+}
+
+type negativeEntry struct {
+    expires time.Time
+    key     string
+}
+
+func newNegativeCache(ttl time.Duration, maxEntries int) *negativeCache {
+    return &negativeCache{
+        entries:    make(map[string]*list.Element),
+        maxEntries: maxEntries,
+        order:      list.New(),
+        ttl:        ttl,
+    }
+}
+
+func (nc *negativeCache) add(key string) {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+
+    elem, ok := nc.entries[key]
+    if ok {
+        nc.order.Remove(elem)
+    }
+
+    nc.entries[key] = nc.order.PushBack(&negativeEntry{
+        expires: time.Now().Add(nc.ttl),
+        key:     key,
+    })
+
+    // entries share a ttl, so the oldest are also the first to expire
+    for nc.order.Len() > 0 {
+        front := nc.order.Front()
+        if nc.order.Len() <= nc.maxEntries && !isExpired(front.Value.(*negativeEntry).expires) {
+            break
+        }
+
+        nc.order.Remove(front)
+        delete(nc.entries, front.Value.(*negativeEntry).key)
+    }
+}
+
+func (nc *negativeCache) contains(key string) bool {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+
+    elem, ok := nc.entries[key]
+    if !ok {
+        return false
+    }
+
+    if isExpired(elem.Value.(*negativeEntry).expires) {
+        nc.order.Remove(elem)
+        delete(nc.entries, key)
+        return false
+    }
+
+    return true
+}
+
+func (nc *negativeCache) len() int {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+
+    return nc.order.Len()
+}
+
+func (nc *negativeCache) remove(key string) {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+
+    elem, ok := nc.entries[key]
+    if !ok {
+        return
+    }
+
+    nc.order.Remove(elem)
+    delete(nc.entries, key)
+}
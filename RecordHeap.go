@@ -0,0 +1,94 @@
+package cache
+
+import (
+    "container/heap"
+)
+
+// recordHeap is a binary heap of DataRecords which also tracks each
+// record's position, so that records can be updated or removed from the
+// middle in O(log n). slot returns the field of a record holding its
+// position, which is -1 while it is not in the heap.
+type recordHeap struct {
+    less    func(a, b *DataRecord) bool
+    records []*DataRecord
+    slot    func(val *DataRecord) *int
+}
+
+func newRecordHeap(less func(a, b *DataRecord) bool, slot func(val *DataRecord) *int) *recordHeap {
+    return &recordHeap{
+        less:    less,
+        records: make([]*DataRecord, 0),
+        slot:    slot,
+    }
+}
+
+func (rh *recordHeap) Len() int           { return len(rh.records) }
+func (rh *recordHeap) Less(i, j int) bool { return rh.less(rh.records[i], rh.records[j]) }
+
+func (rh *recordHeap) Swap(i, j int) {
+    rh.records[i], rh.records[j] = rh.records[j], rh.records[i]
+    *rh.slot(rh.records[i]) = i
+    *rh.slot(rh.records[j]) = j
+}
+
+func (rh *recordHeap) Push(x interface{}) {
+    val := x.(*DataRecord)
+    *rh.slot(val) = len(rh.records)
+    rh.records = append(rh.records, val)
+}
+
+func (rh *recordHeap) Pop() interface{} {
+    last := len(rh.records) - 1
+    val := rh.records[last]
+    rh.records[last] = nil
+    rh.records = rh.records[:last]
+    *rh.slot(val) = -1
+
+    return val
+}
+
+// add inserts val, or moves it to its new place if it is already held.
+func (rh *recordHeap) add(val *DataRecord) {
+    if rh.contains(val) {
+        heap.Fix(rh, *rh.slot(val))
+        return
+    }
+
+    heap.Push(rh, val)
+}
+
+func (rh *recordHeap) contains(val *DataRecord) bool {
+    i := *rh.slot(val)
+    return i >= 0 && i < len(rh.records) && rh.records[i] == val
+}
+
+// peek returns the first record, or nil if the heap is empty.
+func (rh *recordHeap) peek() *DataRecord {
+    if len(rh.records) == 0 {
+        return nil
+    }
+
+    return rh.records[0]
+}
+
+func (rh *recordHeap) remove(val *DataRecord) {
+    if !rh.contains(val) {
+        return
+    }
+
+    heap.Remove(rh, *rh.slot(val))
+}
+
+// reset replaces the heap's contents with records in O(n).
+func (rh *recordHeap) reset(records []*DataRecord) {
+    for i := range rh.records {
+        *rh.slot(rh.records[i]) = -1
+    }
+
+    rh.records = append(rh.records[:0], records...)
+    for i := range rh.records {
+        *rh.slot(rh.records[i]) = i
+    }
+
+    heap.Init(rh)
+}
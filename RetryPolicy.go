@@ -0,0 +1,127 @@
+package cache
+
+import (
+    "math"
+    "math/rand"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// MaxRetryAfter is the longest wait a Retry-After header can ask for. Longer
+// requests are cut to it, or to the policy's Max if that is shorter.
+const MaxRetryAfter = 5 * time.Minute
+
+// RetryPolicy decides whether a failed HTTP attempt is tried again, and how
+// long to wait first. attempt counts the attempts made so far, starting at
+// 1. resp is the failed response, or nil if the attempt failed with err.
+type RetryPolicy interface {
+    Retry(attempt int, resp *http.Response, err error) (time.Duration, bool)
+}
+
+// BackoffRetryPolicy waits Initial before the first retry, multiplying the
+// wait by Multiplier after each attempt up to Max. Jitter, between 0 and 1,
+// randomly shortens each wait by up to that fraction so that clients which
+// failed together do not retry together. A Retry-After header on a 429 or 503
+// response is used in place of the computed wait, though never beyond Max or
+// MaxRetryAfter.
+type BackoffRetryPolicy struct {
+    Initial     time.Duration
+    Jitter      float64
+    Max         time.Duration // zero for no limit
+    MaxAttempts int           // including the first
+    Multiplier  float64
+}
+
+// DefaultRetryPolicy returns the policy HttpReadCache uses unless told
+// otherwise: HttpMaxRetries attempts, HttpRetryIntervalSec apart.
+func DefaultRetryPolicy() RetryPolicy {
+    return &BackoffRetryPolicy{
+        Initial:     HttpRetryIntervalSec * time.Second,
+        MaxAttempts: HttpMaxRetries,
+        Multiplier:  1,
+    }
+}
+
+// NewBackoffRetryPolicy returns a policy making up to maxAttempts attempts,
+// doubling the wait from initial up to max, with full jitter.
+func NewBackoffRetryPolicy(maxAttempts int, initial, max time.Duration) *BackoffRetryPolicy {
+    return &BackoffRetryPolicy{
+        Initial:     initial,
+        Jitter:      1,
+        Max:         max,
+        MaxAttempts: maxAttempts,
+        Multiplier:  2,
+    }
+}
+
+func (brp *BackoffRetryPolicy) Retry(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+    if attempt >= brp.MaxAttempts {
+        return 0, false
+    }
+
+    if resp != nil {
+        wait, ok := retryAfter(resp)
+        if ok {
+            if brp.Max > 0 && wait > brp.Max {
+                wait = brp.Max
+            }
+
+            return wait, true
+        }
+    }
+
+    wait := float64(brp.Initial) * math.Pow(brp.Multiplier, float64(attempt-1))
+    if brp.Max > 0 && wait > float64(brp.Max) {
+        wait = float64(brp.Max)
+    }
+
+    if brp.Jitter > 0 {
+        wait -= wait * brp.Jitter * rand.Float64()
+    }
+
+    return time.Duration(wait), true
+}
+
+// retryAfter returns the wait requested by a 429 or 503 response's
+// Retry-After header, given either in seconds or as a date, up to
+// MaxRetryAfter.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+    if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+        return 0, false
+    }
+
+    value := resp.Header.Get("Retry-After")
+    if value == "" {
+        return 0, false
+    }
+
+    seconds, err := strconv.ParseInt(value, 10, 64)
+    if err == nil {
+        if seconds < 0 {
+            seconds = 0
+        }
+
+        // clamped first, as large values overflow a Duration
+        if seconds > int64(MaxRetryAfter/time.Second) {
+            seconds = int64(MaxRetryAfter / time.Second)
+        }
+
+        return time.Duration(seconds) * time.Second, true
+    }
+
+    date, err := http.ParseTime(value)
+    if err != nil {
+        return 0, false
+    }
+
+    wait := time.Until(date)
+    if wait < 0 {
+        wait = 0
+    }
+    if wait > MaxRetryAfter {
+        wait = MaxRetryAfter
+    }
+
+    return wait, true
+}
@@ -1,13 +1,25 @@
 package cache
 
 import (
+    "bytes"
+    "errors"
     "fmt"
+    "hash"
     "io"
 )
 
+// Both match ErrCorrupt.
+var (
+    ErrChecksumMismatch error = &CacheError{Err: errors.New("checksum mismatch"), Kind: ErrCorrupt}
+    ErrReadSizeMismatch error = &CacheError{Err: errors.New("read size mismatch"), Kind: ErrCorrupt}
+)
+
 type SafeReader struct {
     ReadSize int64
     SrcSize  int64
+    checksum []byte
+    closed   bool
+    hash     hash.Hash
     source   io.Reader
     parent   io.Reader
 }
@@ -21,31 +33,81 @@ func NewSafeReader(srcSize int64, src, parent io.Reader) io.Reader {
     }
 }
 
+// NewSafeReaderChecksum is like NewSafeReader, but additionally hashes the
+// data with h and fails with ErrChecksumMismatch at EOF unless the result
+// equals checksum.
+func NewSafeReaderChecksum(srcSize int64, src, parent io.Reader, h hash.Hash, checksum []byte) io.Reader {
+    return &SafeReader{
+        ReadSize: int64(0),
+        SrcSize:  srcSize,
+        checksum: checksum,
+        hash:     h,
+        source:   src,
+        parent:   parent,
+    }
+}
+
 func (sr *SafeReader) Read(p []byte) (int, error) {
     c, err := sr.source.Read(p)
     sr.ReadSize += int64(c)
 
-    if err == io.EOF {
-        rc, ok := sr.source.(io.ReadCloser)
-        if ok {
-            rc.Close()
-        }
+    if sr.hash != nil && c > 0 {
+        sr.hash.Write(p[:c])
+    }
 
-        if sr.parent != nil {
-            rc, ok = sr.parent.(io.ReadCloser)
-            if ok {
-                rc.Close()
-            }
-        }
+    if err == io.EOF {
+        sr.Close()
 
         if sr.SrcSize > -1 && sr.ReadSize != sr.SrcSize {
             return c, fmt.Errorf(
-                "read size mismatch (%d != %d)",
+                "%w (%d != %d)",
+                ErrReadSizeMismatch,
                 sr.ReadSize,
                 sr.SrcSize,
             )
         }
+
+        if sr.hash != nil {
+            sum := sr.hash.Sum(nil)
+            if !bytes.Equal(sum, sr.checksum) {
+                return c, fmt.Errorf(
+                    "%w (%X != %X)",
+                    ErrChecksumMismatch,
+                    sum,
+                    sr.checksum,
+                )
+            }
+        }
     }
 
     return c, err
 }
+
+// Close releases the source and parent readers. It is safe to call more than
+// once, and is called automatically on EOF.
+func (sr *SafeReader) Close() error {
+    if sr.closed {
+        return nil
+    }
+
+    sr.closed = true
+
+    var err error
+
+    rc, ok := sr.source.(io.Closer)
+    if ok {
+        err = rc.Close()
+    }
+
+    if sr.parent != nil {
+        rc, ok = sr.parent.(io.Closer)
+        if ok {
+            perr := rc.Close()
+            if err == nil {
+                err = perr
+            }
+        }
+    }
+
+    return err
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+    "context"
     "io"
     "sort"
     "sync"
@@ -8,9 +9,14 @@ import (
 )
 
 type DataRecord struct {
-    Key      string
-    LastRead time.Time
-    Size     int64
+    Expires    time.Time
+    Key        string
+    LastRead   time.Time
+    Revalidate bool // kept past Expires so that it can be revalidated
+    Size       int64
+
+    expiryIndex int // position in the Scavenger's byExpiry heap
+    readIndex   int // position in an LRUEviction's heap
 }
 
 type ByLastReadAsc []*DataRecord
@@ -19,27 +25,93 @@ func (dr ByLastReadAsc) Len() int           { return len(dr) }
 func (dr ByLastReadAsc) Swap(i, j int)      { dr[i], dr[j] = dr[j], dr[i] }
 func (dr ByLastReadAsc) Less(i, j int) bool { return dr[i].LastRead.Before(dr[j].LastRead) }
 
+// Scavenger keeps its parent cache under maxSize by deleting expired
+// entries, then the entries its EvictionPolicy picks, least recently read
+// by default. Expiry is tracked in a heap, so that reads, writes and each
+// eviction take O(log n) with any of the package's policies. With
+// watermarks set, eviction runs in the background.
 type Scavenger struct {
+    byExpiry    *recordHeap // records which expire, soonest first
     data        map[string]*DataRecord
-    dataList    []*DataRecord
+    evictDone   chan struct{}
+    evicting    map[string]chan struct{} // keys being deleted by background eviction
+    highWater   int64
+    index       *scavengerIndex // nil unless opened with OpenScavenger
     lock        sync.RWMutex
+    lowWater    int64
     maxSize     int64
     currentSize int64
+    orderLock   sync.Mutex // guards LastRead and policy under the read lock
     parentCache RWCache
+    policy      EvictionPolicy
+    stop        chan struct{} // nil unless evicting in the background
+    wake        chan struct{}
 }
 
 func NewScavenger(parent RWCache, maxSize int64) *Scavenger {
     ns := &Scavenger{
+        byExpiry: newRecordHeap(
+            func(a, b *DataRecord) bool { return a.Expires.Before(b.Expires) },
+            func(val *DataRecord) *int { return &val.expiryIndex },
+        ),
         data:        make(map[string]*DataRecord),
-        dataList:    make([]*DataRecord, 0),
+        evicting:    make(map[string]chan struct{}),
         maxSize:     maxSize,
         currentSize: 0,
         parentCache: parent,
+        policy:      NewLRUEviction(),
     }
 
     return ns
 }
 
+// NewScavengerWithPolicy is like NewScavenger, but evicts the entries
+// policy picks.
+func NewScavengerWithPolicy(parent RWCache, maxSize int64, policy EvictionPolicy) *Scavenger {
+    ns := NewScavenger(parent, maxSize)
+    ns.SetEvictionPolicy(policy)
+
+    return ns
+}
+
+// OpenScavenger is like NewScavenger, but keeps its records in an index
+// file at path so that they survive restarts. Records saved by an earlier
+// run are loaded, and the cache is scavenged at once if they exceed
+// maxSize. Close the Scavenger to save its final state.
+func OpenScavenger(parent RWCache, maxSize int64, path string) (*Scavenger, error) {
+    index, records, err := openScavengerIndex(path)
+    if err != nil {
+        return nil, err
+    }
+
+    ns := NewScavenger(parent, maxSize)
+    ns.index = index
+    ns.data = records
+
+    list := ns.records()
+    sort.Sort(ByLastReadAsc(list))
+
+    expiring := make([]*DataRecord, 0)
+    for _, val := range list {
+        ns.policy.Add(val)
+        if !val.Expires.IsZero() {
+            expiring = append(expiring, val)
+        }
+
+        ns.currentSize += val.Size
+    }
+
+    ns.byExpiry.reset(expiring)
+
+    Log.Debug("Scavenger::Open %s, %d records (%d bytes)", path, len(records), ns.currentSize)
+
+    ns.lock.Lock()
+    ns.enforce()
+    ns.lock.Unlock()
+
+    return ns, nil
+}
+
 func (s *Scavenger) Touch(key string, size int64) {
     s.lock.Lock()
     defer s.lock.Unlock()
@@ -51,24 +123,54 @@ func (s *Scavenger) Touch(key string, size int64) {
             Size: size,
         }
         val = s.data[key]
-        s.dataList = append(s.dataList, val)
+        val.LastRead = time.Now()
+        s.policy.Add(val)
+    } else {
+        val.LastRead = time.Now()
+        s.policy.Access(val)
     }
 
-    val.LastRead = time.Now()
     s.currentSize += size
 
-    if s.currentSize > s.maxSize {
-        s.scavenge()
+    if s.index != nil {
+        s.index.put(val)
     }
+
+    s.enforce()
+}
+
+// Close stops background eviction and saves the index of a Scavenger opened
+// with OpenScavenger. The Scavenger must not be used afterwards.
+func (s *Scavenger) Close() error {
+    s.stopEviction()
+
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    if s.index == nil {
+        return nil
+    }
+
+    err := s.index.snapshot(s.records())
+    if err != nil {
+        s.index.close()
+        return err
+    }
+
+    return s.index.close()
 }
 
 func (s *Scavenger) Delete(key string, metadata interface{}) error {
+    return s.DeleteContext(context.Background(), key, metadata)
+}
+
+func (s *Scavenger) DeleteContext(ctx context.Context, key string, metadata interface{}) error {
     Log.Debug("Scavenger::Delete %s", key)
 
-    s.lock.Lock()
+    s.lockKey(key)
     defer s.lock.Unlock()
 
-    return s.delete(key, metadata)
+    return s.delete(ctx, key, metadata)
 }
 
 func (s *Scavenger) Find(key string) bool {
@@ -82,20 +184,25 @@ func (s *Scavenger) Find(key string) bool {
 }
 
 func (s *Scavenger) Get(key string, metadata interface{}) (int64, io.Reader, error) {
+    return s.GetContext(context.Background(), key, metadata)
+}
+
+func (s *Scavenger) GetContext(ctx context.Context, key string, metadata interface{}) (int64, io.Reader, error) {
     Log.Debug("Scavenger::Get %s (cache size %d)", key, s.Size())
 
+    if s.reclaimExpired(ctx, key) {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
+
     s.lock.RLock()
     defer s.lock.RUnlock()
 
-    count, reader, err := s.parentCache.Get(key, metadata)
+    count, reader, err := WithRWContext(s.parentCache).GetContext(ctx, key, metadata)
     if err != nil {
         return GetLengthUnknown, nil, err
     }
 
-    val, ok := s.data[key]
-    if ok {
-        val.LastRead = time.Now()
-    }
+    s.touch(key)
     // if !ok {
     //     s.data[key] = &DataRecord{
     //         Key: key,
@@ -108,13 +215,60 @@ func (s *Scavenger) Get(key string, metadata interface{}) (int64, io.Reader, err
     return count, reader, err
 }
 
+func (s *Scavenger) GetRange(key string, metadata interface{}, offset, length int64) (int64, io.Reader, error) {
+    return s.GetRangeContext(context.Background(), key, metadata, offset, length)
+}
+
+func (s *Scavenger) GetRangeContext(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    Log.Debug("Scavenger::GetRange %s (%d, %d)", key, offset, length)
+
+    if s.reclaimExpired(ctx, key) {
+        return GetLengthUnknown, nil, ErrDataNotFound
+    }
+
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+
+    count, reader, err := GetRangeContext(ctx, s.parentCache, key, metadata, offset, length)
+    if err != nil {
+        return GetLengthUnknown, nil, err
+    }
+
+    s.touch(key)
+
+    return count, reader, err
+}
+
+func (s *Scavenger) Stat(key string, metadata interface{}) (*CacheStat, error) {
+    return s.StatContext(context.Background(), key, metadata)
+}
+
+func (s *Scavenger) StatContext(ctx context.Context, key string, metadata interface{}) (*CacheStat, error) {
+    Log.Debug("Scavenger::Stat %s", key)
+
+    if s.reclaimExpired(ctx, key) {
+        return nil, ErrDataNotFound
+    }
+
+    return StatContext(ctx, s.parentCache, key, metadata)
+}
+
 func (s *Scavenger) Put(key string, metadata interface{}, data io.Reader) (int64, error) {
+    return s.PutContext(context.Background(), key, metadata, data)
+}
+
+func (s *Scavenger) PutContext(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error) {
     Log.Debug("Scavenger::Put %s", key)
 
-    s.lock.Lock()
+    s.lockKey(key)
     defer s.lock.Unlock()
 
-    c, err := s.parentCache.Put(key, metadata, data)
+    c, err := WithRWContext(s.parentCache).PutContext(ctx, key, metadata, data)
     if err != nil {
         return 0, err
     }
@@ -125,22 +279,58 @@ func (s *Scavenger) Put(key string, metadata interface{}, data io.Reader) (int64
             Key: key,
         }
         val = s.data[key]
-        s.dataList = append(s.dataList, val)
     }
 
+    // a replaced entry no longer takes up its old size
+    s.currentSize += c - val.Size
+
+    val.Expires, val.Revalidate = recordExpiry(metadata)
     val.LastRead = time.Now()
     val.Size = c
-    s.currentSize += c
 
-    Log.Debug("Scavenger::CurrentSize %d (%d max)", s.currentSize, s.maxSize)
+    s.policy.Add(val)
+    s.updateExpiry(val)
 
-    if s.currentSize > s.maxSize {
-        s.scavenge()
+    if s.index != nil {
+        s.index.put(val)
     }
 
+    Log.Debug("Scavenger::CurrentSize %d (%d max)", s.currentSize, s.maxSize)
+
+    s.enforce()
+    s.compact()
+
     return c, nil
 }
 
+// SetEvictionPolicy sets how the Scavenger picks entries to delete once the
+// cache is over maxSize. Records already held are handed to the new policy
+// in the order they were last read, so it is best set before the Scavenger
+// is used. Policies which divide the cache by size, such as ARCEviction, are
+// sized to maxSize. A nil policy restores the default LRUEviction.
+func (s *Scavenger) SetEvictionPolicy(policy EvictionPolicy) {
+    if policy == nil {
+        policy = NewLRUEviction()
+    }
+
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    sized, ok := policy.(sizedPolicy)
+    if ok {
+        sized.setCapacity(s.maxSize)
+    }
+
+    list := s.records()
+    sort.Sort(ByLastReadAsc(list))
+
+    for _, val := range list {
+        policy.Add(val)
+    }
+
+    s.policy = policy
+}
+
 func (s *Scavenger) Size() int64 {
     s.lock.RLock()
     defer s.lock.RUnlock()
@@ -148,8 +338,8 @@ func (s *Scavenger) Size() int64 {
     return s.currentSize
 }
 
-func (s *Scavenger) delete(key string, metadata interface{}) error {
-    err := s.parentCache.Delete(key, metadata)
+func (s *Scavenger) delete(ctx context.Context, key string, metadata interface{}) error {
+    err := WithRWContext(s.parentCache).DeleteContext(ctx, key, metadata)
 
     if err != nil {
         return err
@@ -160,44 +350,186 @@ func (s *Scavenger) delete(key string, metadata interface{}) error {
         return nil
     }
 
-    index := -1
-    for i := range s.dataList {
-        if s.dataList[i] == val {
-            index = i
-        }
+    s.byExpiry.remove(val)
+    s.policy.Remove(val)
+    s.currentSize -= val.Size
+
+    delete(s.data, key)
+
+    if s.index != nil {
+        s.index.delete(key)
     }
 
-    if index > -1 {
-        s.dataList = append(s.dataList[:index], s.dataList[index+1:]...)
+    return nil
+}
+
+func (s *Scavenger) UpdateMetadata(key string, metadata interface{}) error {
+    return s.UpdateMetadataContext(context.Background(), key, metadata)
+}
+
+func (s *Scavenger) UpdateMetadataContext(ctx context.Context, key string, metadata interface{}) error {
+    Log.Debug("Scavenger::UpdateMetadata %s", key)
+
+    s.lockKey(key)
+    defer s.lock.Unlock()
+
+    err := UpdateMetadataContext(ctx, s.parentCache, key, metadata)
+    if err != nil {
+        return err
     }
 
-    s.currentSize -= val.Size
+    val, ok := s.data[key]
+    if ok {
+        val.Expires, val.Revalidate = recordExpiry(metadata)
+        s.updateExpiry(val)
 
-    delete(s.data, key)
+        if s.index != nil {
+            s.index.put(val)
+        }
+    }
 
     return nil
 }
 
-func (s *Scavenger) scavenge() {
+// compact rewrites the index once its journal has grown large. The caller
+// must hold the write lock, or the read lock and orderLock.
+func (s *Scavenger) compact() {
+    if s.index == nil || !s.index.needsCompaction(len(s.data)) {
+        return
+    }
+
+    err := s.index.snapshot(s.records())
+    if err != nil {
+        Log.Debug("Scavenger::compact error: %v", err)
+    }
+}
+
+// touch records a read of key. Reads only hold the read lock, so the record
+// is updated under orderLock.
+func (s *Scavenger) touch(key string) {
+    val, ok := s.data[key]
+    if !ok {
+        return
+    }
+
+    now := time.Now()
+
+    s.orderLock.Lock()
+    defer s.orderLock.Unlock()
+
+    val.LastRead = now
+    s.policy.Access(val)
+
+    if s.index != nil {
+        s.index.read(key, now)
+
+        // reads alone must not grow the journal without bound
+        s.compact()
+    }
+}
+
+// records returns every record held. The caller must hold the write lock.
+func (s *Scavenger) records() []*DataRecord {
+    list := make([]*DataRecord, 0, len(s.data))
+    for _, val := range s.data {
+        list = append(list, val)
+    }
+
+    return list
+}
+
+// updateExpiry moves val to its place in byExpiry after its expiry changed.
+func (s *Scavenger) updateExpiry(val *DataRecord) {
+    if val.Expires.IsZero() {
+        s.byExpiry.remove(val)
+        return
+    }
+
+    s.byExpiry.add(val)
+}
+
+// reclaimExpired deletes key if its record has expired and cannot be
+// revalidated, reporting whether it did.
+func (s *Scavenger) reclaimExpired(ctx context.Context, key string) bool {
+    s.lock.RLock()
+    val, ok := s.data[key]
+    expired := ok && isExpired(val.Expires) && !val.Revalidate
+    s.lock.RUnlock()
+
+    if !expired {
+        return false
+    }
+
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    // re-check, it may have been replaced in the meantime
+    val, ok = s.data[key]
+    if !ok || !isExpired(val.Expires) || val.Revalidate {
+        return false
+    }
+
+    Log.Debug("Scavenger::reclaimExpired %s", key)
+
+    err := s.delete(ctx, key, nil)
+    if err != nil {
+        Log.Debug("Scavenger::reclaimExpired %s: %v", key, err)
+        return false
+    }
+
+    return true
+}
+
+func recordExpiry(metadata interface{}) (time.Time, bool) {
+    em := GetEntryMetadata(metadata)
+    if em == nil {
+        return time.Time{}, false
+    }
+
+    return em.Expires, em.HasValidators()
+}
+
+// scavenge deletes expired records, then those the policy evicts until the
+// cache fits in limit bytes. Records whose entries could not be deleted are
+// kept, but not tried again until the next scavenge. The caller must hold
+// the write lock.
+func (s *Scavenger) scavenge(limit int64) {
     Log.Debug("Scavenging cache records...")
 
-    deletes := make([]string, 0)
+    failed := make([]*DataRecord, 0)
+
+    // expired records go first, regardless of when they were last read
+    for s.byExpiry.Len() > 0 && isExpired(s.byExpiry.peek().Expires) {
+        val := s.byExpiry.peek()
+
+        err := s.delete(context.Background(), val.Key, nil)
+        if err != nil {
+            Log.Debug("Scavenger::scavenge %s: %v", val.Key, err)
+            s.byExpiry.remove(val)
+            failed = append(failed, val)
+        }
+    }
+
+    for i := range failed {
+        s.byExpiry.add(failed[i])
+    }
 
-    // sort by last read time
-    sort.Sort(ByLastReadAsc(s.dataList))
+    failed = failed[:0]
 
-    // delete until below maxSize
-    targetSize := s.currentSize - s.maxSize
-    deleteSize := int64(0)
-    for i := range s.dataList {
-        deleteSize += s.dataList[i].Size
-        deletes = append(deletes, s.dataList[i].Key)
-        if deleteSize >= targetSize {
+    for s.currentSize > limit {
+        val := s.policy.Evict()
+        if val == nil {
             break
         }
+
+        err := s.delete(context.Background(), val.Key, nil)
+        if err != nil {
+            Log.Debug("Scavenger::scavenge %s: %v", val.Key, err)
+            failed = append(failed, val)
+        }
     }
 
-    for i := range deletes {
-        s.delete(deletes[i], nil)
+    for i := range failed {
+        s.policy.Add(failed[i])
     }
 }
@@ -0,0 +1,230 @@
+package cache
+
+import (
+    "context"
+    "errors"
+
+    "github.com/xaevman/crash"
+)
+
+// evictBatchSize is the most records background eviction takes from the
+// Scavenger under a single hold of its lock.
+const evictBatchSize = 64
+
+// SetWatermarks moves eviction into the background. Once the cache grows
+// past high bytes, a background goroutine deletes entries until it is back
+// under low, so that writes do not wait for files to be deleted and the next
+// write after an eviction does not start another. maxSize stays a hard
+// limit: a write which takes the cache past it evicts down to low itself,
+// which happens only if background eviction falls that far behind or high
+// is maxSize. high is limited to maxSize, and low to high. Close stops
+// the goroutine.
+func (s *Scavenger) SetWatermarks(high, low int64) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    if high > s.maxSize {
+        high = s.maxSize
+    }
+    if low > high {
+        low = high
+    }
+
+    s.highWater = high
+    s.lowWater = low
+
+    if s.stop == nil {
+        s.evictDone = make(chan struct{})
+        s.stop = make(chan struct{})
+        s.wake = make(chan struct{}, 1)
+
+        go s.evictLoop(s.stop, s.wake, s.evictDone)
+    }
+
+    if s.currentSize > s.highWater {
+        s.notifyEviction()
+    }
+}
+
+// enforce evicts at once if the cache is over maxSize, and wakes background
+// eviction if it is over the high watermark. With watermarks set, eviction
+// at once goes down to the low watermark, so that a high watermark at
+// maxSize does not leave every later write to evict for itself. The caller
+// must hold the write lock.
+func (s *Scavenger) enforce() {
+    if s.currentSize > s.maxSize {
+        limit := s.maxSize
+        if s.wake != nil {
+            limit = s.lowWater
+        }
+
+        s.scavenge(limit)
+    }
+
+    if s.wake != nil && s.currentSize > s.highWater {
+        s.notifyEviction()
+    }
+}
+
+// evictBackground evicts until the cache is under the low watermark, or
+// stop is closed. Records are taken from the Scavenger in batches under the
+// lock, and their entries deleted from the parent once it is released. A
+// batch with entries which could not be deleted ends the run, so that they
+// are not retried until the next.
+func (s *Scavenger) evictBackground(stop chan struct{}) {
+    for {
+        select {
+        case <-stop:
+            return
+        default:
+        }
+
+        s.lock.Lock()
+        victims := s.takeVictims()
+        s.lock.Unlock()
+
+        if len(victims) == 0 {
+            return
+        }
+
+        Log.Debug("Scavenger::evict %d records", len(victims))
+
+        failed := false
+        for i := range victims {
+            err := WithRWContext(s.parentCache).DeleteContext(context.Background(), victims[i].Key, nil)
+            if errors.Is(err, ErrDataNotFound) {
+                err = nil
+            }
+
+            s.lock.Lock()
+            s.finishEviction(victims[i], err)
+            s.lock.Unlock()
+
+            failed = failed || err != nil
+        }
+
+        if failed {
+            return
+        }
+    }
+}
+
+func (s *Scavenger) evictLoop(stop, wake, done chan struct{}) {
+    defer crash.HandleAll()
+    defer close(done)
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-wake:
+            s.evictBackground(stop)
+        }
+    }
+}
+
+// finishEviction marks the eviction of val done. If its entry could not be
+// deleted, val is restored, unless the key has been written again since.
+// The caller must hold the write lock.
+func (s *Scavenger) finishEviction(val *DataRecord, err error) {
+    done := s.evicting[val.Key]
+    delete(s.evicting, val.Key)
+    close(done)
+
+    if err == nil {
+        return
+    }
+
+    Log.Debug("Scavenger::evict %s: %v", val.Key, err)
+
+    _, ok := s.data[val.Key]
+    if ok {
+        return
+    }
+
+    s.data[val.Key] = val
+    s.currentSize += val.Size
+    s.policy.Add(val)
+    s.updateExpiry(val)
+
+    if s.index != nil {
+        s.index.put(val)
+    }
+}
+
+// lockKey takes the write lock once no eviction of key is in progress, so
+// that a write is never undone by the deletion of what it replaced.
+func (s *Scavenger) lockKey(key string) {
+    for {
+        s.lock.Lock()
+
+        done, ok := s.evicting[key]
+        if !ok {
+            return
+        }
+
+        s.lock.Unlock()
+        <-done
+    }
+}
+
+// notifyEviction wakes background eviction, if it is not already awake.
+func (s *Scavenger) notifyEviction() {
+    select {
+    case s.wake <- struct{}{}:
+    default:
+    }
+}
+
+// stopEviction stops background eviction and waits for it to finish.
+func (s *Scavenger) stopEviction() {
+    s.lock.Lock()
+    stop := s.stop
+    done := s.evictDone
+    s.stop = nil
+    s.wake = nil
+    s.lock.Unlock()
+
+    if stop == nil {
+        return
+    }
+
+    close(stop)
+    <-done
+}
+
+// takeVictims removes the next batch of records to evict from the
+// Scavenger, expired records first, and marks them as being evicted. The
+// caller must hold the write lock.
+func (s *Scavenger) takeVictims() []*DataRecord {
+    victims := make([]*DataRecord, 0)
+
+    take := func(val *DataRecord) {
+        delete(s.data, val.Key)
+        s.byExpiry.remove(val)
+        s.policy.Remove(val)
+        s.currentSize -= val.Size
+        s.evicting[val.Key] = make(chan struct{})
+
+        if s.index != nil {
+            s.index.delete(val.Key)
+        }
+
+        victims = append(victims, val)
+    }
+
+    for len(victims) < evictBatchSize && s.byExpiry.Len() > 0 && isExpired(s.byExpiry.peek().Expires) {
+        take(s.byExpiry.peek())
+    }
+
+    for len(victims) < evictBatchSize && s.currentSize > s.lowWater {
+        val := s.policy.Evict()
+        if val == nil {
+            break
+        }
+
+        take(val)
+    }
+
+    return victims
+}
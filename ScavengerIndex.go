@@ -0,0 +1,284 @@
+package cache
+
+import (
+    "bufio"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const (
+    indexOpDelete = "delete"
+    indexOpPut    = "put"
+    indexOpRead   = "read"
+)
+
+// minCompaction is the fewest journal entries which make a Scavenger
+// compact its index.
+const minCompaction = 1024
+
+// indexEntry is a line of a Scavenger index. Snapshots hold a put for every
+// record; the journal holds every change since.
+type indexEntry struct {
+    Expires    time.Time `json:"expires"`
+    Key        string    `json:"key"`
+    LastRead   time.Time `json:"lastRead"`
+    Op         string    `json:"op"`
+    Revalidate bool      `json:"revalidate,omitempty"`
+    Size       int64     `json:"size,omitempty"`
+}
+
+// scavengerIndex persists a Scavenger's records as a snapshot file at path
+// and a journal of changes next to it. Each journal entry is a single
+// append, and snapshots replace the old one by rename, so a crash loses at
+// most the entries not yet written and never leaves a damaged index behind.
+type scavengerIndex struct {
+    entries int
+    journal *os.File
+    lock    sync.Mutex
+    path    string
+}
+
+// openScavengerIndex loads the records saved at path, compacts them into a
+// fresh snapshot and opens a new journal.
+func openScavengerIndex(path string) (*scavengerIndex, map[string]*DataRecord, error) {
+    records := make(map[string]*DataRecord)
+
+    err := os.MkdirAll(filepath.Dir(path), 0770)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    err = replayIndex(path, records)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    err = replayIndex(journalPath(path), records)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    si := &scavengerIndex{
+        path: path,
+    }
+
+    list := make([]*DataRecord, 0, len(records))
+    for _, val := range records {
+        list = append(list, val)
+    }
+
+    err = si.snapshot(list)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return si, records, nil
+}
+
+func journalPath(path string) string {
+    return path + ".journal"
+}
+
+// replayIndex applies the entries in the file at path to records. A missing
+// file holds nothing. Reading stops at the first damaged line, which can
+// only be a write cut short by a crash.
+func replayIndex(path string, records map[string]*DataRecord) error {
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+    for scanner.Scan() {
+        var entry indexEntry
+
+        err := json.Unmarshal(scanner.Bytes(), &entry)
+        if err != nil {
+            Log.Debug("Scavenger index %s damaged, ignoring the rest: %v", path, err)
+            return nil
+        }
+
+        switch entry.Op {
+        case indexOpPut:
+            records[entry.Key] = &DataRecord{
+                Expires:    entry.Expires,
+                Key:        entry.Key,
+                LastRead:   entry.LastRead,
+                Revalidate: entry.Revalidate,
+                Size:       entry.Size,
+            }
+        case indexOpRead:
+            val, ok := records[entry.Key]
+            if ok {
+                val.LastRead = entry.LastRead
+            }
+        case indexOpDelete:
+            delete(records, entry.Key)
+        }
+    }
+
+    err = scanner.Err()
+    if err != nil {
+        Log.Debug("Scavenger index %s unreadable, ignoring the rest: %v", path, err)
+    }
+
+    return nil
+}
+
+func (si *scavengerIndex) close() error {
+    si.lock.Lock()
+    defer si.lock.Unlock()
+
+    if si.journal == nil {
+        return nil
+    }
+
+    err := si.journal.Sync()
+    si.journal.Close()
+    si.journal = nil
+
+    return err
+}
+
+func (si *scavengerIndex) delete(key string) {
+    si.append(&indexEntry{
+        Key: key,
+        Op:  indexOpDelete,
+    })
+}
+
+// needsCompaction reports whether the journal has grown well past the live
+// records it describes.
+func (si *scavengerIndex) needsCompaction(live int) bool {
+    si.lock.Lock()
+    defer si.lock.Unlock()
+
+    return si.entries > minCompaction && si.entries > 2*live
+}
+
+func (si *scavengerIndex) put(val *DataRecord) {
+    si.append(putEntry(val))
+}
+
+func (si *scavengerIndex) read(key string, lastRead time.Time) {
+    si.append(&indexEntry{
+        Key:      key,
+        LastRead: lastRead,
+        Op:       indexOpRead,
+    })
+}
+
+// snapshot replaces the index with records and starts an empty journal.
+// The new snapshot is synced before it takes the old one's place.
+func (si *scavengerIndex) snapshot(records []*DataRecord) error {
+    si.lock.Lock()
+    defer si.lock.Unlock()
+
+    tmp := si.path + ".tmp"
+
+    f, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+
+    w := bufio.NewWriter(f)
+    enc := json.NewEncoder(w)
+
+    for i := range records {
+        err = enc.Encode(putEntry(records[i]))
+        if err != nil {
+            break
+        }
+    }
+
+    if err == nil {
+        err = w.Flush()
+    }
+
+    if err == nil {
+        err = f.Sync()
+    }
+
+    f.Close()
+
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+
+    err = os.Rename(tmp, si.path)
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+
+    syncDir(filepath.Dir(si.path))
+
+    // the journal's entries are all in the snapshot now
+    if si.journal != nil {
+        si.journal.Close()
+    }
+
+    si.journal, err = os.OpenFile(journalPath(si.path), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0660)
+    si.entries = 0
+
+    return err
+}
+
+func (si *scavengerIndex) append(entry *indexEntry) {
+    line, err := json.Marshal(entry)
+    if err != nil {
+        Log.Debug("Scavenger index entry for %s: %v", entry.Key, err)
+        return
+    }
+
+    si.lock.Lock()
+    defer si.lock.Unlock()
+
+    if si.journal == nil {
+        return
+    }
+
+    // one write per entry, so a crash cannot interleave two of them
+    _, err = si.journal.Write(append(line, '\n'))
+    if err != nil {
+        Log.Debug("Scavenger index write for %s: %v", entry.Key, err)
+        return
+    }
+
+    si.entries++
+}
+
+func putEntry(val *DataRecord) *indexEntry {
+    return &indexEntry{
+        Expires:    val.Expires,
+        Key:        val.Key,
+        LastRead:   val.LastRead,
+        Op:         indexOpPut,
+        Revalidate: val.Revalidate,
+        Size:       val.Size,
+    }
+}
+
+// syncDir makes a rename within dir durable where the platform allows it.
+func syncDir(dir string) {
+    d, err := os.Open(dir)
+    if err != nil {
+        return
+    }
+    defer d.Close()
+
+    err = d.Sync()
+    if err != nil {
+        Log.Debug("Sync %s: %v", dir, err)
+    }
+}
@@ -0,0 +1,266 @@
+package cache
+
+import (
+    "context"
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/xaevman/crash"
+)
+
+const (
+    // files in a DiskCache's temp root older than this are left over from
+    // writes which never finished, and are removed by a rebuild
+    StaleTmpAge = time.Hour
+
+    // scanned records are added to the Scavenger this many at a time
+    scanBatchSize = 1000
+)
+
+// ScanProgress is how far a rebuild of a Scavenger has got.
+type ScanProgress struct {
+    Bytes      int64 // total size of the files recorded
+    Done       bool
+    Err        error // why the rebuild stopped early, once Done
+    Files      int   // files recorded
+    StaleFiles int   // leftover temp files removed
+}
+
+// ScavengerScan is a rebuild of a Scavenger's records running in the
+// background.
+type ScavengerScan struct {
+    done     chan struct{}
+    lock     sync.Mutex
+    progress ScanProgress
+}
+
+// Rebuild records every file in dc in the background, so that a Scavenger
+// created over an existing cache can manage what is already there. Each
+// file is recorded with its decompressed size, the unit Put accounts in, and
+// the later of its access and modification times as its last read. Files
+// whose size cannot be read, such as compressed files older than the chunked
+// layout, are recorded at their size on disk. Expired files are reclaimed
+// rather than recorded. Records the Scavenger already holds are kept, and
+// maxSize is enforced as the scan goes. Leftover files in dc's temp root are
+// removed first.
+func (s *Scavenger) Rebuild(dc *DiskCache) *ScavengerScan {
+    return s.RebuildContext(context.Background(), dc)
+}
+
+// RebuildContext is like Rebuild, but the scan stops early if ctx is done.
+func (s *Scavenger) RebuildContext(ctx context.Context, dc *DiskCache) *ScavengerScan {
+    ss := &ScavengerScan{
+        done: make(chan struct{}),
+    }
+
+    go func() {
+        defer crash.HandleAll()
+        defer close(ss.done)
+
+        err := s.rebuild(ctx, dc, ss)
+
+        ss.lock.Lock()
+        ss.progress.Done = true
+        ss.progress.Err = err
+        progress := ss.progress
+        ss.lock.Unlock()
+
+        Log.Debug(
+            "Scavenger::Rebuild %s done, %d files (%d bytes), %d stale: %v",
+            dc.GetRoot(),
+            progress.Files,
+            progress.Bytes,
+            progress.StaleFiles,
+            err,
+        )
+    }()
+
+    return ss
+}
+
+// Progress returns how far the rebuild has got.
+func (ss *ScavengerScan) Progress() ScanProgress {
+    ss.lock.Lock()
+    defer ss.lock.Unlock()
+
+    return ss.progress
+}
+
+// Wait waits for the rebuild to finish, returning why it stopped early if
+// it did.
+func (ss *ScavengerScan) Wait() error {
+    <-ss.done
+
+    return ss.Progress().Err
+}
+
+func (s *Scavenger) rebuild(ctx context.Context, dc *DiskCache, ss *ScavengerScan) error {
+    err := removeStaleTmp(ctx, dc.GetTmpRoot(), ss)
+    if err != nil {
+        return err
+    }
+
+    root := dc.GetRoot()
+    batch := make([]*DataRecord, 0, scanBatchSize)
+
+    err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) {
+                return nil
+            }
+
+            return err
+        }
+
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+
+        if d.IsDir() {
+            if path == filepath.Join(root, diskMetaDir) {
+                return filepath.SkipDir
+            }
+
+            return nil
+        }
+
+        fi, err := d.Info()
+        if os.IsNotExist(err) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        rel, err := filepath.Rel(root, path)
+        if err != nil {
+            return err
+        }
+        key := filepath.ToSlash(rel)
+
+        val := &DataRecord{
+            Key:      key,
+            LastRead: lastUsed(fi),
+            Size:     fi.Size(),
+        }
+
+        st, err := dc.StatContext(ctx, key, nil)
+        if errors.Is(err, ErrDataNotFound) {
+            return nil
+        }
+        if err != nil {
+            Log.Debug("Scavenger::Rebuild stat error %s: %v", key, err)
+        } else {
+            if st.Size != GetLengthUnknown {
+                val.Size = st.Size
+            }
+
+            val.Expires, val.Revalidate = recordExpiry(st.Metadata)
+        }
+
+        batch = append(batch, val)
+        if len(batch) == scanBatchSize {
+            s.addScanned(batch, ss)
+            batch = batch[:0]
+        }
+
+        return nil
+    })
+
+    s.addScanned(batch, ss)
+
+    return err
+}
+
+// addScanned adds scanned records the Scavenger does not already hold, and
+// evicts if they take it past its limits.
+func (s *Scavenger) addScanned(batch []*DataRecord, ss *ScavengerScan) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    files := 0
+    bytes := int64(0)
+
+    for _, val := range batch {
+        _, ok := s.data[val.Key]
+        _, evicting := s.evicting[val.Key]
+        if ok || evicting {
+            continue
+        }
+
+        s.data[val.Key] = val
+        s.policy.Add(val)
+        s.updateExpiry(val)
+        s.currentSize += val.Size
+
+        if s.index != nil {
+            s.index.put(val)
+        }
+
+        files++
+        bytes += val.Size
+    }
+
+    s.enforce()
+    s.compact()
+
+    ss.lock.Lock()
+    ss.progress.Files += files
+    ss.progress.Bytes += bytes
+    progress := ss.progress
+    ss.lock.Unlock()
+
+    Log.Debug("Scavenger::Rebuild %d files (%d bytes) so far", progress.Files, progress.Bytes)
+}
+
+// removeStaleTmp removes files in tmp older than StaleTmpAge.
+func removeStaleTmp(ctx context.Context, tmp string, ss *ScavengerScan) error {
+    entries, err := os.ReadDir(tmp)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    for _, entry := range entries {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+
+        fi, err := entry.Info()
+        if err != nil || fi.IsDir() || time.Since(fi.ModTime()) < StaleTmpAge {
+            continue
+        }
+
+        err = os.Remove(filepath.Join(tmp, entry.Name()))
+        if err != nil {
+            Log.Debug("Scavenger::Rebuild stale file %s: %v", entry.Name(), err)
+            continue
+        }
+
+        ss.lock.Lock()
+        ss.progress.StaleFiles++
+        ss.lock.Unlock()
+    }
+
+    return nil
+}
+
+// lastUsed is the later of fi's access and modification times. Access
+// times are often not kept up to date, and are unavailable on some
+// platforms.
+func lastUsed(fi os.FileInfo) time.Time {
+    used := fi.ModTime()
+
+    atime := accessTime(fi)
+    if atime.After(used) {
+        used = atime
+    }
+
+    return used
+}
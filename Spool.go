@@ -0,0 +1,117 @@
+package cache
+
+import (
+    "io"
+    "io/ioutil"
+    "os"
+)
+
+const (
+    DefaultSpoolThreshold = 32 * 1024 * 1024
+)
+
+// Spool buffers a stream in memory until it grows past threshold, at which
+// point it moves to a temporary file in dir. Any number of independent
+// readers may be taken over the spooled data.
+type Spool struct {
+    dir       string
+    file      *os.File
+    memory    []byte
+    size      int64
+    threshold int64
+}
+
+func NewSpool(dir string, threshold int64) *Spool {
+    return &Spool{
+        dir:       dir,
+        memory:    make([]byte, 0),
+        threshold: threshold,
+    }
+}
+
+func (s *Spool) Close() error {
+    s.memory = nil
+
+    if s.file == nil {
+        return nil
+    }
+
+    s.file.Close()
+    err := os.Remove(s.file.Name())
+    s.file = nil
+
+    return err
+}
+
+func (s *Spool) NewReader() io.Reader {
+    return io.NewSectionReader(s, 0, s.size)
+}
+
+func (s *Spool) ReadAt(p []byte, off int64) (int, error) {
+    if s.file != nil {
+        return s.file.ReadAt(p, off)
+    }
+
+    if off >= int64(len(s.memory)) {
+        return 0, io.EOF
+    }
+
+    c := copy(p, s.memory[off:])
+    if c < len(p) {
+        return c, io.EOF
+    }
+
+    return c, nil
+}
+
+func (s *Spool) Size() int64 {
+    return s.size
+}
+
+func (s *Spool) Write(p []byte) (int, error) {
+    if s.file == nil && s.size+int64(len(p)) > s.threshold {
+        err := s.spill()
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    if s.file != nil {
+        c, err := s.file.Write(p)
+        s.size += int64(c)
+        return c, err
+    }
+
+    s.memory = append(s.memory, p...)
+    s.size += int64(len(p))
+
+    return len(p), nil
+}
+
+func (s *Spool) spill() error {
+    Log.Debug("Spool::spill %d bytes to %s", s.size, s.dir)
+
+    if s.dir != "" {
+        err := os.MkdirAll(s.dir, 0770)
+        if err != nil {
+            return err
+        }
+    }
+
+    f, err := ioutil.TempFile(s.dir, "spool")
+    if err != nil {
+        return err
+    }
+
+    _, err = f.Write(s.memory)
+    if err != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return err
+    }
+
+    s.file = f
+    s.memory = nil
+
+    return nil
+}
@@ -0,0 +1,389 @@
+package cache
+
+import (
+    "context"
+    "errors"
+    "io"
+    "sync"
+
+    "github.com/xaevman/crash"
+)
+
+const (
+    PromoteAll     PromotionMode = iota // copy a hit into every level above the one which held it
+    PromoteToLevel                      // copy a hit only into PromotionPolicy.Level
+)
+
+// maxTrackedHits bounds the keys TieredCache counts hits for. Once reached
+// the counts start again from zero.
+const maxTrackedHits = 64 * 1024
+
+type PromotionMode int
+
+// PromotionPolicy decides which levels of a TieredCache a hit in a lower
+// level is copied into. With MinHits above 1, a key is only promoted on
+// every MinHits'th hit below the top level.
+type PromotionPolicy struct {
+    Level   int // the level PromoteToLevel copies into
+    MinHits int
+    Mode    PromotionMode
+}
+
+// TieredCache reads through an ordered list of levels, fastest first, and
+// promotes entries found in a lower level into the levels above it as they
+// are read. Each promotion buffers the data once, however many levels it is
+// copied into. Levels which are not a WriteCache, such as HTTP origins, are
+// only read from.
+type TieredCache struct {
+    admission      AdmissionPolicy
+    hitLock        sync.Mutex
+    hits           map[string]int
+    levels         []ReadCache
+    policy         PromotionPolicy
+    spoolDir       string
+    spoolThreshold int64
+}
+
+// levelWriter writes to several levels from a single buffered copy of the
+// data.
+type levelWriter struct {
+    levels         []WriteCache
+    spoolDir       string
+    spoolThreshold int64
+}
+
+func NewTieredCache(levels ...ReadCache) *TieredCache {
+    return &TieredCache{
+        hits:           make(map[string]int),
+        levels:         levels,
+        spoolThreshold: DefaultSpoolThreshold,
+    }
+}
+
+func (tc *TieredCache) Delete(key string, metadata interface{}) error {
+    return tc.DeleteContext(context.Background(), key, metadata)
+}
+
+// DeleteContext deletes key from every writable level. Levels which did not
+// hold key are only reported if none did.
+func (tc *TieredCache) DeleteContext(ctx context.Context, key string, metadata interface{}) error {
+    Log.Debug("TieredCache::Delete %s", key)
+
+    deleted := false
+    errs := make([]error, 0, len(tc.levels))
+
+    for i := range tc.levels {
+        wc, ok := tc.levels[i].(WriteCache)
+        if !ok {
+            continue
+        }
+
+        err := WithWriteContext(wc).DeleteContext(ctx, key, metadata)
+        if err != nil {
+            errs = append(errs, err)
+            continue
+        }
+
+        deleted = true
+    }
+
+    if len(errs) == 0 {
+        return nil
+    }
+
+    err := newTierError("Delete", key, errs)
+    if deleted && errors.Is(err, ErrDataNotFound) {
+        return nil
+    }
+
+    return err
+}
+
+func (tc *TieredCache) Get(key string, metadata interface{}) (int64, io.Reader, error) {
+    return tc.GetContext(context.Background(), key, metadata)
+}
+
+// GetContext reads key from the first level which holds it. If the policy
+// calls for it, the returned reader copies the data into the chosen levels
+// above once it has been read to the end.
+func (tc *TieredCache) GetContext(ctx context.Context, key string, metadata interface{}) (int64, io.Reader, error) {
+    Log.Debug("TieredCache::Get %s", key)
+
+    errs := make([]error, 0, len(tc.levels))
+
+    for i := range tc.levels {
+        count, data, err := WithReadContext(tc.levels[i]).GetContext(ctx, key, metadata)
+        if err != nil {
+            if ctx.Err() != nil {
+                return GetLengthUnknown, nil, ctx.Err()
+            }
+
+            errs = append(errs, err)
+            continue
+        }
+
+        Log.Debug("TieredCache::Get %s, level %d", key, i)
+
+        targets := tc.promotionTargets(key, i)
+        if len(targets) == 0 {
+            return count, data, nil
+        }
+
+        if tc.admission != nil && !tc.admission.Admit(key, count) {
+            Log.Debug("TieredCache::Get %s, not admitted", key)
+            return count, data, nil
+        }
+
+        // the promotion finishes in the background, so it must not be
+        // cancelled along with the caller once the data is read
+        filler := NewCacheFillerContext(context.WithoutCancel(ctx), key, metadata, &levelWriter{
+            levels:         targets,
+            spoolDir:       tc.spoolDir,
+            spoolThreshold: tc.spoolThreshold,
+        }, data)
+        filler.SetSpool(tc.spoolDir, tc.spoolThreshold)
+        filler.SetExpectedSize(count)
+
+        return count, filler, nil
+    }
+
+    return GetLengthUnknown, nil, newTierError("Get", key, errs)
+}
+
+func (tc *TieredCache) GetRange(key string, metadata interface{}, offset, length int64) (int64, io.Reader, error) {
+    return tc.GetRangeContext(context.Background(), key, metadata, offset, length)
+}
+
+// GetRangeContext reads a range from the first level which holds key.
+// Partial reads are never promoted.
+func (tc *TieredCache) GetRangeContext(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    Log.Debug("TieredCache::GetRange %s (%d, %d)", key, offset, length)
+
+    errs := make([]error, 0, len(tc.levels))
+
+    for i := range tc.levels {
+        count, data, err := GetRangeContext(ctx, tc.levels[i], key, metadata, offset, length)
+        if err == nil || errors.Is(err, ErrInvalidRange) {
+            return count, data, err
+        }
+
+        if ctx.Err() != nil {
+            return GetLengthUnknown, nil, ctx.Err()
+        }
+
+        errs = append(errs, err)
+    }
+
+    return GetLengthUnknown, nil, newTierError("GetRange", key, errs)
+}
+
+// Levels returns the cache's levels, fastest first.
+func (tc *TieredCache) Levels() []ReadCache {
+    return append([]ReadCache(nil), tc.levels...)
+}
+
+func (tc *TieredCache) Put(key string, metadata interface{}, data io.Reader) (int64, error) {
+    return tc.PutContext(context.Background(), key, metadata, data)
+}
+
+// PutContext writes data to every writable level. It only fails if no level
+// could store it.
+func (tc *TieredCache) PutContext(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error) {
+    Log.Debug("TieredCache::Put %s", key)
+
+    lw := &levelWriter{
+        levels:         make([]WriteCache, 0, len(tc.levels)),
+        spoolDir:       tc.spoolDir,
+        spoolThreshold: tc.spoolThreshold,
+    }
+
+    for i := range tc.levels {
+        wc, ok := tc.levels[i].(WriteCache)
+        if ok {
+            lw.levels = append(lw.levels, wc)
+        }
+    }
+
+    return lw.PutContext(ctx, key, metadata, data)
+}
+
+// SetAdmissionPolicy sets which entries the promotion policy picks are
+// actually promoted. A nil policy admits everything.
+func (tc *TieredCache) SetAdmissionPolicy(policy AdmissionPolicy) {
+    tc.admission = policy
+}
+
+// SetPromotionPolicy sets which levels hits are copied into. The default
+// copies every hit into every level above it.
+func (tc *TieredCache) SetPromotionPolicy(policy PromotionPolicy) {
+    tc.hitLock.Lock()
+    defer tc.hitLock.Unlock()
+
+    tc.policy = policy
+    tc.hits = make(map[string]int)
+}
+
+// SetSpool configures where promotions and Puts stage data. Data up to
+// threshold bytes is held in memory, anything larger is written to a temp
+// file in dir.
+func (tc *TieredCache) SetSpool(dir string, threshold int64) {
+    tc.spoolDir = dir
+    tc.spoolThreshold = threshold
+}
+
+func (tc *TieredCache) Stat(key string, metadata interface{}) (*CacheStat, error) {
+    return tc.StatContext(context.Background(), key, metadata)
+}
+
+// StatContext stats the level Get would read key from. Level reports which
+// level that was. Levels which cannot Stat are skipped.
+func (tc *TieredCache) StatContext(ctx context.Context, key string, metadata interface{}) (*CacheStat, error) {
+    Log.Debug("TieredCache::Stat %s", key)
+
+    errs := make([]error, 0, len(tc.levels))
+
+    for i := range tc.levels {
+        st, err := StatContext(ctx, tc.levels[i], key, metadata)
+        if err == nil {
+            st.Level += i
+            return st, nil
+        }
+
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+
+        if err != ErrNotSupported {
+            errs = append(errs, err)
+        }
+    }
+
+    return nil, newTierError("Stat", key, errs)
+}
+
+// promotionTargets returns the writable levels above found that a hit on key
+// in found should be copied into.
+func (tc *TieredCache) promotionTargets(key string, found int) []WriteCache {
+    if found == 0 {
+        return nil
+    }
+
+    tc.hitLock.Lock()
+    policy := tc.policy
+    promote := true
+    if policy.MinHits > 1 {
+        if len(tc.hits) >= maxTrackedHits {
+            tc.hits = make(map[string]int)
+        }
+
+        tc.hits[key]++
+        promote = tc.hits[key] >= policy.MinHits
+        if promote {
+            delete(tc.hits, key)
+        }
+    }
+    tc.hitLock.Unlock()
+
+    if !promote {
+        return nil
+    }
+
+    targets := make([]WriteCache, 0, found)
+    for i := 0; i < found; i++ {
+        if policy.Mode == PromoteToLevel && i != policy.Level {
+            continue
+        }
+
+        wc, ok := tc.levels[i].(WriteCache)
+        if ok {
+            targets = append(targets, wc)
+        }
+    }
+
+    return targets
+}
+
+func (lw *levelWriter) Delete(key string, metadata interface{}) error {
+    return lw.DeleteContext(context.Background(), key, metadata)
+}
+
+func (lw *levelWriter) DeleteContext(ctx context.Context, key string, metadata interface{}) error {
+    for i := range lw.levels {
+        err := WithWriteContext(lw.levels[i]).DeleteContext(ctx, key, metadata)
+        if err != nil && !errors.Is(err, ErrDataNotFound) {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (lw *levelWriter) Put(key string, metadata interface{}, data io.Reader) (int64, error) {
+    return lw.PutContext(context.Background(), key, metadata, data)
+}
+
+// PutContext writes data to every level concurrently, each reading its own
+// section of one buffered copy. Data which is already an io.SectionReader,
+// such as a CacheFiller's spool, is not buffered again. It only fails if
+// every level failed.
+func (lw *levelWriter) PutContext(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error) {
+    source, ok := data.(*io.SectionReader)
+    if !ok {
+        spool := NewSpool(lw.spoolDir, lw.spoolThreshold)
+        defer spool.Close()
+
+        _, err := io.Copy(spool, &contextReader{ctx: ctx, source: data})
+        if err != nil {
+            return 0, err
+        }
+
+        source = io.NewSectionReader(spool, 0, spool.Size())
+    }
+
+    counts := make([]int64, len(lw.levels))
+    errs := make([]error, len(lw.levels))
+
+    var wg sync.WaitGroup
+    wg.Add(len(lw.levels))
+
+    for i := range lw.levels {
+        go func() {
+            defer crash.HandleAll()
+            defer wg.Done()
+
+            Log.Debug("TieredCache::Put %s, level %d", key, i)
+            counts[i], errs[i] = WithWriteContext(lw.levels[i]).PutContext(
+                ctx,
+                key,
+                metadata,
+                io.NewSectionReader(source, 0, source.Size()),
+            )
+            if errs[i] != nil {
+                Log.Debug("TieredCache PUT error: %v", errs[i])
+            }
+        }()
+    }
+
+    wg.Wait()
+
+    for i := range errs {
+        if errs[i] == nil {
+            return counts[i], nil
+        }
+    }
+
+    if len(errs) == 0 {
+        return source.Size(), nil
+    }
+
+    return 0, &ReplicationError{
+        Errs: errs,
+        Key:  key,
+        Op:   "Put",
+    }
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+    "container/list"
+)
+
+const (
+    tinyLFUWindow    = 0.01 // the share of capacity new records are admitted to
+    tinyLFUProtected = 0.8  // the share of the rest held by records read again
+)
+
+// TinyLFUEviction is a W-TinyLFU policy measured in bytes. New records enter
+// a small LRU window, and move on to the main cache as the window overflows.
+// The main cache is a segmented LRU, whose records read again are protected
+// from records read only once. To be kept, the newest record on probation
+// must have been read more often, by a frequency sketch, than the oldest one
+// it would displace. Recent bursts are absorbed by the window, and scans of
+// one time reads cannot displace the popular records.
+type TinyLFUEviction struct {
+    entries    map[*DataRecord]*list.Element
+    probation  *sizedList
+    protected  *sizedList
+    protectMax int64
+    sketch     *FrequencyAdmission
+    window     *sizedList
+    windowMax  int64
+}
+
+// NewTinyLFUEviction returns a W-TinyLFU policy with a frequency sketch
+// sized for about entries distinct keys. Its window and protected segment
+// are sized from the Scavenger's maxSize once set as its policy.
+func NewTinyLFUEviction(entries int) *TinyLFUEviction {
+    return &TinyLFUEviction{
+        entries:   make(map[*DataRecord]*list.Element),
+        probation: newSizedList(),
+        protected: newSizedList(),
+        sketch:    NewFrequencyAdmission(1, entries),
+        window:    newSizedList(),
+    }
+}
+
+func (tlfu *TinyLFUEviction) Add(val *DataRecord) {
+    e, ok := tlfu.entries[val]
+    if ok {
+        ee := e.Value.(*evictionEntry)
+        ee.list.resize(ee, val.Size)
+        tlfu.Access(val)
+        return
+    }
+
+    tlfu.sketch.Admit(val.Key, val.Size)
+    tlfu.entries[val] = tlfu.window.push(&evictionEntry{
+        size: val.Size,
+        val:  val,
+    })
+
+    for tlfu.window.size > tlfu.windowMax {
+        moved := tlfu.window.remove(tlfu.window.oldest())
+        tlfu.entries[moved.val] = tlfu.probation.push(moved)
+    }
+}
+
+func (tlfu *TinyLFUEviction) Access(val *DataRecord) {
+    e, ok := tlfu.entries[val]
+    if !ok {
+        return
+    }
+
+    tlfu.sketch.Admit(val.Key, val.Size)
+
+    ee := e.Value.(*evictionEntry)
+    if ee.list == tlfu.window {
+        tlfu.entries[val] = tlfu.window.push(tlfu.window.remove(e))
+        return
+    }
+
+    // records read again in the main cache are protected, demoting the
+    // oldest protected records back to probation to make room
+    ee.list.remove(e)
+    tlfu.entries[val] = tlfu.protected.push(ee)
+
+    for tlfu.protected.size > tlfu.protectMax && tlfu.protected.entries.Len() > 1 {
+        demoted := tlfu.protected.remove(tlfu.protected.oldest())
+        tlfu.entries[demoted.val] = tlfu.probation.push(demoted)
+    }
+}
+
+func (tlfu *TinyLFUEviction) Evict() *DataRecord {
+    e := tlfu.probation.oldest()
+
+    // the newest record on probation is kept only if it is read more often
+    // than the oldest
+    candidate := tlfu.probation.entries.Back()
+    if candidate != e {
+        cv := candidate.Value.(*evictionEntry).val
+        vv := e.Value.(*evictionEntry).val
+
+        if tlfu.sketch.Estimate(cv.Key) <= tlfu.sketch.Estimate(vv.Key) {
+            e = candidate
+        }
+    }
+
+    if e == nil {
+        e = tlfu.protected.oldest()
+    }
+    if e == nil {
+        e = tlfu.window.oldest()
+    }
+    if e == nil {
+        return nil
+    }
+
+    ee := e.Value.(*evictionEntry)
+    ee.list.remove(e)
+    delete(tlfu.entries, ee.val)
+
+    return ee.val
+}
+
+func (tlfu *TinyLFUEviction) Remove(val *DataRecord) {
+    e, ok := tlfu.entries[val]
+    if !ok {
+        return
+    }
+
+    ee := e.Value.(*evictionEntry)
+    ee.list.remove(e)
+    delete(tlfu.entries, val)
+}
+
+func (tlfu *TinyLFUEviction) setCapacity(capacity int64) {
+    tlfu.windowMax = int64(float64(capacity) * tinyLFUWindow)
+    tlfu.protectMax = int64(float64(capacity-tlfu.windowMax) * tinyLFUProtected)
+}
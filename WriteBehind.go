@@ -0,0 +1,262 @@
+package cache
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "time"
+
+    "github.com/xaevman/crash"
+)
+
+const (
+    WriteBehindBlock      WriteBehindPolicy = iota // Put waits for room in the queue
+    WriteBehindDropNewest                          // the new write is dropped
+    WriteBehindDropOldest                          // the oldest queued write is dropped to make room
+)
+
+// DefaultWriteBehindQueueSize is the queue size used when
+// WriteBehindConfig.QueueSize is below 1.
+const DefaultWriteBehindQueueSize = 64
+
+type WriteBehindPolicy int
+
+// WriteBehindConfig configures HierarchicalCache's write-behind mode, in
+// which Put and Delete return once the parent is written and queue the
+// children's writes. Each child has its own queue of QueueSize writes,
+// drained by Concurrency workers. QueueSize must be at least 1, so that the
+// drop policies have a queue to drop from; below that
+// DefaultWriteBehindQueueSize is used. A failed write is retried as Retry
+// allows; the response passed to it is always nil. Retries still waiting when
+// the child is removed or write-behind is reconfigured are abandoned. With
+// more than one worker, writes to the same key may reach a child out of
+// order.
+type WriteBehindConfig struct {
+    Concurrency int               // workers per child, at least 1
+    Policy      WriteBehindPolicy // what to do when a child's queue is full
+    QueueSize   int               // at least 1, see DefaultWriteBehindQueueSize
+    Retry       RetryPolicy       // nil for DefaultRetryPolicy
+}
+
+// writeQueue holds the pending writes to a single child.
+type writeQueue struct {
+    cancel  context.CancelFunc
+    ctx     context.Context // done once the queue is closed
+    idle    chan struct{}   // closed whenever nothing is pending
+    jobs    chan *writeJob
+    lock    sync.Mutex
+    pending int
+    policy  WriteBehindPolicy
+    retry   RetryPolicy
+    writer  WriteCache
+}
+
+// writeJob is a queued Put, or a Delete if spool is nil.
+type writeJob struct {
+    ctx      context.Context
+    key      string
+    metadata interface{}
+    spool    *sharedSpool
+}
+
+// sharedSpool closes its spool once every holder has released it.
+type sharedSpool struct {
+    lock  sync.Mutex
+    refs  int
+    spool *Spool
+}
+
+func newWriteQueue(writer WriteCache, config *WriteBehindConfig) *writeQueue {
+    idle := make(chan struct{})
+    close(idle)
+
+    size := config.QueueSize
+    if size < 1 {
+        size = DefaultWriteBehindQueueSize
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    q := &writeQueue{
+        cancel: cancel,
+        ctx:    ctx,
+        idle:   idle,
+        jobs:   make(chan *writeJob, size),
+        policy: config.Policy,
+        retry:  config.Retry,
+        writer: writer,
+    }
+
+    if q.retry == nil {
+        q.retry = DefaultRetryPolicy()
+    }
+
+    workers := config.Concurrency
+    if workers < 1 {
+        workers = 1
+    }
+
+    for i := 0; i < workers; i++ {
+        go q.run()
+    }
+
+    return q
+}
+
+// close stops the workers once the writes already queued are done. Writes
+// waiting to be retried give up.
+func (q *writeQueue) close() {
+    close(q.jobs)
+    q.cancel()
+}
+
+// enqueue queues job according to the queue's policy. Under
+// WriteBehindBlock it gives up when ctx is done.
+func (q *writeQueue) enqueue(ctx context.Context, job *writeJob) error {
+    q.begin()
+
+    switch q.policy {
+    case WriteBehindDropNewest:
+        select {
+        case q.jobs <- job:
+        default:
+            q.drop(job)
+        }
+    case WriteBehindDropOldest:
+        for {
+            select {
+            case q.jobs <- job:
+                return nil
+            default:
+            }
+
+            select {
+            case old := <-q.jobs:
+                q.drop(old)
+            default:
+            }
+        }
+    default:
+        select {
+        case q.jobs <- job:
+        case <-ctx.Done():
+            q.finish(job)
+            return ctx.Err()
+        }
+    }
+
+    return nil
+}
+
+// wait returns once nothing is pending, or ctx is done.
+func (q *writeQueue) wait(ctx context.Context) error {
+    q.lock.Lock()
+    idle := q.idle
+    q.lock.Unlock()
+
+    select {
+    case <-idle:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (q *writeQueue) begin() {
+    q.lock.Lock()
+    defer q.lock.Unlock()
+
+    if q.pending == 0 {
+        q.idle = make(chan struct{})
+    }
+    q.pending++
+}
+
+func (q *writeQueue) drop(job *writeJob) {
+    Log.Debug("Cache write-behind queue full, dropping write of %s", job.key)
+    q.finish(job)
+}
+
+func (q *writeQueue) finish(job *writeJob) {
+    if job.spool != nil {
+        job.spool.release()
+    }
+
+    q.lock.Lock()
+    defer q.lock.Unlock()
+
+    q.pending--
+    if q.pending == 0 {
+        close(q.idle)
+    }
+}
+
+func (q *writeQueue) run() {
+    for job := range q.jobs {
+        q.write(job)
+        q.finish(job)
+    }
+}
+
+func (q *writeQueue) write(job *writeJob) {
+    defer crash.HandleAll()
+
+    for attempt := 1; ; attempt++ {
+        var err error
+        if job.spool == nil {
+            Log.Debug("HierarchicalCache::Delete %s, write-behind attempt %d", job.key, attempt)
+            err = WithWriteContext(q.writer).DeleteContext(job.ctx, job.key, job.metadata)
+            if errors.Is(err, ErrDataNotFound) {
+                err = nil
+            }
+        } else {
+            Log.Debug("HierarchicalCache::Put %s, write-behind attempt %d", job.key, attempt)
+            _, err = WithWriteContext(q.writer).PutContext(job.ctx, job.key, job.metadata, job.spool.spool.NewReader())
+        }
+
+        if err == nil {
+            return
+        }
+
+        wait, ok := q.retry.Retry(attempt, nil, err)
+        if !ok {
+            Log.Debug("Cache write-behind error for %s: %v", job.key, err)
+            return
+        }
+
+        err = q.backoff(job, wait)
+        if err != nil {
+            Log.Debug("Cache write-behind for %s abandoned: %v", job.key, err)
+            return
+        }
+    }
+}
+
+// backoff waits before job is retried, giving up early if job's context is
+// done or the queue is closed.
+func (q *writeQueue) backoff(job *writeJob, wait time.Duration) error {
+    ctx, cancel := context.WithCancel(job.ctx)
+    defer cancel()
+
+    stop := context.AfterFunc(q.ctx, cancel)
+    defer stop()
+
+    return sleepContext(ctx, wait)
+}
+
+func (ss *sharedSpool) release() {
+    ss.lock.Lock()
+    defer ss.lock.Unlock()
+
+    ss.refs--
+    if ss.refs == 0 {
+        ss.spool.Close()
+    }
+}
+
+func (ss *sharedSpool) retain() {
+    ss.lock.Lock()
+    defer ss.lock.Unlock()
+
+    ss.refs++
+}
@@ -14,16 +14,27 @@ package cache
 
 import (
     "bytes"
+    "compress/zlib"
+    "context"
     "crypto/rand"
     "crypto/sha1"
+    "errors"
     "fmt"
     "io"
     "io/ioutil"
+    mathrand "math/rand"
     "net/http"
+    "net/http/httptest"
     "os"
     "path/filepath"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "testing"
+    "time"
+
+    "github.com/xaevman/log"
 )
 
 const (
@@ -43,6 +54,206 @@ var (
 
 type TestLogger struct{}
 
+// countingReadCache counts Gets against the wrapped cache, stalling each one
+// so that concurrent callers overlap.
+type countingReadCache struct {
+    cache ReadCache
+    count int32
+    delay time.Duration
+}
+
+func (crc *countingReadCache) Get(key string, metadata interface{}) (int64, io.Reader, error) {
+    atomic.AddInt32(&crc.count, 1)
+    <-time.After(crc.delay)
+    return crc.cache.Get(key, metadata)
+}
+
+// slowWriteCache stalls each write to the wrapped cache, and fails the first
+// fail of them.
+type slowWriteCache struct {
+    cache WriteCache
+    count int32
+    delay time.Duration
+    fail  int32
+}
+
+func (swc *slowWriteCache) Delete(key string, metadata interface{}) error {
+    atomic.AddInt32(&swc.count, 1)
+    <-time.After(swc.delay)
+    if atomic.AddInt32(&swc.fail, -1) >= 0 {
+        return ErrTransient
+    }
+
+    return swc.cache.Delete(key, metadata)
+}
+
+func (swc *slowWriteCache) Put(key string, metadata interface{}, data io.Reader) (int64, error) {
+    atomic.AddInt32(&swc.count, 1)
+    <-time.After(swc.delay)
+    if atomic.AddInt32(&swc.fail, -1) >= 0 {
+        return 0, ErrTransient
+    }
+
+    return swc.cache.Put(key, metadata, data)
+}
+
+// countingReadSeeker counts the Reads of a ReadSeeker.
+type countingReadSeeker struct {
+    io.ReadSeeker
+    reads int
+}
+
+func (crs *countingReadSeeker) Read(p []byte) (int, error) {
+    crs.reads++
+    return crs.ReadSeeker.Read(p)
+}
+
+// failingWriter fails every Write.
+type failingWriter struct{}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+    return 0, io.ErrShortWrite
+}
+
+// gatedReader holds each Read until release is closed, noting whether it
+// was closed while a Read was under way.
+type gatedReader struct {
+    closed      int32
+    closedEarly int32
+    reading     int32
+    release     chan struct{}
+    started     chan struct{}
+}
+
+func (gr *gatedReader) Read(p []byte) (int, error) {
+    if atomic.SwapInt32(&gr.reading, 1) == 0 {
+        close(gr.started)
+    }
+    <-gr.release
+    atomic.StoreInt32(&gr.reading, 2)
+
+    return len(p), nil
+}
+
+func (gr *gatedReader) Close() error {
+    if atomic.LoadInt32(&gr.reading) == 1 {
+        atomic.StoreInt32(&gr.closedEarly, 1)
+    }
+    atomic.StoreInt32(&gr.closed, 1)
+
+    return nil
+}
+
+// gatedDeleteCache holds every Delete until gate is closed, counting the
+// Deletes started.
+type gatedDeleteCache struct {
+    RWCache
+    deletes int32
+    gate    chan struct{}
+}
+
+func (gdc *gatedDeleteCache) Delete(key string, metadata interface{}) error {
+    atomic.AddInt32(&gdc.deletes, 1)
+    <-gdc.gate
+    return gdc.RWCache.Delete(key, metadata)
+}
+
+// statCountingCache counts the Stats of a MemoryCache.
+type statCountingCache struct {
+    *MemoryCache
+    stats int32
+}
+
+func (scc *statCountingCache) Stat(key string, metadata interface{}) (*CacheStat, error) {
+    return scc.StatContext(context.Background(), key, metadata)
+}
+
+func (scc *statCountingCache) StatContext(ctx context.Context, key string, metadata interface{}) (*CacheStat, error) {
+    atomic.AddInt32(&scc.stats, 1)
+    return scc.MemoryCache.StatContext(ctx, key, metadata)
+}
+
+// stallingReadCache answers every Get with its data after delay, noting
+// whether the request had been cancelled meanwhile and whether its readers
+// are closed. It keeps the context of the last request.
+type stallingReadCache struct {
+    cancelled int32
+    closed    int32
+    ctx       context.Context
+    data      string
+    delay     time.Duration
+    lock      sync.Mutex
+}
+
+type stallingReader struct {
+    io.Reader
+    cache *stallingReadCache
+}
+
+func (src *stallingReadCache) Get(key string, metadata interface{}) (int64, io.Reader, error) {
+    return src.GetContext(context.Background(), key, metadata)
+}
+
+func (src *stallingReadCache) GetContext(ctx context.Context, key string, metadata interface{}) (int64, io.Reader, error) {
+    src.lock.Lock()
+    src.ctx = ctx
+    src.lock.Unlock()
+
+    <-time.After(src.delay)
+    if ctx.Err() != nil {
+        atomic.AddInt32(&src.cancelled, 1)
+    }
+
+    return int64(len(src.data)), &stallingReader{Reader: strings.NewReader(src.data), cache: src}, nil
+}
+
+func (sr *stallingReader) Close() error {
+    atomic.AddInt32(&sr.cache.closed, 1)
+    return nil
+}
+
+// countingTransport counts requests made through it.
+type countingTransport struct {
+    count int32
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    atomic.AddInt32(&ct.count, 1)
+    return http.DefaultTransport.RoundTrip(req)
+}
+
+// discardCache stores nothing, so that benchmarks measure only the cache
+// wrapping it.
+type discardCache struct{}
+
+func (dc *discardCache) Delete(key string, metadata interface{}) error {
+    return nil
+}
+
+func (dc *discardCache) Get(key string, metadata interface{}) (int64, io.Reader, error) {
+    return 0, strings.NewReader(""), nil
+}
+
+func (dc *discardCache) Put(key string, metadata interface{}, data io.Reader) (int64, error) {
+    return io.Copy(ioutil.Discard, data)
+}
+
+// waitForFlights waits until no fetch is in flight in hc, so that the next
+// Get starts a fetch of its own.
+func waitForFlights(hc *HierarchicalCache) {
+    for {
+        hc.flightLock.Lock()
+        pending := len(hc.flights)
+        hc.flightLock.Unlock()
+
+        if pending == 0 {
+            return
+        }
+
+        <-time.After(time.Millisecond)
+    }
+}
+
 func (tl *TestLogger) Debug(format string, v ...interface{}) {
     fmt.Printf(fmt.Sprintf("%s\n", format), v...)
 }
@@ -58,260 +269,2778 @@ func TestMain(m *testing.M) {
         }
     }
 
-    err := makeTestFile()
-    if err != nil {
-        cleanup()
-        os.Exit(1)
+    err := makeTestFile()
+    if err != nil {
+        cleanup()
+        os.Exit(1)
+    }
+
+    err = bigFileSetup()
+    if err != nil {
+        cleanup()
+        os.Exit(1)
+    }
+
+    os.Exit(m.Run())
+}
+
+func TestFileRead(t *testing.T) {
+    f, err := os.Open(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    defer f.Close()
+
+    checkData(f, t)
+}
+
+func TestSafeReader(t *testing.T) {
+    f, err := os.Open(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        t.Fatalf("Error: %v", err)
+    }
+
+    reader := NewSafeReader(fi.Size(), f, nil)
+
+    checkData(reader, t)
+}
+
+func TestDiskCacheGetRoots(t *testing.T) {
+    err := clean(1)
+    if err != nil {
+        t.Fatalf("Error cleaning: %v", err)
+    }
+
+    root := "root1"
+    tmpRoot := "tmp1"
+
+    c := NewDiskCache(root, tmpRoot, false)
+    dc := c.GetParent().(*DiskCache)
+
+    if dc.GetRoot() != root {
+        t.Fatalf("Invalid cache root (%s != %s)", dc.GetRoot(), root)
+    }
+
+    if dc.GetTmpRoot() != tmpRoot {
+        t.Fatalf("Invalid cache root (%s != %s)", dc.GetTmpRoot(), tmpRoot)
+    }
+}
+
+func TestDiskCacheChildren(t *testing.T) {
+    dc1 := NewDiskCache("cache1", "tmp1", false)
+    dc2 := NewDiskCache("cache2", "tmp2", false)
+
+    err := dc1.AddChild(dc2)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    dc1.RemoveChild(dc2)
+    if len(dc1.readers) != 0 {
+        t.Fatal()
+    }
+    if len(dc1.writers) != 0 {
+        t.Fatal()
+    }
+}
+
+func TestDiskCachePut(t *testing.T) {
+    dc := NewDiskCache("cache1", "tmp1", false)
+
+    f, err := os.Open(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        t.Fatalf("Error: %v", err)
+    }
+
+    reader := NewSafeReader(fi.Size(), f, nil)
+
+    _, err = dc.Put(TestCachePath, nil, reader)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    fullPath := filepath.Join("cache1", TestCachePath)
+    f2, err := os.Open(fullPath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    fi, err = f2.Stat()
+    if err != nil {
+        f2.Close()
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(NewSafeReader(fi.Size(), f2, nil), t)
+
+    _, data, err := dc.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(data, t)
+}
+
+func TestDiskCacheGet(t *testing.T) {
+    dc := NewDiskCache("cache1", "tmp1", false)
+
+    _, reader, err := dc.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(reader, t)
+}
+
+func TestDiskCacheRetries(t *testing.T) {
+    dc := NewDiskCache("cache1", "tmp1", false)
+    tmp := dc.GetParent().(*DiskCache)
+
+    data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+    reader := bytes.NewReader(data)
+
+    // hold file lock
+    f, err := os.OpenFile(filepath.Join(tmp.GetRoot(), TestCachePath), os.O_RDWR, 0660)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    defer f.Close()
+
+    err = dc.Delete(TestCachePath, nil)
+    if err == nil {
+        t.Fatal("Deleting cache file wasn't supposed to succeed!")
+    }
+
+    _, err = dc.Put(TestCachePath, nil, reader)
+    if err == nil {
+        t.Fatalf("Error: %v", err)
+    }
+}
+
+func TestFsReadCache(t *testing.T) {
+    cache := &FsReadCache{}
+    path := filepath.Join("cache1", TestCachePath)
+    _, reader, err := cache.Get(path, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(reader, t)
+}
+
+func TestHttpReadCache(t *testing.T) {
+    go http.ListenAndServe(":8888", http.FileServer(http.Dir("./cache1")))
+
+    uri := fmt.Sprintf("http://localhost:8888/%s", TestCachePath)
+    uri = strings.Replace(uri, "\\", "/", -1)
+
+    cache := &HttpReadCache{}
+    _, reader, err := cache.Get(uri, http.Header{})
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(reader, t)
+
+    _, _, err = cache.Get(uri, nil)
+    if err == nil {
+        t.Fatalf("Error: should have thrown error on nil header")
+    }
+}
+
+func TestHttpReadCacheCancel(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer srv.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+
+    start := time.Now()
+
+    cache := &HttpReadCache{}
+    _, _, err := cache.GetContext(ctx, srv.URL, http.Header{})
+    if err == nil {
+        t.Fatal("Error: cancelled request should have failed")
+    }
+
+    if time.Since(start) > HttpRetryIntervalSec*time.Second {
+        t.Fatalf("Error: cancelled request took %v", time.Since(start))
+    }
+}
+
+func TestHttpRetryPolicy(t *testing.T) {
+    policy := NewBackoffRetryPolicy(4, 100*time.Millisecond, 250*time.Millisecond)
+
+    for attempt, max := range []time.Duration{100, 200, 250} {
+        wait, retry := policy.Retry(attempt+1, nil, io.ErrUnexpectedEOF)
+        if !retry {
+            t.Fatalf("Error: attempt %d should be retried", attempt+1)
+        }
+
+        if wait < 0 || wait > max*time.Millisecond {
+            t.Fatalf("Error: attempt %d waits %v, expected at most %v", attempt+1, wait, max*time.Millisecond)
+        }
+    }
+
+    _, retry := policy.Retry(4, nil, io.ErrUnexpectedEOF)
+    if retry {
+        t.Fatal("Error: retried beyond MaxAttempts")
+    }
+
+    // Retry-After is limited by Max
+    busy := &http.Response{
+        Header:     http.Header{"Retry-After": []string{"86400"}},
+        StatusCode: http.StatusServiceUnavailable,
+    }
+
+    wait, retry := NewBackoffRetryPolicy(3, time.Millisecond, time.Second).Retry(1, busy, nil)
+    if !retry || wait != time.Second {
+        t.Fatalf("Error: expected a wait of 1s, got %v (%v)", wait, retry)
+    }
+
+    // and by MaxRetryAfter without a Max, however large
+    for _, value := range []string{"86400", "99999999999999999", time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat)} {
+        busy.Header.Set("Retry-After", value)
+
+        wait, retry = DefaultRetryPolicy().Retry(1, busy, nil)
+        if !retry || wait != MaxRetryAfter {
+            t.Fatalf("Error: Retry-After %s, expected a wait of %v, got %v (%v)", value, MaxRetryAfter, wait, retry)
+        }
+    }
+
+    var lock sync.Mutex
+    attempts := 0
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        lock.Lock()
+        attempts++
+        attempt := attempts
+        lock.Unlock()
+
+        switch attempt {
+        case 1:
+            w.Header().Set("Retry-After", "1")
+            w.WriteHeader(http.StatusServiceUnavailable)
+        case 2:
+            w.Header().Set("Retry-After", "0")
+            w.WriteHeader(http.StatusTooManyRequests)
+        default:
+            io.WriteString(w, "retried data")
+        }
+    }))
+    defer srv.Close()
+
+    var transport countingTransport
+    client := &http.Client{Transport: &transport}
+
+    cache := NewHttpReadCache(client)
+    cache.SetRetryPolicy(NewBackoffRetryPolicy(3, time.Millisecond, 2*time.Second))
+
+    start := time.Now()
+
+    _, reader, err := cache.Get(srv.URL, http.Header{})
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    data, err := ioutil.ReadAll(reader)
+    if err != nil || string(data) != "retried data" {
+        t.Fatalf("Error: unexpected result %q (%v)", data, err)
+    }
+
+    if time.Since(start) < time.Second {
+        t.Fatalf("Error: Retry-After not honored, took %v", time.Since(start))
+    }
+
+    if atomic.LoadInt32(&transport.count) != 3 {
+        t.Fatalf("Error: expected 3 requests through the client, got %d", transport.count)
+    }
+
+    // out of attempts, the last response stands
+    lock.Lock()
+    attempts = 0
+    lock.Unlock()
+
+    cache.SetRetryPolicy(NewBackoffRetryPolicy(2, time.Millisecond, time.Millisecond))
+    _, _, err = cache.Get(srv.URL, http.Header{})
+    if err == nil {
+        t.Fatal("Error: expected failure after exhausting retries")
+    }
+}
+
+func TestHttpResume(t *testing.T) {
+    content := bytes.Repeat([]byte("0123456789"), 10000)
+    modTime := time.Now().Add(-time.Hour)
+
+    var lock sync.Mutex
+    requests := 0
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        lock.Lock()
+        requests++
+        request := requests
+        lock.Unlock()
+
+        if request > 1 {
+            http.ServeContent(w, r, "resume.data", modTime, bytes.NewReader(content))
+            return
+        }
+
+        // send half the body, then drop the connection
+        w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+        w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+        w.WriteHeader(http.StatusOK)
+        w.Write(content[:len(content)/2])
+        w.(http.Flusher).Flush()
+
+        conn, _, err := w.(http.Hijacker).Hijack()
+        if err == nil {
+            conn.Close()
+        }
+    }))
+    defer srv.Close()
+
+    cache := NewHttpReadCache(nil)
+    cache.SetRetryPolicy(NewBackoffRetryPolicy(3, time.Millisecond, time.Millisecond))
+
+    _, reader, err := cache.Get(srv.URL, http.Header{})
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    data, err := ioutil.ReadAll(reader)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    if !bytes.Equal(data, content) {
+        t.Fatalf("Error: resumed data mismatch (%d bytes)", len(data))
+    }
+
+    if requests != 2 {
+        t.Fatalf("Error: expected 2 requests, got %d", requests)
+    }
+}
+
+func TestErrorKinds(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/forbidden":
+            w.WriteHeader(http.StatusForbidden)
+        case "/gateway-timeout":
+            w.WriteHeader(http.StatusGatewayTimeout)
+        case "/unavailable":
+            w.WriteHeader(http.StatusServiceUnavailable)
+        default:
+            w.WriteHeader(http.StatusNotFound)
+        }
+    }))
+    defer srv.Close()
+
+    hrc := NewHttpReadCache(nil)
+    hrc.SetRetryPolicy(NewBackoffRetryPolicy(1, 0, 0))
+
+    ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+    defer cancel()
+
+    _, _, fsMissing := (&FsReadCache{}).Get("notreal.file", nil)
+    _, _, fsTimeout := (&FsReadCache{}).GetContext(ctx, TestFilePath, nil)
+    _, _, httpMissing := hrc.Get(srv.URL+"/missing", http.Header{})
+    _, _, httpForbidden := hrc.Get(srv.URL+"/forbidden", http.Header{})
+    _, _, httpTimeout := hrc.Get(srv.URL+"/gateway-timeout", http.Header{})
+    _, _, httpUnavailable := hrc.Get(srv.URL+"/unavailable", http.Header{})
+    _, sizeMismatch := ioutil.ReadAll(NewSafeReader(10, strings.NewReader("short"), nil))
+
+    // a damaged compressed file, and one the cache may not read
+    root := filepath.Join(t.TempDir(), "cache")
+    err := os.MkdirAll(root, 0770)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    for name, mode := range map[string]os.FileMode{"damaged": 0660, "unreadable": 0} {
+        err = ioutil.WriteFile(filepath.Join(root, name), []byte("not compressed data"), mode)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    dc := NewDiskCache(root, filepath.Join(filepath.Dir(root), "tmp"), true).GetParent()
+    _, _, diskCorrupt := dc.Get("damaged", nil)
+    _, _, diskUnreadable := dc.Get("unreadable", nil)
+
+    kinds := []struct {
+        err   error
+        kind  error
+        cause error
+    }{
+        {fsMissing, ErrDataNotFound, os.ErrNotExist},
+        {fsTimeout, ErrTimeout, context.DeadlineExceeded},
+        {httpMissing, ErrDataNotFound, http.ErrMissingFile},
+        {httpForbidden, ErrPermission, http.ErrMissingFile},
+        {httpTimeout, ErrTimeout, http.ErrMissingFile},
+        {httpUnavailable, ErrTransient, http.ErrMissingFile},
+        {sizeMismatch, ErrCorrupt, ErrReadSizeMismatch},
+        {diskCorrupt, ErrCorrupt, zlib.ErrHeader},
+        {diskUnreadable, ErrPermission, os.ErrPermission},
+    }
+
+    // permissions do not stop root
+    if os.Getuid() == 0 {
+        kinds = kinds[:len(kinds)-1]
+    }
+
+    for i := range kinds {
+        if !errors.Is(kinds[i].err, kinds[i].kind) {
+            t.Fatalf("Error: case %d: %v does not match %v", i, kinds[i].err, kinds[i].kind)
+        }
+
+        if !errors.Is(kinds[i].err, kinds[i].cause) {
+            t.Fatalf("Error: case %d: %v does not wrap %v", i, kinds[i].err, kinds[i].cause)
+        }
+
+        var ce *CacheError
+        if !errors.As(kinds[i].err, &ce) {
+            t.Fatalf("Error: case %d: %v is not a CacheError", i, kinds[i].err)
+        }
+    }
+
+    hc := NewMemoryCache()
+    hc.AddChild(hrc)
+
+    // a miss on every tier is a miss
+    _, _, err = hc.Get(srv.URL+"/missing", http.Header{})
+    if !errors.Is(err, ErrDataNotFound) {
+        t.Fatalf("Error: expected a miss, got %v", err)
+    }
+
+    // a failing tier is not
+    _, _, err = hc.Get(srv.URL+"/unavailable", http.Header{})
+    if errors.Is(err, ErrDataNotFound) || !errors.Is(err, ErrTransient) {
+        t.Fatalf("Error: expected a transient failure, got %v", err)
+    }
+
+    var te *TierError
+    if !errors.As(err, &te) || len(te.Errs) != 2 {
+        t.Fatalf("Error: expected errors from 2 tiers, got %v", err)
+    }
+
+    if te.Errs[0] != ErrDataNotFound || !errors.Is(te.Errs[1], ErrTransient) {
+        t.Fatalf("Error: unexpected tier errors %v", te.Errs)
+    }
+}
+
+func TestContextAdapter(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    // embedding hides FsReadCache.GetContext, forcing the adapter
+    cache := WithReadContext(struct{ ReadCache }{&FsReadCache{}})
+    _, _, err := cache.GetContext(ctx, TestFilePath, nil)
+    if err != context.Canceled {
+        t.Fatalf("Error: expected context.Canceled, got %v", err)
+    }
+
+    _, reader, err := cache.GetContext(context.Background(), TestFilePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(reader, t)
+}
+
+func TestChildFill(t *testing.T) {
+    dc1 := NewDiskCache("cache1", "tmp1", false)
+    dc3 := NewDiskCache("cache3", "tmp3", false)
+
+    dc3.AddChild(dc1)
+
+    // previous tests should have populated the dc1 cache
+    // this call should fall through to r1 and return both
+    // valid data and populate the dc3 cache
+    _, d1, err := dc3.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    // check the returned data
+    checkData(d1, t)
+
+    WaitForCacheFill(d1)
+
+    dc3.RemoveChild(dc1)
+    _, d2, err := dc3.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    // check the data that was populated into dc3 cache
+    checkData(d2, t)
+}
+
+func TestCoalescedChildFill(t *testing.T) {
+    child := &countingReadCache{
+        cache: NewDiskCache("cache1", "tmp1", false),
+        delay: 200 * time.Millisecond,
+    }
+
+    mc := NewMemoryCache()
+    mc.AddChild(child)
+
+    var wg sync.WaitGroup
+    readers := make([]io.Reader, 10)
+    errs := make([]error, 10)
+
+    for i := range readers {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            _, readers[i], errs[i] = mc.Get(TestCachePath, nil)
+        }(i)
+    }
+
+    wg.Wait()
+
+    for i := range readers {
+        if errs[i] != nil {
+            t.Fatalf("Error: %v", errs[i])
+        }
+
+        checkData(readers[i], t)
+    }
+
+    if WaitForCacheFill(readers[0]) != TestFileSize {
+        t.Fatal("Error: coalesced fill failed")
+    }
+
+    if atomic.LoadInt32(&child.count) != 1 {
+        t.Fatalf("Error: expected 1 child fetch, got %d", child.count)
+    }
+
+    mc.RemoveChild(child)
+    _, data, err := mc.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(data, t)
+}
+
+func TestCoalescedDiscardOnClose(t *testing.T) {
+    child := &countingReadCache{
+        cache: NewDiskCache("cache1", "tmp1", false),
+        delay: 200 * time.Millisecond,
+    }
+
+    mc := NewMemoryCache()
+    mc.AddChild(child)
+    mc.SetFillClosePolicy(DiscardOnClose)
+
+    var wg sync.WaitGroup
+    readers := make([]io.Reader, 5)
+    errs := make([]error, 5)
+
+    for i := range readers {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            _, readers[i], errs[i] = mc.Get(TestCachePath, nil)
+
+            // the first caller gives up at once, which must not abort the
+            // fetch the others share
+            if i == 0 && errs[i] == nil {
+                AsReadCloser(readers[i]).Close()
+            }
+        }(i)
+    }
+
+    wg.Wait()
+
+    for i := range readers {
+        if errs[i] != nil {
+            t.Fatalf("Error: %v", errs[i])
+        }
+    }
+
+    if atomic.LoadInt32(&child.count) != 1 {
+        t.Fatalf("Error: expected 1 child fetch, got %d", child.count)
+    }
+
+    for i := 1; i < len(readers); i++ {
+        checkData(readers[i], t)
+    }
+
+    if WaitForCacheFill(readers[1]) != TestFileSize {
+        t.Fatal("Error: coalesced fill aborted")
+    }
+}
+
+func TestStreamingPut(t *testing.T) {
+    for i := 1; i < 3; i++ {
+        err := clean(i)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    dc1 := NewDiskCache("cache1", "tmp1", false)
+    dc2 := NewDiskCache("cache2", "tmp2", true)
+
+    dc1.AddChild(dc2)
+
+    fd, err := ioutil.ReadFile(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    // force the spool out to disk
+    dc1.SetSpool("tmp1", 1024)
+
+    for _, mode := range []PutMode{PutSpool, PutTee} {
+        dc1.SetPutMode(mode)
+        cachePath := fmt.Sprintf("%s%d", TestCachePath, mode)
+
+        c, err := dc1.Put(cachePath, nil, bytes.NewReader(fd))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        if c != TestFileSize {
+            t.Fatalf("Error: Put size mismatch (%d != %d)", c, TestFileSize)
+        }
+
+        for _, dc := range []*HierarchicalCache{dc1, dc2} {
+            _, data, err := dc.Get(cachePath, nil)
+            if err != nil {
+                t.Fatalf("Error: %v", err)
+            }
+            checkData(data, t)
+        }
+    }
+
+    leftovers, err := filepath.Glob(filepath.Join("tmp1", "spool*"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    if len(leftovers) != 0 {
+        t.Fatalf("Error: spool files left behind: %v", leftovers)
+    }
+}
+
+func TestSpooledCacheFiller(t *testing.T) {
+    err := clean(1)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    f, err := os.Open(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        t.Fatalf("Error: %v", err)
+    }
+
+    mc := NewMemoryCache()
+
+    filler := NewCacheFiller(TestCachePath, nil, mc, NewSafeReader(fi.Size(), f, nil))
+    filler.SetSpool("tmp1", 1024)
+    shared := filler.NewReader()
+
+    // read past the threshold so the spool moves to disk
+    buffer := make([]byte, 4096)
+    _, err = io.ReadFull(filler, buffer)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    spools, err := filepath.Glob(filepath.Join("tmp1", "spool*"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    if len(spools) != 1 {
+        t.Fatalf("Error: expected 1 spool file, found %v", spools)
+    }
+
+    checkData(io.MultiReader(bytes.NewReader(buffer), filler), t)
+    checkData(shared, t)
+
+    c := WaitForCacheFill(filler)
+    if c != TestFileSize {
+        t.Fatalf("Error: Invalid fill size (%d != %d)", c, TestFileSize)
+    }
+
+    spools, err = filepath.Glob(filepath.Join("tmp1", "spool*"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    if len(spools) != 0 {
+        t.Fatalf("Error: spool files left behind: %v", spools)
+    }
+
+    _, data, err := mc.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(data, t)
+}
+
+func TestCacheFillVerification(t *testing.T) {
+    fd, err := ioutil.ReadFile(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    sum := sha1.Sum(fd)
+    badSum := sha1.Sum(nil)
+
+    tests := []struct {
+        reader   io.Reader
+        expected int64
+        fill     int64
+    }{
+        {NewSafeReader(TestFileSize+1, bytes.NewReader(fd), nil), GetLengthUnknown, CacheFillIncomplete},
+        {bytes.NewReader(fd), TestFileSize + 1, CacheFillIncomplete},
+        {NewSafeReaderChecksum(TestFileSize, bytes.NewReader(fd), nil, sha1.New(), badSum[:]), TestFileSize, CacheFillCorrupt},
+        {NewSafeReaderChecksum(TestFileSize, bytes.NewReader(fd), nil, sha1.New(), sum[:]), TestFileSize, TestFileSize},
+    }
+
+    for i := range tests {
+        mc := NewMemoryCache()
+
+        filler := NewCacheFiller(TestCachePath, nil, mc, tests[i].reader)
+        filler.SetExpectedSize(tests[i].expected)
+
+        _, err := io.Copy(ioutil.Discard, filler)
+        if (err == nil) != (tests[i].fill > 0) {
+            t.Fatalf("Error: test %d unexpected read result: %v", i, err)
+        }
+
+        c := WaitForCacheFill(filler)
+        if c != tests[i].fill {
+            t.Fatalf("Error: test %d fill result mismatch (%d != %d)", i, c, tests[i].fill)
+        }
+
+        _, _, err = mc.Get(TestCachePath, nil)
+        if (err == nil) != (tests[i].fill > 0) {
+            t.Fatalf("Error: test %d unexpected cache state: %v", i, err)
+        }
+    }
+}
+
+func TestCacheFillerClose(t *testing.T) {
+    fd, err := ioutil.ReadFile(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    policies := []FillClosePolicy{FillOnClose, DiscardOnClose}
+    fills := []int64{TestFileSize, CacheFillAborted}
+
+    for i := range policies {
+        mc := NewMemoryCache()
+
+        filler := NewCacheFiller(TestCachePath, nil, mc, bytes.NewReader(fd))
+        filler.SetClosePolicy(policies[i])
+
+        _, err := io.ReadFull(filler, make([]byte, 1024))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        err = filler.Close()
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        c := WaitForCacheFill(filler)
+        if c != fills[i] {
+            t.Fatalf("Error: policy %d fill result mismatch (%d != %d)", policies[i], c, fills[i])
+        }
+    }
+}
+
+func TestCacheFillerAbortDuringRead(t *testing.T) {
+    child := &gatedReader{
+        release: make(chan struct{}),
+        started: make(chan struct{}),
+    }
+
+    filler := NewCacheFiller(TestCachePath, nil, NewMemoryCache(), child)
+    filler.SetClosePolicy(DiscardOnClose)
+    reader := filler.NewReader()
+
+    copied := make(chan struct{})
+    go func() {
+        io.Copy(ioutil.Discard, filler)
+        close(copied)
+    }()
+
+    // the child is closed by the Read under way, not by the abort
+    <-child.started
+    reader.Close()
+
+    if atomic.LoadInt32(&child.closed) != 0 {
+        t.Fatal("Error: child closed during a Read")
+    }
+
+    close(child.release)
+    <-copied
+
+    if atomic.LoadInt32(&child.closed) != 1 || atomic.LoadInt32(&child.closedEarly) != 0 {
+        t.Fatal("Error: child not closed after its Read")
+    }
+
+    if WaitForCacheFill(filler) != CacheFillAborted {
+        t.Fatal("Error: fill not aborted")
+    }
+
+    // a coalesced fetch aborted part way, as run under -race
+    data := make([]byte, TestFileSize)
+    rand.Read(data)
+
+    origin := NewMemoryCache()
+    origin.Put(TestCachePath, nil, bytes.NewReader(data))
+
+    mc := NewMemoryCache()
+    mc.AddChild(origin)
+    mc.SetFillClosePolicy(DiscardOnClose)
+
+    _, r, err := mc.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    _, err = io.ReadFull(r, make([]byte, 10))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    // the fetch may already have finished, so either result will do
+    AsReadCloser(r).Close()
+    WaitForCacheFill(r)
+}
+
+func TestSafeReaderClose(t *testing.T) {
+    _, reader, err := GetReadCloser(context.Background(), &FsReadCache{}, TestFilePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    err = reader.Close()
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    _, err = reader.Read(make([]byte, 1))
+    if err == nil {
+        t.Fatal("Error: read after Close should fail")
+    }
+
+    // closing twice is harmless
+    err = reader.Close()
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+}
+
+func TestGetRange(t *testing.T) {
+    for i := 1; i < 3; i++ {
+        err := clean(i)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    // spans several compressed chunks
+    fd := make([]byte, 3*chunkedChunkSize+123)
+    _, err := rand.Read(fd)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    key := "range.data"
+    size := int64(len(fd))
+
+    dc := NewDiskCache("cache1", "tmp1", false)
+    cdc := NewDiskCache("cache2", "tmp2", true)
+    mc := NewMemoryCache()
+
+    for _, c := range []*HierarchicalCache{dc, cdc, mc} {
+        _, err = c.Put(key, nil, bytes.NewReader(fd))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    // ranges must be routed to the child
+    hc := NewMemoryCache()
+    hc.AddChild(cdc)
+
+    srv := httptest.NewServer(http.FileServer(http.Dir("cache1")))
+    defer srv.Close()
+
+    caches := []struct {
+        cache    ReadCache
+        key      string
+        metadata interface{}
+    }{
+        {dc, key, nil},
+        {cdc, key, nil},
+        {mc, key, nil},
+        {hc, key, nil},
+        {&FsReadCache{}, filepath.Join("cache1", key), nil},
+        {&HttpReadCache{}, fmt.Sprintf("%s/%s", srv.URL, key), http.Header{}},
+    }
+
+    ranges := []struct {
+        offset int64
+        length int64
+    }{
+        {0, -1},
+        {5, 100},
+        {chunkedChunkSize - 10, 20},
+        {2*chunkedChunkSize + 7, chunkedChunkSize},
+        {size - 5, -1},
+        {size - 5, 100},
+    }
+
+    for i := range caches {
+        for _, r := range ranges {
+            c, data, err := GetRangeContext(
+                context.Background(),
+                caches[i].cache,
+                caches[i].key,
+                caches[i].metadata,
+                r.offset,
+                r.length,
+            )
+            if err != nil {
+                t.Fatalf("Error: cache %d range %v: %v", i, r, err)
+            }
+
+            end := size
+            if r.length > -1 && r.offset+r.length < size {
+                end = r.offset + r.length
+            }
+
+            if c != end-r.offset {
+                t.Fatalf("Error: cache %d range %v count mismatch (%d != %d)", i, r, c, end-r.offset)
+            }
+
+            got, err := ioutil.ReadAll(data)
+            if err != nil {
+                t.Fatalf("Error: cache %d range %v: %v", i, r, err)
+            }
+
+            if !bytes.Equal(got, fd[r.offset:end]) {
+                t.Fatalf("Error: cache %d range %v data mismatch", i, r)
+            }
+        }
+
+        _, _, err := GetRangeContext(
+            context.Background(),
+            caches[i].cache,
+            caches[i].key,
+            caches[i].metadata,
+            size+1,
+            -1,
+        )
+        if err != ErrInvalidRange {
+            t.Fatalf("Error: cache %d expected ErrInvalidRange, got %v", i, err)
+        }
+    }
+}
+
+func TestStat(t *testing.T) {
+    for i := 1; i < 3; i++ {
+        err := clean(i)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    fd, err := ioutil.ReadFile(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    dc := NewDiskCache("cache1", "tmp1", false)
+    cdc := NewDiskCache("cache2", "tmp2", true)
+    mc := NewMemoryCache()
+
+    for _, c := range []*HierarchicalCache{dc, cdc, mc} {
+        _, err = c.Put(TestCachePath, nil, bytes.NewReader(fd))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    hc := NewMemoryCache()
+    hc.AddChild(dc)
+
+    srv := httptest.NewServer(http.FileServer(http.Dir("cache1")))
+    defer srv.Close()
+
+    uri := fmt.Sprintf("%s/%s", srv.URL, TestCachePath)
+    uri = strings.Replace(uri, "\\", "/", -1)
+
+    caches := []struct {
+        cache    ReadCache
+        key      string
+        metadata interface{}
+        level    int
+    }{
+        {dc, TestCachePath, nil, 0},
+        {cdc, TestCachePath, nil, 0},
+        {mc, TestCachePath, nil, 0},
+        {hc, TestCachePath, nil, 1},
+        {&FsReadCache{}, filepath.Join("cache1", TestCachePath), nil, 0},
+        {&HttpReadCache{}, uri, http.Header{}, 0},
+    }
+
+    for i := range caches {
+        st, err := StatContext(context.Background(), caches[i].cache, caches[i].key, caches[i].metadata)
+        if err != nil {
+            t.Fatalf("Error: cache %d: %v", i, err)
+        }
+
+        if st.Size != TestFileSize {
+            t.Fatalf("Error: cache %d size mismatch (%d != %d)", i, st.Size, TestFileSize)
+        }
+
+        if st.Level != caches[i].level {
+            t.Fatalf("Error: cache %d level mismatch (%d != %d)", i, st.Level, caches[i].level)
+        }
+
+        if st.ModTime.IsZero() {
+            t.Fatalf("Error: cache %d missing modification time", i)
+        }
+    }
+
+    _, err = hc.Stat("notreal.file", nil)
+    if err != ErrDataNotFound {
+        t.Fatalf("Error: expected ErrDataNotFound, got %v", err)
+    }
+}
+
+func TestExpiry(t *testing.T) {
+    for i := 1; i < 3; i++ {
+        err := clean(i)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    data := []byte("expiring data")
+    ttl := 200 * time.Millisecond
+
+    dc := NewDiskCache("cache1", "tmp1", false)
+    mc := NewMemoryCache()
+    sc := NewScavenger(NewDiskCache("cache2", "tmp2", false), 1024*1024)
+
+    caches := []RWCache{dc, mc, sc}
+
+    for i := range caches {
+        _, err := caches[i].Put(TestCachePath, WithTTL(nil, ttl), bytes.NewReader(data))
+        if err != nil {
+            t.Fatalf("Error: cache %d: %v", i, err)
+        }
+
+        _, _, err = caches[i].Get(TestCachePath, nil)
+        if err != nil {
+            t.Fatalf("Error: cache %d: %v", i, err)
+        }
+
+        st, err := StatContext(context.Background(), caches[i], TestCachePath, nil)
+        if err != nil {
+            t.Fatalf("Error: cache %d: %v", i, err)
+        }
+
+        if st.Expires.IsZero() {
+            t.Fatalf("Error: cache %d missing expiry", i)
+        }
+    }
+
+    <-time.After(ttl)
+
+    for i := range caches {
+        _, _, err := caches[i].Get(TestCachePath, nil)
+        if err != ErrDataNotFound {
+            t.Fatalf("Error: cache %d: expected ErrDataNotFound, got %v", i, err)
+        }
+    }
+
+    if sc.Size() != 0 {
+        t.Fatalf("Error: scavenger size %d after expiry", sc.Size())
+    }
+
+    _, err := os.Stat(filepath.Join("cache1", TestCachePath))
+    if !os.IsNotExist(err) {
+        t.Fatalf("Error: expired data not removed: %v", err)
+    }
+
+    // an expired parent entry is refetched from the child
+    _, err = dc.Put(TestCachePath, nil, bytes.NewReader(data))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    child := &countingReadCache{
+        cache: dc,
+    }
+
+    hc := NewMemoryCache()
+    hc.AddChild(child)
+
+    for i := 0; i < 2; i++ {
+        _, reader, err := hc.Get(TestCachePath, WithTTL(nil, ttl))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        ioutil.ReadAll(reader)
+        WaitForCacheFill(reader)
+
+        _, _, err = hc.Get(TestCachePath, nil)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        <-time.After(ttl)
+    }
+
+    count := atomic.LoadInt32(&child.count)
+    if count != 2 {
+        t.Fatalf("Error: expected 2 child reads, got %d", count)
+    }
+}
+
+func TestRevalidation(t *testing.T) {
+    err := clean(1)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    var lock sync.Mutex
+    body := "first version"
+    etag := `"v1"`
+    full := 0
+    notModified := 0
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        lock.Lock()
+        defer lock.Unlock()
+
+        w.Header().Set("ETag", etag)
+        if r.Header.Get("If-None-Match") == etag {
+            notModified++
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+
+        full++
+        io.WriteString(w, body)
+    }))
+    defer srv.Close()
+
+    uri := srv.URL + "/revalidate.data"
+    ttl := 200 * time.Millisecond
+
+    hc := NewDiskCache("cache1", "tmp1", false)
+    hc.AddChild(&HttpReadCache{})
+
+    get := func(expected string) {
+        _, reader, err := hc.Get(uri, WithTTL(http.Header{}, ttl))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        data, err := ioutil.ReadAll(reader)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+        WaitForCacheFill(reader)
+
+        if string(data) != expected {
+            t.Fatalf("Error: expected %q, got %q", expected, data)
+        }
+
+        // let the fetch finish so that the next Get cannot join it
+        waitForFlights(hc)
+    }
+
+    counts := func(expectedFull, expectedNotModified int) {
+        lock.Lock()
+        defer lock.Unlock()
+
+        if full != expectedFull || notModified != expectedNotModified {
+            t.Fatalf(
+                "Error: expected %d full and %d conditional responses, got %d and %d",
+                expectedFull,
+                expectedNotModified,
+                full,
+                notModified,
+            )
+        }
+    }
+
+    get("first version")
+    counts(1, 0)
+
+    st, err := hc.GetParent().(StatCache).Stat(uri, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    em, ok := st.Metadata.(*EntryMetadata)
+    if !ok || em.ETag != `"v1"` {
+        t.Fatalf("Error: validators not stored: %#v", st.Metadata)
+    }
+
+    // fresh copies are served without contacting the origin
+    get("first version")
+    counts(1, 0)
+
+    // expired copies are revalidated rather than downloaded again
+    <-time.After(ttl)
+    get("first version")
+    counts(1, 1)
+
+    hc.SetRevalidate(true)
+    get("first version")
+    counts(1, 2)
+
+    lock.Lock()
+    body = "second version"
+    etag = `"v2"`
+    lock.Unlock()
+
+    get("second version")
+    counts(2, 2)
+
+    get("second version")
+    counts(2, 3)
+
+    // checking for a stale copy reads only its stored metadata
+    parent := &statCountingCache{
+        MemoryCache: NewMemoryCache().GetParent().(*MemoryCache),
+    }
+
+    mhc := NewHierarchicalCache(parent)
+    mhc.AddChild(&HttpReadCache{})
+
+    _, err = parent.Put("fresh", nil, strings.NewReader("data"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    _, _, err = mhc.Get("fresh", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    if atomic.LoadInt32(&parent.stats) != 0 {
+        t.Fatal("Error: Get stat the parent")
+    }
+}
+
+func TestCacheControl(t *testing.T) {
+    err := clean(1)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    var lock sync.Mutex
+    requests := make(map[string]int)
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        lock.Lock()
+        requests[r.URL.Path]++
+        lock.Unlock()
+
+        switch r.URL.Path {
+        case "/no-store":
+            w.Header().Set("Cache-Control", "no-store")
+        case "/private":
+            w.Header().Set("Cache-Control", "private, max-age=60")
+        case "/max-age":
+            w.Header().Set("Cache-Control", "public, max-age=60")
+        case "/s-maxage":
+            w.Header().Set("Cache-Control", "max-age=60, s-maxage=120")
+        case "/expires":
+            now := time.Now()
+            w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+            w.Header().Set("Expires", now.Add(30*time.Second).UTC().Format(http.TimeFormat))
+        case "/age":
+            w.Header().Set("Age", "50")
+            w.Header().Set("Cache-Control", "max-age=60")
+        case "/revalidate":
+            w.Header().Set("ETag", `"v1"`)
+            if r.Header.Get("If-None-Match") == `"v1"` {
+                w.Header().Set("Cache-Control", "max-age=60")
+                w.WriteHeader(http.StatusNotModified)
+                return
+            }
+            w.Header().Set("Cache-Control", "no-cache")
+        }
+
+        io.WriteString(w, "cache control data")
+    }))
+    defer srv.Close()
+
+    hc := NewDiskCache("cache1", "tmp1", false)
+    hc.AddChild(&HttpReadCache{})
+
+    get := func(path string) int64 {
+        _, reader, err := hc.Get(srv.URL+path, http.Header{})
+        if err != nil {
+            t.Fatalf("Error: %s: %v", path, err)
+        }
+
+        ioutil.ReadAll(reader)
+        fill := WaitForCacheFill(reader)
+        waitForFlights(hc)
+
+        return fill
+    }
+
+    expires := func(path string) time.Duration {
+        st, err := hc.GetParent().(StatCache).Stat(srv.URL+path, nil)
+        if err != nil {
+            t.Fatalf("Error: %s: %v", path, err)
+        }
+
+        return time.Until(st.Expires)
+    }
+
+    for _, path := range []string{"/no-store", "/private"} {
+        fill := get(path)
+        if fill != CacheFillSkipped {
+            t.Fatalf("Error: %s: expected skipped fill, got %d", path, fill)
+        }
+
+        _, err := hc.GetParent().(StatCache).Stat(srv.URL+path, nil)
+        if err != ErrDataNotFound {
+            t.Fatalf("Error: %s: expected ErrDataNotFound, got %v", path, err)
+        }
+    }
+
+    lifetimes := []struct {
+        path     string
+        lifetime time.Duration
+    }{
+        {"/max-age", 60 * time.Second},
+        {"/s-maxage", 120 * time.Second},
+        {"/expires", 30 * time.Second},
+        {"/age", 10 * time.Second},
+    }
+
+    for _, l := range lifetimes {
+        fill := get(l.path)
+        if fill < 0 {
+            t.Fatalf("Error: %s: fill failed (%d)", l.path, fill)
+        }
+
+        remaining := expires(l.path)
+        if remaining > l.lifetime || remaining < l.lifetime-5*time.Second {
+            t.Fatalf("Error: %s: expected lifetime %v, got %v", l.path, l.lifetime, remaining)
+        }
+    }
+
+    // no-cache entries are stored already stale, and the 304 sets a lifetime
+    get("/revalidate")
+    if expires("/revalidate") > 0 {
+        t.Fatal("Error: no-cache entry should be stale")
+    }
+
+    _, reader, err := hc.Get(srv.URL+"/revalidate", http.Header{})
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    ioutil.ReadAll(reader)
+
+    remaining := expires("/revalidate")
+    if remaining > 60*time.Second || remaining < 55*time.Second {
+        t.Fatalf("Error: expected revalidated lifetime 60s, got %v", remaining)
+    }
+
+    lock.Lock()
+    defer lock.Unlock()
+
+    if requests["/revalidate"] != 2 {
+        t.Fatalf("Error: expected 2 requests, got %d", requests["/revalidate"])
+    }
+}
+
+func TestNegativeCache(t *testing.T) {
+    err := clean(1)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    child := &countingReadCache{
+        cache: NewDiskCache("cache1", "tmp1", false),
+    }
+
+    ttl := 200 * time.Millisecond
+
+    hc := NewMemoryCache()
+    hc.AddChild(child)
+    hc.SetNegativeCache(ttl, 2)
+
+    get := func(key string, want int32) {
+        _, _, err := hc.Get(key, nil)
+        if err != ErrDataNotFound {
+            t.Fatalf("Error: expected ErrDataNotFound for %s, got %v", key, err)
+        }
+
+        count := atomic.LoadInt32(&child.count)
+        if count != want {
+            t.Fatalf("Error: expected %d child reads, got %d", want, count)
+        }
+    }
+
+    // repeated misses are answered without asking the child
+    get("missing-a", 1)
+    get("missing-a", 1)
+
+    _, err = hc.Stat("missing-a", nil)
+    if err != ErrDataNotFound {
+        t.Fatalf("Error: expected ErrDataNotFound, got %v", err)
+    }
+
+    // a Put forgets the miss
+    _, err = hc.Put("missing-a", nil, strings.NewReader("found"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    _, reader, err := hc.Get("missing-a", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    data, _ := ioutil.ReadAll(reader)
+    if string(data) != "found" {
+        t.Fatalf("Error: expected found, got %q", data)
+    }
+
+    // misses expire after ttl
+    get("missing-b", 2)
+    get("missing-b", 2)
+    <-time.After(ttl)
+    get("missing-b", 3)
+
+    // only maxEntries misses are remembered, oldest first out
+    get("missing-c", 4)
+    get("missing-d", 5)
+    if hc.negative.len() != 2 {
+        t.Fatalf("Error: expected 2 remembered misses, got %d", hc.negative.len())
+    }
+
+    get("missing-d", 5)
+    get("missing-b", 6)
+}
+
+func TestWriteBehind(t *testing.T) {
+    delay := 200 * time.Millisecond
+
+    child := &slowWriteCache{
+        cache: NewMemoryCache(),
+        delay: delay,
+        fail:  1,
+    }
+
+    hc := NewMemoryCache()
+    hc.AddChild(child)
+    hc.SetDeleteThrough(true)
+    hc.SetWriteBehind(&WriteBehindConfig{
+        Concurrency: 1,
+        QueueSize:   4,
+        Retry:       NewBackoffRetryPolicy(3, 10*time.Millisecond, 10*time.Millisecond),
+    })
+
+    start := time.Now()
+    _, err := hc.Put("behind", nil, strings.NewReader("data"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    if time.Since(start) >= delay {
+        t.Fatal("Error: Put waited for the child")
+    }
+
+    _, _, err = hc.Get("behind", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    // the first attempt fails and is retried
+    err = hc.Flush()
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    count := atomic.LoadInt32(&child.count)
+    if count != 2 {
+        t.Fatalf("Error: expected 2 child writes, got %d", count)
+    }
+
+    _, _, err = child.cache.(*HierarchicalCache).Get("behind", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    // deletes are queued too
+    err = hc.Delete("behind", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    err = hc.Flush()
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    _, _, err = child.cache.(*HierarchicalCache).Get("behind", nil)
+    if err != ErrDataNotFound {
+        t.Fatalf("Error: expected ErrDataNotFound, got %v", err)
+    }
+
+    // with one write in progress and one queued, a third overflows
+    overflow := func(policy WriteBehindPolicy) (*slowWriteCache, error) {
+        child := &slowWriteCache{
+            cache: NewMemoryCache(),
+            delay: delay,
+        }
+
+        hc := NewMemoryCache()
+        hc.AddChild(child)
+        hc.SetWriteBehind(&WriteBehindConfig{
+            Concurrency: 1,
+            Policy:      policy,
+            QueueSize:   1,
+        })
+
+        hc.Put("first", nil, strings.NewReader("data"))
+        for atomic.LoadInt32(&child.count) == 0 {
+            <-time.After(time.Millisecond)
+        }
+
+        hc.Put("second", nil, strings.NewReader("data"))
+
+        ctx, cancel := context.WithTimeout(context.Background(), delay/4)
+        defer cancel()
+
+        _, err := hc.PutContext(ctx, "third", nil, strings.NewReader("data"))
+
+        _, _, parentErr := hc.Get("third", nil)
+        if parentErr != nil {
+            t.Fatalf("Error: %v", parentErr)
+        }
+
+        flushErr := hc.Flush()
+        if flushErr != nil {
+            t.Fatalf("Error: %v", flushErr)
+        }
+
+        return child, err
+    }
+
+    has := func(child *slowWriteCache, keys ...string) {
+        for _, key := range []string{"first", "second", "third"} {
+            want := false
+            for i := range keys {
+                want = want || keys[i] == key
+            }
+
+            _, _, err := child.cache.(*HierarchicalCache).Get(key, nil)
+            if want != (err == nil) {
+                t.Fatalf("Error: %s, expected present %v, got %v", key, want, err)
+            }
+        }
+    }
+
+    child, err = overflow(WriteBehindBlock)
+    if err != context.DeadlineExceeded {
+        t.Fatalf("Error: expected DeadlineExceeded, got %v", err)
+    }
+    has(child, "first", "second")
+
+    child, err = overflow(WriteBehindDropNewest)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    has(child, "first", "second")
+
+    child, err = overflow(WriteBehindDropOldest)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    has(child, "first", "third")
+
+    // without a queue size, writes queue behind one in progress
+    child = &slowWriteCache{
+        cache: NewMemoryCache(),
+        delay: delay,
+    }
+
+    hc = NewMemoryCache()
+    hc.AddChild(child)
+    hc.SetWriteBehind(&WriteBehindConfig{
+        Policy: WriteBehindDropNewest,
+    })
+
+    hc.Put("first", nil, strings.NewReader("data"))
+    for atomic.LoadInt32(&child.count) == 0 {
+        <-time.After(time.Millisecond)
+    }
+
+    hc.Put("second", nil, strings.NewReader("data"))
+
+    err = hc.Flush()
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    has(child, "first", "second")
+
+    // a retry waiting when write-behind is reconfigured is abandoned
+    child = &slowWriteCache{
+        cache: NewMemoryCache(),
+        fail:  1000,
+    }
+
+    hc = NewMemoryCache()
+    hc.AddChild(child)
+    hc.SetWriteBehind(&WriteBehindConfig{
+        Retry: NewBackoffRetryPolicy(3, time.Hour, time.Hour),
+    })
+
+    hc.Put("first", nil, strings.NewReader("data"))
+    for atomic.LoadInt32(&child.count) == 0 {
+        <-time.After(time.Millisecond)
+    }
+
+    hc.SetWriteBehind(nil)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    err = hc.FlushContext(ctx)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+}
+
+func TestConsistency(t *testing.T) {
+    good := NewMemoryCache()
+    bad := &slowWriteCache{
+        cache: NewMemoryCache(),
+        fail:  1000,
+    }
+    worse := &slowWriteCache{
+        cache: NewMemoryCache(),
+        fail:  1000,
+    }
+
+    hc := NewMemoryCache()
+    hc.AddChild(good)
+    hc.AddChild(NewMemoryCache())
+    hc.AddChild(bad)
+
+    put := func() error {
+        _, err := hc.Put("replicated", nil, strings.NewReader("data"))
+        return err
+    }
+
+    err := put()
+    if err != nil {
+        t.Fatalf("Error: best effort Put failed: %v", err)
+    }
+
+    hc.SetConsistency(ConsistencyQuorum)
+    err = put()
+    if err != nil {
+        t.Fatalf("Error: quorum Put failed: %v", err)
+    }
+
+    for _, mode := range []PutMode{PutSpool, PutTee} {
+        hc.SetConsistency(ConsistencyAll)
+        hc.SetPutMode(mode)
+
+        err = put()
+
+        var re *ReplicationError
+        if !errors.As(err, &re) {
+            t.Fatalf("Error: expected ReplicationError, got %v", err)
+        }
+
+        if len(re.Failed()) != 1 || re.Failed()[0] != 2 {
+            t.Fatalf("Error: expected child 2 to fail, got %v", re.Failed())
+        }
+
+        if !errors.Is(err, ErrTransient) {
+            t.Fatalf("Error: expected ErrTransient, got %v", err)
+        }
+
+        _, _, err = hc.Get("replicated", nil)
+        if err != nil {
+            t.Fatalf("Error: parent lost the Put: %v", err)
+        }
+    }
+
+    hc.SetPutMode(PutSpool)
+    hc.AddChild(worse)
+    hc.SetConsistency(ConsistencyQuorum)
+
+    // two of four is not a majority
+    err = put()
+    if !errors.Is(err, ErrTransient) {
+        t.Fatalf("Error: expected quorum failure, got %v", err)
+    }
+
+    hc.SetDeleteThrough(true)
+    err = hc.Delete("replicated", nil)
+
+    var re *ReplicationError
+    if !errors.As(err, &re) || len(re.Failed()) != 2 {
+        t.Fatalf("Error: expected 2 failed deletes, got %v", err)
+    }
+
+    _, _, err = good.Get("replicated", nil)
+    if err != ErrDataNotFound {
+        t.Fatalf("Error: expected ErrDataNotFound, got %v", err)
+    }
+}
+
+func TestHedgedRead(t *testing.T) {
+    delay := 300 * time.Millisecond
+
+    slow := &stallingReadCache{data: "slow", delay: delay}
+    fast := &stallingReadCache{data: "fast"}
+
+    hc := NewMemoryCache()
+    hc.AddChild(slow)
+    hc.AddChild(fast)
+
+    get := func(key, want string, within time.Duration) {
+        start := time.Now()
+
+        _, reader, err := hc.Get(key, nil)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        data, _ := ioutil.ReadAll(reader)
+        if string(data) != want {
+            t.Fatalf("Error: expected %s, got %s", want, data)
+        }
+
+        if time.Since(start) > within {
+            t.Fatalf("Error: %s took %v", key, time.Since(start))
+        }
+
+        AsReadCloser(reader).Close()
+    }
+
+    // the loser is cancelled, and its reader closed when it answers
+    abandoned := func(want int32) {
+        for atomic.LoadInt32(&slow.closed) < want {
+            <-time.After(10 * time.Millisecond)
+        }
+
+        if atomic.LoadInt32(&slow.cancelled) != want {
+            t.Fatalf("Error: expected %d cancelled reads, got %d", want, slow.cancelled)
+        }
+    }
+
+    get("sequential", "slow", 2*delay)
+
+    hc.SetReadPolicy(ReadParallel, 0)
+    get("parallel", "fast", delay/2)
+    abandoned(1)
+
+    // the winner's request ends with its reader
+    waitForFlights(hc)
+
+    fast.lock.Lock()
+    ctx := fast.ctx
+    fast.lock.Unlock()
+
+    if ctx.Err() == nil {
+        t.Fatal("Error: winning request not cancelled")
+    }
+
+    hc.SetReadPolicy(ReadHedged, delay/6)
+    get("hedged", "fast", delay/2)
+    abandoned(2)
+
+    // a child which fails is followed at once
+    hc.RemoveChild(slow)
+    hc.RemoveChild(fast)
+    hc.AddChild(NewDiskCache("cache1", "tmp1", false))
+    hc.AddChild(fast)
+    hc.SetReadPolicy(ReadHedged, delay)
+    get("missing", "fast", delay/2)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+    var failing atomic.Bool
+    var requests int32
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&requests, 1)
+        if failing.Load() {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+
+        io.WriteString(w, "healthy")
+    }))
+    defer srv.Close()
+
+    child := NewHttpReadCache(nil)
+    child.SetRetryPolicy(NewBackoffRetryPolicy(1, 0, 0))
+
+    cooldown := 200 * time.Millisecond
+
+    hc := NewMemoryCache()
+    hc.AddChild(child)
+    hc.SetCircuitBreaker(2, cooldown)
+
+    n := 0
+    get := func() error {
+        n++
+        _, reader, err := hc.Get(fmt.Sprintf("%s/%d", srv.URL, n), http.Header{})
+        if err == nil {
+            ioutil.ReadAll(reader)
+        }
+
+        return err
+    }
+
+    state := func(want CircuitState, wantRequests int32) {
+        health := hc.ChildHealth()
+        if len(health) != 1 || health[0].Child != child {
+            t.Fatalf("Error: unexpected child health %+v", health)
+        }
+
+        if health[0].State != want {
+            t.Fatalf("Error: expected %v circuit, got %v", want, health[0].State)
+        }
+
+        if atomic.LoadInt32(&requests) != wantRequests {
+            t.Fatalf("Error: expected %d requests, got %d", wantRequests, requests)
+        }
+    }
+
+    failing.Store(true)
+    for i := 0; i < 2; i++ {
+        err := get()
+        if !errors.Is(err, ErrTransient) {
+            t.Fatalf("Error: expected ErrTransient, got %v", err)
+        }
+    }
+    state(CircuitOpen, 2)
+
+    // an open circuit skips the child
+    err := get()
+    if !errors.Is(err, ErrCircuitOpen) {
+        t.Fatalf("Error: expected ErrCircuitOpen, got %v", err)
+    }
+    state(CircuitOpen, 2)
+
+    if hc.ChildHealth()[0].ConsecutiveFailures != 2 {
+        t.Fatalf("Error: expected 2 consecutive failures, got %d", hc.ChildHealth()[0].ConsecutiveFailures)
+    }
+
+    // a failed probe reopens the circuit at once
+    <-time.After(cooldown)
+    get()
+    state(CircuitOpen, 3)
+
+    // a successful probe closes it
+    failing.Store(false)
+    <-time.After(cooldown)
+    err = get()
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    state(CircuitClosed, 4)
+
+    // with circuit breaking off, health is still tracked
+    hc.SetCircuitBreaker(0, 0)
+    failing.Store(true)
+    for i := 0; i < 3; i++ {
+        get()
+    }
+    state(CircuitClosed, 7)
+
+    if hc.ChildHealth()[0].Failures != 6 {
+        t.Fatalf("Error: expected 6 failures, got %d", hc.ChildHealth()[0].Failures)
+    }
+}
+
+func TestTieredCache(t *testing.T) {
+    data := make([]byte, TestFileSize)
+    rand.Read(data)
+
+    origin := NewMemoryCache()
+    for _, key := range []string{"all", "level", "hits"} {
+        _, err := origin.Put(key, nil, bytes.NewReader(data))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    counted := &countingReadCache{cache: origin}
+
+    var tc *TieredCache
+    var top, middle RWCache
+
+    newTiers := func(policy PromotionPolicy) (*TieredCache, RWCache, RWCache) {
+        top := NewMemoryCache().GetParent()
+        middle := NewMemoryCache().GetParent()
+
+        tc := NewTieredCache(top, middle, counted)
+        tc.SetPromotionPolicy(policy)
+
+        return tc, top, middle
+    }
+
+    read := func(tc *TieredCache, key string) {
+        _, reader, err := tc.Get(key, nil)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        got, _ := ioutil.ReadAll(reader)
+        if !bytes.Equal(got, data) {
+            t.Fatalf("Error: %s: data mismatch", key)
+        }
+
+        WaitForCacheFill(reader)
+    }
+
+    holds := func(key string, want ...bool) {
+        for i, level := range []RWCache{top, middle} {
+            _, _, err := level.Get(key, nil)
+            if want[i] != (err == nil) {
+                t.Fatalf("Error: %s: level %d expected present %v, got %v", key, i, want[i], err)
+            }
+        }
+    }
+
+    originReads := func(want int32) {
+        count := atomic.LoadInt32(&counted.count)
+        if count != want {
+            t.Fatalf("Error: expected %d origin reads, got %d", want, count)
+        }
+    }
+
+    tc, top, middle = newTiers(PromotionPolicy{})
+    read(tc, "all")
+    holds("all", true, true)
+    read(tc, "all")
+    originReads(1)
+
+    // promotion outlives the caller's context
+    tc, top, middle = newTiers(PromotionPolicy{})
+    ctx, cancel := context.WithCancel(context.Background())
+
+    _, reader, err := tc.GetContext(ctx, "all", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    ioutil.ReadAll(reader)
+    cancel()
+    WaitForCacheFill(reader)
+    holds("all", true, true)
+    originReads(2)
+
+    // only level 1 is filled, and hits there go no higher
+    tc, top, middle = newTiers(PromotionPolicy{Level: 1, Mode: PromoteToLevel})
+    read(tc, "level")
+    holds("level", false, true)
+    read(tc, "level")
+    holds("level", false, true)
+    originReads(3)
+
+    tc, top, middle = newTiers(PromotionPolicy{MinHits: 2})
+    read(tc, "hits")
+    holds("hits", false, false)
+    read(tc, "hits")
+    holds("hits", true, true)
+    originReads(5)
+
+    st, err := tc.Stat("hits", nil)
+    if err != nil || st.Level != 0 {
+        t.Fatalf("Error: expected level 0, got %+v, %v", st, err)
+    }
+
+    err = tc.Delete("hits", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    holds("hits", false, false)
+}
+
+func TestAdmissionPolicy(t *testing.T) {
+    big := make([]byte, TestFileSize)
+    rand.Read(big)
+    small := []byte("small entry")
+
+    origin := NewMemoryCache()
+    origin.Put("big", nil, bytes.NewReader(big))
+    for _, key := range []string{"small", "tmp/small", "keep/small"} {
+        origin.Put(key, nil, bytes.NewReader(small))
+    }
+
+    child := &countingReadCache{
+        cache: origin,
+        delay: 50 * time.Millisecond,
+    }
+
+    hc := NewMemoryCache()
+    hc.AddChild(child)
+    hc.SetAdmissionPolicy(AdmissionChain{
+        &MaxSizeAdmission{MaxSize: 1024},
+        NewFrequencyAdmission(2, 1024),
+    })
+
+    get := func(key string, want []byte) {
+        _, reader, err := hc.Get(key, nil)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        got, _ := ioutil.ReadAll(reader)
+        if !bytes.Equal(got, want) {
+            t.Fatalf("Error: %s: data mismatch", key)
+        }
+
+        WaitForCacheFill(reader)
+        waitForFlights(hc)
+    }
+
+    stored := func(key string, want bool) {
+        _, _, err := hc.GetParent().Get(key, nil)
+        if want != (err == nil) {
+            t.Fatalf("Error: %s: expected stored %v, got %v", key, want, err)
+        }
+    }
+
+    // callers sharing a refused fetch each get the whole entry
+    var wg sync.WaitGroup
+    readers := make([]io.Reader, 3)
+    errs := make([]error, 3)
+
+    for i := range readers {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            _, readers[i], errs[i] = hc.Get("big", nil)
+        }(i)
+    }
+
+    wg.Wait()
+
+    for i := range readers {
+        if errs[i] != nil {
+            t.Fatalf("Error: %v", errs[i])
+        }
+
+        got, _ := ioutil.ReadAll(readers[i])
+        if !bytes.Equal(got, big) {
+            t.Fatal("Error: big: data mismatch")
+        }
+    }
+
+    // from a single read of the child
+    if atomic.LoadInt32(&child.count) != 1 {
+        t.Fatalf("Error: expected 1 child fetch, got %d", child.count)
+    }
+
+    if WaitForCacheFill(readers[0]) != CacheFillSkipped {
+        t.Fatal("Error: refused entry filled")
+    }
+
+    waitForFlights(hc)
+    stored("big", false)
+
+    get("small", small)
+    stored("small", false)
+    get("small", small)
+    stored("small", true)
+
+    hc.SetAdmissionPolicy(&PrefixAdmission{
+        Rules: map[string]AdmissionPolicy{
+            "tmp/": AdmitNever,
+        },
+    })
+
+    get("tmp/small", small)
+    stored("tmp/small", false)
+    get("keep/small", small)
+    stored("keep/small", true)
+
+    fa := NewFrequencyAdmission(3, 64)
+    for i := 1; i <= 3; i++ {
+        if fa.Admit("key", 1) != (i == 3) {
+            t.Fatalf("Error: read %d admitted %v", i, i != 3)
+        }
+
+        if fa.Estimate("key") != i {
+            t.Fatalf("Error: expected estimate %d, got %d", i, fa.Estimate("key"))
+        }
+    }
+
+    if fa.Estimate("other") != 0 {
+        t.Fatalf("Error: unread key estimated at %d", fa.Estimate("other"))
+    }
+
+    msa := &MaxSizeAdmission{MaxSize: 10, RejectUnknown: true}
+    if !msa.Admit("key", 10) || msa.Admit("key", 11) || msa.Admit("key", GetLengthUnknown) {
+        t.Fatal("Error: MaxSizeAdmission admitted the wrong sizes")
+    }
+}
+
+func TestScavengerIndex(t *testing.T) {
+    err := clean(2)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    dc := NewDiskCache("cache2", "tmp2", false)
+    index := filepath.Join(t.TempDir(), "scavenger.index")
+
+    open := func(maxSize int64) *Scavenger {
+        sc, err := OpenScavenger(dc, maxSize, index)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        return sc
+    }
+
+    sc := open(1024)
+    for _, key := range []string{"a", "b", "c"} {
+        _, err = sc.Put(key, nil, strings.NewReader("0123456789"))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    // a is now the most recently read
+    <-time.After(10 * time.Millisecond)
+    _, _, err = sc.Get("a", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    err = sc.Delete("b", nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    err = sc.Close()
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    sc = open(1024)
+    if !sc.Find("a") || sc.Find("b") || !sc.Find("c") || sc.Size() != 20 {
+        t.Fatalf("Error: records not restored, size %d", sc.Size())
+    }
+
+    if !sc.data["a"].LastRead.After(sc.data["c"].LastRead) {
+        t.Fatal("Error: read time not restored")
+    }
+
+    // without Close, changes survive through the journal, and a write cut
+    // short by a crash is ignored
+    _, err = sc.Put("d", nil, strings.NewReader("0123456789"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    f, err := os.OpenFile(index+".journal", os.O_WRONLY|os.O_APPEND, 0660)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    f.WriteString(`{"op":"put","key":"torn","si`)
+    f.Close()
+
+    sc = open(1024)
+    if !sc.Find("d") || sc.Find("torn") || sc.Size() != 30 {
+        t.Fatalf("Error: journal not replayed, size %d", sc.Size())
+    }
+
+    // restored records count against a smaller limit at once
+    sc.Close()
+    sc = open(25)
+    if sc.Size() > 25 || !sc.Find("a") || sc.Find("c") {
+        t.Fatalf("Error: restored cache not scavenged, size %d", sc.Size())
+    }
+
+    _, _, err = dc.Get("c", nil)
+    if err != ErrDataNotFound {
+        t.Fatalf("Error: expected ErrDataNotFound, got %v", err)
+    }
+
+    // reads alone compact the journal too
+    for i := 0; i < 3*minCompaction; i++ {
+        _, reader, err := sc.Get("a", nil)
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+        AsReadCloser(reader).Close()
+    }
+
+    if sc.index.entries > minCompaction+1 {
+        t.Fatalf("Error: journal not compacted, %d entries", sc.index.entries)
+    }
+
+    sc.Close()
+}
+
+func TestScavengerRebuild(t *testing.T) {
+    err := clean(2)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    hc := NewDiskCache("cache2", "tmp2", false)
+    dc := hc.GetParent().(*DiskCache)
+
+    for _, key := range []string{"a", "dir/b", "c"} {
+        _, err = dc.Put(key, nil, strings.NewReader("0123456789"))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    }
+
+    _, err = dc.Put("expired", WithExpiry(nil, time.Now().Add(-time.Minute)), strings.NewReader("0123456789"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    // c was last used long ago, so it is the first to go
+    old := time.Now().Add(-24 * time.Hour)
+    err = os.Chtimes(filepath.Join(dc.GetRoot(), "c"), old, old)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    // only temp files left behind long ago are removed
+    err = ioutil.WriteFile(filepath.Join(dc.GetTmpRoot(), "stale"), []byte("stale"), 0660)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    err = os.Chtimes(filepath.Join(dc.GetTmpRoot(), "stale"), old, old)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    err = ioutil.WriteFile(filepath.Join(dc.GetTmpRoot(), "fresh"), []byte("fresh"), 0660)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    sc := NewScavenger(dc, 25)
+
+    // records the Scavenger already holds are kept
+    _, err = sc.Put("a", nil, strings.NewReader("0123456789"))
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    scan := sc.Rebuild(dc)
+    err = scan.Wait()
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    progress := scan.Progress()
+    if !progress.Done || progress.Files != 2 || progress.Bytes != 20 || progress.StaleFiles != 1 {
+        t.Fatalf("Error: unexpected progress %+v", progress)
+    }
+
+    if sc.Size() != 20 || !sc.Find("a") || !sc.Find("dir/b") || sc.Find("c") || sc.Find("expired") {
+        t.Fatalf("Error: records not rebuilt, size %d", sc.Size())
+    }
+
+    _, _, err = dc.Get("c", nil)
+    if err != ErrDataNotFound {
+        t.Fatalf("Error: expected ErrDataNotFound, got %v", err)
+    }
+
+    _, err = os.Stat(filepath.Join(dc.GetTmpRoot(), "stale"))
+    if !os.IsNotExist(err) {
+        t.Fatalf("Error: stale temp file not removed: %v", err)
     }
 
-    err = bigFileSetup()
+    _, err = os.Stat(filepath.Join(dc.GetTmpRoot(), "fresh"))
     if err != nil {
-        cleanup()
-        os.Exit(1)
+        t.Fatalf("Error: %v", err)
     }
 
-    os.Exit(m.Run())
-}
+    // a cancelled rebuild stops early
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
 
-func TestFileRead(t *testing.T) {
-    f, err := os.Open(TestFilePath)
-    if err != nil {
-        t.Fatalf("Error: %v", err)
+    err = NewScavenger(dc, 25).RebuildContext(ctx, dc).Wait()
+    if err != context.Canceled {
+        t.Fatalf("Error: expected context.Canceled, got %v", err)
     }
-    defer f.Close()
 
-    checkData(f, t)
-}
+    // compressed files count at their decompressed size, as Put counts them
+    dir := t.TempDir()
+    cdc := NewDiskCache(filepath.Join(dir, "cache"), filepath.Join(dir, "tmp"), true).GetParent().(*DiskCache)
 
-func TestSafeReader(t *testing.T) {
-    f, err := os.Open(TestFilePath)
+    _, err = cdc.Put("zeros", nil, bytes.NewReader(make([]byte, 1000)))
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
-    fi, err := f.Stat()
+
+    sc = NewScavenger(cdc, 1024*1024)
+    err = sc.Rebuild(cdc).Wait()
     if err != nil {
-        f.Close()
         t.Fatalf("Error: %v", err)
     }
 
-    reader := NewSafeReader(fi.Size(), f, nil)
-
-    checkData(reader, t)
+    if sc.Size() != 1000 {
+        t.Fatalf("Error: expected 1000 bytes recorded, got %d", sc.Size())
+    }
 }
 
-func TestDiskCacheGetRoots(t *testing.T) {
-    err := clean(1)
-    if err != nil {
-        t.Fatalf("Error cleaning: %v", err)
+func TestEvictionPolicy(t *testing.T) {
+    start := time.Now()
+    seq := 0
+
+    records := make(map[string]*DataRecord)
+    record := func(key string, size int64) *DataRecord {
+        val, ok := records[key]
+        if !ok {
+            val = &DataRecord{
+                Key:  key,
+                Size: size,
+            }
+            records[key] = val
+        }
+
+        seq++
+        val.LastRead = start.Add(time.Duration(seq) * time.Second)
+
+        return val
     }
 
-    root := "root1"
-    tmpRoot := "tmp1"
+    tests := []struct {
+        name   string
+        policy EvictionPolicy
+        order  []string
+    }{
+        {"FIFO", NewFIFOEviction(), []string{"a", "b", "big", "c"}},
+        {"LRU", NewLRUEviction(), []string{"b", "big", "a", "c"}},
+        {"LFU", NewLFUEviction(), []string{"b", "big", "a", "c"}},
+        {"GreedyDualSize", NewGreedyDualSizeEviction(), []string{"big", "b", "a", "c"}},
+    }
 
-    c := NewDiskCache(root, tmpRoot, false)
-    dc := c.GetParent().(*DiskCache)
+    for _, test := range tests {
+        records = make(map[string]*DataRecord)
 
-    if dc.GetRoot() != root {
-        t.Fatalf("Invalid cache root (%s != %s)", dc.GetRoot(), root)
+        test.policy.Add(record("a", 1))
+        test.policy.Add(record("b", 1))
+        test.policy.Add(record("big", 100))
+        test.policy.Add(record("c", 1))
+        test.policy.Access(record("a", 1))
+        test.policy.Access(record("c", 1))
+        test.policy.Access(record("c", 1))
+
+        // removed records are never evicted
+        test.policy.Add(record("gone", 1))
+        test.policy.Remove(records["gone"])
+        test.policy.Remove(&DataRecord{Key: "never added"})
+
+        for _, key := range test.order {
+            val := test.policy.Evict()
+            if val == nil || val.Key != key {
+                t.Fatalf("Error: %s evicted %v, expected %s", test.name, val, key)
+            }
+        }
+
+        if test.policy.Evict() != nil {
+            t.Fatalf("Error: %s evicted from an empty policy", test.name)
+        }
     }
 
-    if dc.GetTmpRoot() != tmpRoot {
-        t.Fatalf("Invalid cache root (%s != %s)", dc.GetTmpRoot(), tmpRoot)
+    // a scan of one time reads must not flush records read repeatedly
+    for _, policy := range []EvictionPolicy{NewARCEviction(), NewTinyLFUEviction(1000)} {
+        policy.(sizedPolicy).setCapacity(10)
+        records = make(map[string]*DataRecord)
+        size := int64(0)
+
+        add := func(key string) {
+            policy.Add(record(key, 1))
+            size++
+
+            for size > 10 {
+                val := policy.Evict()
+                if val == nil {
+                    t.Fatalf("Error: %T evicted nothing", policy)
+                }
+
+                delete(records, val.Key)
+                size--
+            }
+        }
+
+        for i := 0; i < 5; i++ {
+            add("hot" + strconv.Itoa(i))
+            policy.Access(records["hot"+strconv.Itoa(i)])
+        }
+
+        for i := 0; i < 100; i++ {
+            add("scan" + strconv.Itoa(i))
+        }
+
+        for i := 0; i < 5; i++ {
+            _, ok := records["hot"+strconv.Itoa(i)]
+            if !ok {
+                t.Fatalf("Error: %T evicted hot%d during a scan", policy, i)
+            }
+        }
     }
-}
 
-func TestDiskCacheChildren(t *testing.T) {
-    dc1 := NewDiskCache("cache1", "tmp1", false)
-    dc2 := NewDiskCache("cache2", "tmp2", false)
+    // a Scavenger deletes what its policy picks
+    sc := NewScavengerWithPolicy(NewMemoryCache().GetParent(), 25, NewGreedyDualSizeEviction())
 
-    err := dc1.AddChild(dc2)
-    if err != nil {
-        t.Fatalf("Error: %v", err)
+    for _, key := range []string{"small", "large", "medium"} {
+        data := strings.Repeat("0", map[string]int{"small": 5, "large": 15, "medium": 10}[key])
+        _, err := sc.Put(key, nil, strings.NewReader(data))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
     }
 
-    dc1.RemoveChild(dc2)
-    if len(dc1.readers) != 0 {
-        t.Fatal()
+    if sc.Find("large") || !sc.Find("small") || !sc.Find("medium") || sc.Size() != 15 {
+        t.Fatalf("Error: policy not applied, size %d", sc.Size())
     }
-    if len(dc1.writers) != 0 {
-        t.Fatal()
+
+    // and sizes policies which need it to its limit
+    arc := NewARCEviction()
+    NewScavengerWithPolicy(NewMemoryCache().GetParent(), 25, arc)
+
+    if arc.capacity != 25 {
+        t.Fatalf("Error: expected an ARC capacity of 25, got %d", arc.capacity)
     }
 }
 
-func TestDiskCachePut(t *testing.T) {
-    dc := NewDiskCache("cache1", "tmp1", false)
+func TestScavengerWatermarks(t *testing.T) {
+    parent := &gatedDeleteCache{
+        RWCache: NewMemoryCache().GetParent(),
+        gate:    make(chan struct{}),
+    }
 
-    f, err := os.Open(TestFilePath)
-    if err != nil {
-        t.Fatalf("Error: %v", err)
+    sc := NewScavenger(parent, 1000)
+    sc.SetWatermarks(80, 50)
+
+    put := func(key string) chan error {
+        result := make(chan error, 1)
+        go func() {
+            _, err := sc.Put(key, nil, strings.NewReader("0123456789"))
+            result <- err
+        }()
+
+        return result
     }
-    fi, err := f.Stat()
-    if err != nil {
-        f.Close()
-        t.Fatalf("Error: %v", err)
+
+    // a Put past the high watermark but under maxSize deletes nothing
+    // itself, so returns while the deletes are held
+    for i := 0; i < 9; i++ {
+        select {
+        case err := <-put(strconv.Itoa(i)):
+            if err != nil {
+                t.Fatalf("Error: %v", err)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("Error: Put of %d blocked on eviction", i)
+        }
+
+        <-time.After(time.Millisecond)
     }
 
-    reader := NewSafeReader(fi.Size(), f, nil)
+    // past the high watermark, eviction starts in the background and takes
+    // the cache down to the low one
+    for atomic.LoadInt32(&parent.deletes) == 0 {
+        <-time.After(time.Millisecond)
+    }
 
-    _, err = dc.Put(TestCachePath, nil, reader)
-    if err != nil {
-        t.Fatalf("Error: %v", err)
+    if sc.Size() != 50 || sc.Find("3") || !sc.Find("4") {
+        t.Fatalf("Error: unexpected eviction, size %d", sc.Size())
     }
 
-    fullPath := filepath.Join("cache1", TestCachePath)
-    f2, err := os.Open(fullPath)
-    if err != nil {
-        t.Fatalf("Error: %v", err)
+    // writes do not wait for the deletes
+    select {
+    case err := <-put("9"):
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Error: Put blocked on eviction")
     }
-    fi, err = f2.Stat()
+
+    // except of a key being evicted, which must not be deleted once written
+    result := put("0")
+    select {
+    case <-result:
+        t.Fatal("Error: Put did not wait for eviction of its key")
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    close(parent.gate)
+
+    err := <-result
     if err != nil {
-        f2.Close()
         t.Fatalf("Error: %v", err)
     }
 
-    checkData(NewSafeReader(fi.Size(), f2, nil), t)
+    if !sc.Find("0") {
+        t.Fatal("Error: record of a rewritten key lost")
+    }
 
-    data, err := dc.Get(TestCachePath, nil)
+    // Close lets the deletes under way finish, then stops
+    err = sc.Close()
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
 
-    checkData(data, t)
-}
-
-func TestDiskCacheGet(t *testing.T) {
-    dc := NewDiskCache("cache1", "tmp1", false)
+    select {
+    case <-sc.evictDone:
+    default:
+        t.Fatal("Error: background eviction still running after Close")
+    }
 
-    reader, err := dc.Get(TestCachePath, nil)
+    _, _, err = parent.Get("0", nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
 
-    checkData(reader, t)
-}
+    _, _, err = parent.Get("1", nil)
+    if err != ErrDataNotFound {
+        t.Fatalf("Error: expected ErrDataNotFound, got %v", err)
+    }
 
-func TestDiskCacheRetries(t *testing.T) {
-    dc := NewDiskCache("cache1", "tmp1", false)
-    tmp := dc.GetParent().(*DiskCache)
+    // watermarks are kept within maxSize
+    sc = NewScavenger(NewMemoryCache().GetParent(), 100)
+    sc.SetWatermarks(500, 300)
+    defer sc.Close()
 
-    data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
-    reader := bytes.NewReader(data)
+    if sc.highWater != 100 || sc.lowWater != 100 {
+        t.Fatalf("Error: expected watermarks of 100, got %d and %d", sc.highWater, sc.lowWater)
+    }
 
-    // hold file lock
-    f, err := os.OpenFile(filepath.Join(tmp.GetRoot(), TestCachePath), os.O_RDWR, 0660)
-    if err != nil {
-        t.Fatalf("Error: %v", err)
+    // with high at maxSize, a write past it evicts down to low, rather than
+    // leaving the cache full for the next write to evict again
+    sc = NewScavenger(NewMemoryCache().GetParent(), 100)
+    sc.SetWatermarks(100, 50)
+    defer sc.Close()
+
+    for i := 0; i < 15; i++ {
+        _, err := sc.Put(strconv.Itoa(i), nil, strings.NewReader("0123456789"))
+        if err != nil {
+            t.Fatalf("Error: %v", err)
+        }
+
+        if i >= 10 && sc.Size() > 90 {
+            t.Fatalf("Error: Put %d left the cache full, size %d", i, sc.Size())
+        }
     }
-    defer f.Close()
 
-    err = dc.Delete(TestCachePath, nil)
-    if err == nil {
-        t.Fatalf("Deleting cache file wasn't supposed to succeed!", err)
+    if sc.Find("5") || !sc.Find("14") {
+        t.Fatal("Error: unexpected eviction")
     }
+}
 
-    _, err = dc.Put(TestCachePath, nil, reader)
-    if err == nil {
+func TestChunkedIndex(t *testing.T) {
+    data := make([]byte, 5*chunkedChunkSize+123)
+    rand.Read(data)
+
+    var buffer bytes.Buffer
+    writer := newChunkedWriter(&buffer)
+
+    _, err := writer.Write(data)
+    if err != nil {
         t.Fatalf("Error: %v", err)
     }
-}
 
-func TestFsReadCache(t *testing.T) {
-    cache := &FsReadCache{}
-    path := filepath.Join("cache1", TestCachePath)
-    reader, err := cache.Get(path, nil)
+    err = writer.Close()
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
 
-    checkData(reader, t)
-}
+    // a V1 entry is the same frames, without the end marker, index and
+    // footer
+    indexed := buffer.Bytes()
+    legacy := append([]byte(chunkedMagicV1), indexed[len(chunkedMagic):len(indexed)-chunkedHeaderLen-6*chunkedIndexLen-chunkedFooterLen]...)
 
-func TestHttpReadCache(t *testing.T) {
-    go http.ListenAndServe(":8888", http.FileServer(http.Dir("./cache1")))
+    for _, entry := range [][]byte{indexed, legacy} {
+        src := &countingReadSeeker{ReadSeeker: bytes.NewReader(entry)}
 
-    uri := fmt.Sprintf("http://localhost:8888/%s", TestCachePath)
-    uri = strings.Replace(uri, "\\", "/", -1)
+        chunked, err := isChunked(src)
+        if err != nil || !chunked {
+            t.Fatalf("Error: not chunked (%v)", err)
+        }
 
-    cache := &HttpReadCache{}
-    reader, err := cache.Get(uri, http.Header{})
-    if err != nil {
-        t.Fatalf("Error: %v", err)
+        src.reads = 0
+        size, err := chunkedSize(src)
+        if err != nil || size != int64(len(data)) {
+            t.Fatalf("Error: expected size %d, got %d (%v)", len(data), size, err)
+        }
+
+        // the size of an indexed entry is read from its footer
+        if string(entry[:len(chunkedMagic)]) == chunkedMagic && src.reads > 2 {
+            t.Fatalf("Error: %d reads to size an indexed entry", src.reads)
+        }
+
+        for _, offset := range []int64{0, 1, chunkedChunkSize - 1, chunkedChunkSize, 3*chunkedChunkSize + 7, int64(len(data)) - 1, int64(len(data))} {
+            src.Seek(int64(len(chunkedMagic)), io.SeekStart)
+
+            cr, err := openChunkedRange(src, offset)
+            if err != nil {
+                t.Fatalf("Error: offset %d: %v", offset, err)
+            }
+
+            got, err := ioutil.ReadAll(cr)
+            if err != nil || !bytes.Equal(got, data[offset:]) {
+                t.Fatalf("Error: offset %d: data mismatch (%v)", offset, err)
+            }
+        }
+
+        src.Seek(int64(len(chunkedMagic)), io.SeekStart)
+        _, err = openChunkedRange(src, int64(len(data))+1)
+        if err != ErrInvalidRange {
+            t.Fatalf("Error: expected ErrInvalidRange, got %v", err)
+        }
     }
 
-    checkData(reader, t)
+    // a failed final flush is reported by Close
+    writer = newChunkedWriter(&failingWriter{})
+    writer.Write([]byte("data"))
 
-    _, err = cache.Get(uri, nil)
+    err = writer.Close()
     if err == nil {
-        t.Fatalf("Error: should have thrown error on nil header")
+        t.Fatal("Error: Close hid a failed flush")
     }
 }
 
-func TestChildFill(t *testing.T) {
-    dc1 := NewDiskCache("cache1", "tmp1", false)
-    dc3 := NewDiskCache("cache3", "tmp3", false)
-
-    dc3.AddChild(dc1)
+func TestCompression(t *testing.T) {
+    err := clean(1)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
 
-    // previous tests should have populated the dc1 cache
-    // this call should fall through to r1 and return both
-    // valid data and populate the dc3 cache
-    d1, err := dc3.Get(TestCachePath, nil)
+    f, err := os.Open(TestFilePath)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+    fi, err := f.Stat()
     if err != nil {
+        f.Close()
         t.Fatalf("Error: %v", err)
     }
 
-    // check the returned data
-    checkData(d1, t)
+    reader := NewSafeReader(fi.Size(), f, nil)
 
-    WaitForCacheFill(d1)
+    dc1 := NewDiskCache("cache1", "tmp1", true)
 
-    dc3.RemoveChild(dc1)
-    d2, err := dc3.Get(TestCachePath, nil)
+    _, err = dc1.Put(TestCachePath, nil, reader)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
 
-    // check the data that was populated into dc3 cache
-    checkData(d2, t)
+    _, data, err := dc1.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(data, t)
 }
 
-func TestCompression(t *testing.T) {
+func TestLegacyCompression(t *testing.T) {
     err := clean(1)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
 
-    f, err := os.Open(TestFilePath)
+    fd, err := ioutil.ReadFile(TestFilePath)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
-    fi, err := f.Stat()
+
+    // files compressed before the chunked layout are a single zlib stream
+    var buffer bytes.Buffer
+    writer := zlib.NewWriter(&buffer)
+    writer.Write(fd)
+    writer.Close()
+
+    fullPath := filepath.Join("cache1", TestCachePath)
+    err = os.MkdirAll(filepath.Dir(fullPath), 0770)
     if err != nil {
-        f.Close()
         t.Fatalf("Error: %v", err)
     }
 
-    reader := NewSafeReader(fi.Size(), f, nil)
+    err = ioutil.WriteFile(fullPath, buffer.Bytes(), 0660)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
 
-    dc1 := NewDiskCache("cache1", "tmp1", true)
+    dc := NewDiskCache("cache1", "tmp1", true)
 
-    _, err = dc1.Put(TestCachePath, nil, reader)
+    _, data, err := dc.Get(TestCachePath, nil)
+    if err != nil {
+        t.Fatalf("Error: %v", err)
+    }
+
+    checkData(data, t)
+
+    _, data, err = dc.GetRange(TestCachePath, nil, 10, 10)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
 
-    data, err := dc1.Get(TestCachePath, nil)
+    got, err := ioutil.ReadAll(data)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
 
-    checkData(data, t)
+    if !bytes.Equal(got, fd[10:20]) {
+        t.Fatal("Error: legacy range data mismatch")
+    }
 }
 
 func TestDataNotFound(t *testing.T) {
     dc1 := NewDiskCache("cache1", "tmp1", false)
 
-    _, err := dc1.Get("notreal.file", nil)
+    _, _, err := dc1.Get("notreal.file", nil)
     if err == nil {
         t.Fatal()
     }
@@ -324,7 +3053,7 @@ func TestMemCache(t *testing.T) {
     mc.AddChild(dc)
 
     // should bubble up from file cache
-    d1, err := mc.Get(TestCachePath, nil)
+    _, d1, err := mc.Get(TestCachePath, nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
@@ -336,7 +3065,7 @@ func TestMemCache(t *testing.T) {
 
     // should come from RAM
     mc.RemoveChild(dc)
-    d2, err := mc.Get(TestCachePath, nil)
+    _, d2, err := mc.Get(TestCachePath, nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
@@ -373,14 +3102,14 @@ func TestWriteThrough(t *testing.T) {
         t.Fatalf("Error: %v", err)
     }
 
-    data, err := dc.Get(TestCachePath, nil)
+    _, data, err := dc.Get(TestCachePath, nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
 
     checkData(data, t)
 
-    data, err = mc.Get(TestCachePath, nil)
+    _, data, err = mc.Get(TestCachePath, nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
@@ -439,19 +3168,19 @@ func TestScavenger(t *testing.T) {
         }
 
         // check to make sure it made it everywhere via write-through
-        data, err := dc.Get(cachePath, nil)
+        _, data, err := dc.Get(cachePath, nil)
         if err != nil {
             t.Fatalf("Error: %v", err)
         }
         checkData(data, t)
 
-        data, err = mc.Get(cachePath, nil)
+        _, data, err = mc.Get(cachePath, nil)
         if err != nil {
             t.Fatalf("Error: %v", err)
         }
         checkData(data, t)
 
-        data, err = cache.Get(cachePath, nil)
+        _, data, err = cache.Get(cachePath, nil)
         if err != nil {
             t.Fatalf("Error: %v", err)
         }
@@ -464,17 +3193,17 @@ func TestScavenger(t *testing.T) {
             }
         } else {
             // record should be gone now
-            _, err = dc.Get(origPath, nil)
+            _, _, err = dc.Get(origPath, nil)
             if err == nil {
                 t.Fatal()
             }
 
-            _, err = mc.Get(origPath, nil)
+            _, _, err = mc.Get(origPath, nil)
             if err == nil {
                 t.Fatal()
             }
 
-            _, err = cache.Get(origPath, nil)
+            _, _, err = cache.Get(origPath, nil)
             if err == nil {
                 t.Fatal()
             }
@@ -516,19 +3245,19 @@ func TestScavengerDelete(t *testing.T) {
         t.Fatalf("Error: %v", err)
     }
 
-    data, err := dc.Get(TestCachePath, nil)
+    _, data, err := dc.Get(TestCachePath, nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
     checkData(data, t)
 
-    data, err = mc.Get(TestCachePath, nil)
+    _, data, err = mc.Get(TestCachePath, nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
     checkData(data, t)
 
-    data, err = cache.Get(TestCachePath, nil)
+    _, data, err = cache.Get(TestCachePath, nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
@@ -538,17 +3267,17 @@ func TestScavengerDelete(t *testing.T) {
     cache.Delete(TestCachePath, nil)
 
     // record should be gone now
-    _, err = dc.Get(TestCachePath, nil)
+    _, _, err = dc.Get(TestCachePath, nil)
     if err == nil {
         t.Fatal()
     }
 
-    _, err = mc.Get(TestCachePath, nil)
+    _, _, err = mc.Get(TestCachePath, nil)
     if err == nil {
         t.Fatal()
     }
 
-    _, err = cache.Get(TestCachePath, nil)
+    _, _, err = cache.Get(TestCachePath, nil)
     if err == nil {
         t.Fatal()
     }
@@ -584,7 +3313,7 @@ func TestBigFile(t *testing.T) {
         t.Fatalf("Error: %v", err)
     }
 
-    data, err := dc1.Get(BigFileCachePath, nil)
+    _, data, err := dc1.Get(BigFileCachePath, nil)
     if err != nil {
         t.Fatalf("Error: %v", err)
     }
@@ -625,6 +3354,155 @@ func TestBigFile(t *testing.T) {
     }
 }
 
+func BenchmarkScavengerGet(b *testing.B) {
+    for _, n := range []int{10000, 100000, 1000000} {
+        b.Run(strconv.Itoa(n), func(b *testing.B) {
+            sc := fullScavenger(b, n)
+            b.ResetTimer()
+
+            for i := 0; i < b.N; i++ {
+                _, _, err := sc.Get(strconv.Itoa(i*7919%n), nil)
+                if err != nil {
+                    b.Fatalf("Error: %v", err)
+                }
+            }
+        })
+    }
+}
+
+// BenchmarkScavengerPut writes to a full Scavenger, so that every Put
+// evicts a record.
+func BenchmarkScavengerPut(b *testing.B) {
+    for _, n := range []int{10000, 100000, 1000000} {
+        b.Run(strconv.Itoa(n), func(b *testing.B) {
+            sc := fullScavenger(b, n)
+            b.ResetTimer()
+
+            for i := 0; i < b.N; i++ {
+                _, err := sc.Put("new"+strconv.Itoa(i), nil, strings.NewReader("0"))
+                if err != nil {
+                    b.Fatalf("Error: %v", err)
+                }
+            }
+
+            if sc.Size() != int64(n) {
+                b.Fatalf("Error: size %d, expected %d", sc.Size(), n)
+            }
+        })
+    }
+}
+
+// BenchmarkEvictionHitRatio replays synthetic traces against a Scavenger
+// with each policy, reporting the share of reads which hit. Entries are one
+// byte, except in the Sized trace.
+func BenchmarkEvictionHitRatio(b *testing.B) {
+    const (
+        capacity = 1000
+        keys     = 20000
+        length   = 100000 // reads in each trace
+    )
+
+    zipfKey := func(r *mathrand.Rand, zipf *mathrand.Zipf, i int) string {
+        return strconv.FormatUint(zipf.Uint64(), 10)
+    }
+
+    traces := []struct {
+        name string
+        next func(r *mathrand.Rand, zipf *mathrand.Zipf, i int) string
+        size func(key string) int
+    }{
+        // a few keys are read far more often than the rest
+        {"Zipf", zipfKey, nil},
+        // popular reads interrupted by long scans of keys read only once
+        {"Scan", func(r *mathrand.Rand, zipf *mathrand.Zipf, i int) string {
+            if i%10000 < 3000 {
+                return "scan" + strconv.Itoa(i)
+            }
+
+            return strconv.FormatUint(zipf.Uint64(), 10)
+        }, nil},
+        // a loop over slightly more keys than fit
+        {"Loop", func(r *mathrand.Rand, zipf *mathrand.Zipf, i int) string {
+            return strconv.Itoa(i % (capacity * 5 / 4))
+        }, nil},
+        // popular reads of entries from 1 to 32 bytes, unrelated to
+        // popularity
+        {"Sized", zipfKey, func(key string) int {
+            n, _ := strconv.Atoi(key)
+            return 1 + n*7919%32
+        }},
+    }
+
+    policies := []struct {
+        name string
+        new  func() EvictionPolicy
+    }{
+        {"LRU", func() EvictionPolicy { return NewLRUEviction() }},
+        {"FIFO", func() EvictionPolicy { return NewFIFOEviction() }},
+        {"LFU", func() EvictionPolicy { return NewLFUEviction() }},
+        {"ARC", func() EvictionPolicy { return NewARCEviction() }},
+        {"TinyLFU", func() EvictionPolicy { return NewTinyLFUEviction(keys) }},
+        {"GreedyDualSize", func() EvictionPolicy { return NewGreedyDualSizeEviction() }},
+    }
+
+    for _, trace := range traces {
+        for _, policy := range policies {
+            b.Run(trace.name+"/"+policy.name, func(b *testing.B) {
+                quietLog(b)
+
+                // the same trace is replayed each iteration, so the hit
+                // ratio does not depend on b.N
+                hits := 0
+                for n := 0; n < b.N; n++ {
+                    r := mathrand.New(mathrand.NewSource(1))
+                    zipf := mathrand.NewZipf(r, 1.1, 1, keys-1)
+
+                    sc := NewScavengerWithPolicy(&discardCache{}, capacity, policy.new())
+
+                    for i := 0; i < length; i++ {
+                        key := trace.next(r, zipf, i)
+
+                        if sc.Find(key) {
+                            sc.Get(key, nil)
+                            hits++
+                            continue
+                        }
+
+                        size := 1
+                        if trace.size != nil {
+                            size = trace.size(key)
+                        }
+
+                        sc.Put(key, nil, strings.NewReader(strings.Repeat("0", size)))
+                    }
+                }
+
+                b.ReportMetric(100*float64(hits)/float64(b.N*length), "hit%")
+            })
+        }
+    }
+}
+
+// fullScavenger returns a Scavenger holding n one byte records, with no room
+// for more. Logging is silenced until b ends.
+func fullScavenger(b *testing.B, n int) *Scavenger {
+    quietLog(b)
+
+    sc := NewScavenger(&discardCache{}, int64(n))
+    for i := 0; i < n; i++ {
+        sc.Touch(strconv.Itoa(i), 1)
+    }
+
+    return sc
+}
+
+// quietLog silences logging until b ends.
+func quietLog(b *testing.B) {
+    logger := Log
+    Log = log.NullLogger
+    b.Cleanup(func() { Log = logger })
+}
+
 func bigFileSetup() error {
     f, err := os.Open(BigFilePath)
     if err != nil {
@@ -710,7 +3588,7 @@ func cleanup() {
 
     err := os.Remove(TestFilePath)
     if err != nil {
-        fmt.Printf("Error cleaning up temp file %s: %v\n", err)
+        fmt.Printf("Error cleaning up temp file %s: %v\n", TestFilePath, err)
     }
 }
 
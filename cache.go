@@ -1,22 +1,54 @@
 package cache
 
 import (
+    "context"
     "errors"
     "io"
+    "io/ioutil"
+    "time"
 
     "github.com/xaevman/log"
 )
 
 const (
     GetLengthUnknown = -2
+
+    // Deprecated: a fill's result no longer times out waiting to be
+    // collected, so CacheFillTimeout is never reported.
     CacheFillTimeout = -3
-    CacheFillError   = -4
+
+    CacheFillError      = -4
+    CacheFillIncomplete = -5 // child stream was truncated or failed mid-read
+    CacheFillCorrupt    = -6 // child stream failed checksum verification
+    CacheFillAborted    = -7 // reader was closed before the fill could complete
+    CacheFillSkipped    = -8 // the origin or the admission policy forbids storing the entry
 )
 
-var ErrDataNotFound = errors.New("Requested data not found in cache")
+var (
+    ErrDataNotFound = errors.New("Requested data not found in cache")
+    ErrInvalidRange = errors.New("Requested range not satisfiable")
+    ErrNotModified  = errors.New("Requested data not modified")
+    ErrNotSupported = errors.New("Operation not supported by cache")
+)
 
 var Log log.DebugLogger
 
+// NotModifiedError is returned by GetConditional when the entry still matches
+// the caller's validators. Metadata carries anything the origin sent with the
+// answer, such as a new expiry, and may be nil. It matches ErrNotModified
+// with errors.Is.
+type NotModifiedError struct {
+    Metadata *EntryMetadata
+}
+
+func (nme *NotModifiedError) Error() string {
+    return ErrNotModified.Error()
+}
+
+func (nme *NotModifiedError) Is(target error) bool {
+    return target == ErrNotModified
+}
+
 type ReadCache interface {
     Get(key string, metadata interface{}) (int64, io.Reader, error)
 }
@@ -30,6 +62,386 @@ type RWCache interface {
     Put(key string, metadata interface{}, data io.Reader) (int64, error)
 }
 
+// Context-aware variants. Cancellation and deadlines on ctx abort retry
+// loops and in-flight transfers.
+type ReadCacheContext interface {
+    GetContext(ctx context.Context, key string, metadata interface{}) (int64, io.Reader, error)
+}
+type WriteCacheContext interface {
+    DeleteContext(ctx context.Context, key string, metadata interface{}) error
+    PutContext(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error)
+}
+type RWCacheContext interface {
+    DeleteContext(ctx context.Context, key string, metadata interface{}) error
+    GetContext(ctx context.Context, key string, metadata interface{}) (int64, io.Reader, error)
+    PutContext(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error)
+}
+
+// RangeReadCache is implemented by caches which can serve part of an entry.
+// A negative length reads to the end of the entry. The returned count is the
+// length of the range, or GetLengthUnknown.
+type RangeReadCache interface {
+    GetRange(key string, metadata interface{}, offset, length int64) (int64, io.Reader, error)
+}
+type RangeReadCacheContext interface {
+    GetRangeContext(ctx context.Context, key string, metadata interface{}, offset, length int64) (int64, io.Reader, error)
+}
+
+// CacheStat describes a cache entry without opening its data.
+type CacheStat struct {
+    Expires    time.Time   // zero if the entry never expires
+    Level      int         // tier of a HierarchicalCache which holds the entry, 0 for the parent
+    Metadata   interface{} // backend specific, e.g. http.Header for HttpReadCache or *EntryMetadata for DiskCache
+    ModTime    time.Time
+    Size       int64 // length of the data, or GetLengthUnknown
+    StoredSize int64 // bytes occupied in the cache, e.g. after compression
+}
+
+type StatCache interface {
+    Stat(key string, metadata interface{}) (*CacheStat, error)
+}
+type StatCacheContext interface {
+    StatContext(ctx context.Context, key string, metadata interface{}) (*CacheStat, error)
+}
+
+// ConditionalReadCache is implemented by caches which can revalidate a copy
+// of an entry held elsewhere. GetConditional fails with ErrNotModified if the
+// entry still matches the validators in em, and otherwise behaves as Get.
+type ConditionalReadCache interface {
+    GetConditional(key string, metadata interface{}, em *EntryMetadata) (int64, io.Reader, error)
+}
+type ConditionalReadCacheContext interface {
+    GetConditionalContext(ctx context.Context, key string, metadata interface{}, em *EntryMetadata) (int64, io.Reader, error)
+}
+
+// MetadataCache is implemented by caches which can replace the metadata
+// stored with an entry without rewriting its data.
+type MetadataCache interface {
+    UpdateMetadata(key string, metadata interface{}) error
+}
+type MetadataCacheContext interface {
+    UpdateMetadataContext(ctx context.Context, key string, metadata interface{}) error
+}
+
+// WithReadContext returns cache as a ReadCacheContext. Caches without native
+// context support are wrapped so that ctx is checked before each call.
+func WithReadContext(cache ReadCache) ReadCacheContext {
+    rc, ok := cache.(ReadCacheContext)
+    if ok {
+        return rc
+    }
+
+    return &contextAdapter{reader: cache}
+}
+
+// WithWriteContext returns cache as a WriteCacheContext. Caches without native
+// context support are wrapped so that ctx is checked before each call.
+func WithWriteContext(cache WriteCache) WriteCacheContext {
+    wc, ok := cache.(WriteCacheContext)
+    if ok {
+        return wc
+    }
+
+    return &contextAdapter{writer: cache}
+}
+
+// WithRWContext returns cache as a RWCacheContext. Caches without native
+// context support are wrapped so that ctx is checked before each call.
+func WithRWContext(cache RWCache) RWCacheContext {
+    rwc, ok := cache.(RWCacheContext)
+    if ok {
+        return rwc
+    }
+
+    return &contextAdapter{reader: cache, writer: cache}
+}
+
+// WithRangeContext returns cache as a RangeReadCacheContext. Caches without
+// native context support are wrapped so that ctx is checked before each call.
+func WithRangeContext(cache RangeReadCache) RangeReadCacheContext {
+    rrc, ok := cache.(RangeReadCacheContext)
+    if ok {
+        return rrc
+    }
+
+    return &rangeContextAdapter{cache: cache}
+}
+
+// WithStatContext returns cache as a StatCacheContext. Caches without native
+// context support are wrapped so that ctx is checked before each call.
+func WithStatContext(cache StatCache) StatCacheContext {
+    sc, ok := cache.(StatCacheContext)
+    if ok {
+        return sc
+    }
+
+    return &statContextAdapter{cache: cache}
+}
+
+// WithConditionalContext returns cache as a ConditionalReadCacheContext.
+// Caches without native context support are wrapped so that ctx is checked
+// before each call.
+func WithConditionalContext(cache ConditionalReadCache) ConditionalReadCacheContext {
+    crc, ok := cache.(ConditionalReadCacheContext)
+    if ok {
+        return crc
+    }
+
+    return &conditionalContextAdapter{cache: cache}
+}
+
+// WithMetadataContext returns cache as a MetadataCacheContext. Caches without
+// native context support are wrapped so that ctx is checked before each call.
+func WithMetadataContext(cache MetadataCache) MetadataCacheContext {
+    mc, ok := cache.(MetadataCacheContext)
+    if ok {
+        return mc
+    }
+
+    return &metadataContextAdapter{cache: cache}
+}
+
+// UpdateMetadataContext replaces the metadata stored with key in cache,
+// failing with ErrNotSupported if cache cannot do so.
+func UpdateMetadataContext(ctx context.Context, cache interface{}, key string, metadata interface{}) error {
+    mc, ok := cache.(MetadataCache)
+    if !ok {
+        return ErrNotSupported
+    }
+
+    return WithMetadataContext(mc).UpdateMetadataContext(ctx, key, metadata)
+}
+
+// StatContext stats key in cache, failing with ErrNotSupported if cache
+// cannot do so without reading the data.
+func StatContext(ctx context.Context, cache ReadCache, key string, metadata interface{}) (*CacheStat, error) {
+    sc, ok := cache.(StatCache)
+    if !ok {
+        return nil, ErrNotSupported
+    }
+
+    return WithStatContext(sc).StatContext(ctx, key, metadata)
+}
+
+// GetRangeContext reads a range from any cache. Caches without range support
+// are read from the start, discarding the data before offset.
+func GetRangeContext(
+    ctx context.Context,
+    cache ReadCache,
+    key string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    rrc, ok := cache.(RangeReadCache)
+    if ok {
+        return WithRangeContext(rrc).GetRangeContext(ctx, key, metadata, offset, length)
+    }
+
+    count, data, err := WithReadContext(cache).GetContext(ctx, key, metadata)
+    if err != nil {
+        return GetLengthUnknown, nil, err
+    }
+
+    return skipRange(count, data, offset, length)
+}
+
+type rangeContextAdapter struct {
+    cache RangeReadCache
+}
+
+func (rca *rangeContextAdapter) GetRangeContext(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    offset, length int64,
+) (int64, io.Reader, error) {
+    err := ctx.Err()
+    if err != nil {
+        return GetLengthUnknown, nil, err
+    }
+
+    return rca.cache.GetRange(key, metadata, offset, length)
+}
+
+type conditionalContextAdapter struct {
+    cache ConditionalReadCache
+}
+
+func (cca *conditionalContextAdapter) GetConditionalContext(
+    ctx context.Context,
+    key string,
+    metadata interface{},
+    em *EntryMetadata,
+) (int64, io.Reader, error) {
+    err := ctx.Err()
+    if err != nil {
+        return GetLengthUnknown, nil, err
+    }
+
+    return cca.cache.GetConditional(key, metadata, em)
+}
+
+type metadataContextAdapter struct {
+    cache MetadataCache
+}
+
+func (mca *metadataContextAdapter) UpdateMetadataContext(ctx context.Context, key string, metadata interface{}) error {
+    err := ctx.Err()
+    if err != nil {
+        return err
+    }
+
+    return mca.cache.UpdateMetadata(key, metadata)
+}
+
+type statContextAdapter struct {
+    cache StatCache
+}
+
+func (sca *statContextAdapter) StatContext(ctx context.Context, key string, metadata interface{}) (*CacheStat, error) {
+    err := ctx.Err()
+    if err != nil {
+        return nil, err
+    }
+
+    return sca.cache.Stat(key, metadata)
+}
+
+type contextAdapter struct {
+    reader ReadCache
+    writer WriteCache
+}
+
+func (ca *contextAdapter) DeleteContext(ctx context.Context, key string, metadata interface{}) error {
+    err := ctx.Err()
+    if err != nil {
+        return err
+    }
+
+    return ca.writer.Delete(key, metadata)
+}
+
+func (ca *contextAdapter) GetContext(ctx context.Context, key string, metadata interface{}) (int64, io.Reader, error) {
+    err := ctx.Err()
+    if err != nil {
+        return GetLengthUnknown, nil, err
+    }
+
+    return ca.reader.Get(key, metadata)
+}
+
+func (ca *contextAdapter) PutContext(ctx context.Context, key string, metadata interface{}, data io.Reader) (int64, error) {
+    err := ctx.Err()
+    if err != nil {
+        return 0, err
+    }
+
+    return ca.writer.Put(key, metadata, &contextReader{ctx: ctx, source: data})
+}
+
+// contextReader fails reads once its context is done, so long copies stop
+// promptly on cancellation.
+type contextReader struct {
+    ctx    context.Context
+    source io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+    err := cr.ctx.Err()
+    if err != nil {
+        return 0, err
+    }
+
+    return cr.source.Read(p)
+}
+
+// AsReadCloser returns reader as an io.ReadCloser. Readers returned by the
+// caches in this package already implement io.Closer; any other reader is
+// given a no-op Close.
+func AsReadCloser(reader io.Reader) io.ReadCloser {
+    rc, ok := reader.(io.ReadCloser)
+    if ok {
+        return rc
+    }
+
+    return ioutil.NopCloser(reader)
+}
+
+// GetReadCloser gets key from cache, returning a reader which the caller
+// must Close once done with it, whether or not it was read to the end.
+func GetReadCloser(ctx context.Context, cache ReadCache, key string, metadata interface{}) (int64, io.ReadCloser, error) {
+    count, reader, err := WithReadContext(cache).GetContext(ctx, key, metadata)
+    if err != nil {
+        return count, nil, err
+    }
+
+    return count, AsReadCloser(reader), nil
+}
+
+// rangeLength returns the length of a range within an entry of the given
+// size, or GetLengthUnknown if the size is unknown.
+func rangeLength(size, offset, length int64) (int64, error) {
+    if offset < 0 || (size > -1 && offset > size) {
+        return GetLengthUnknown, ErrInvalidRange
+    }
+
+    if size < 0 {
+        return GetLengthUnknown, nil
+    }
+
+    c := size - offset
+    if length > -1 && length < c {
+        c = length
+    }
+
+    return c, nil
+}
+
+// limitRange limits data, already positioned at the start of a range, to
+// the range's length. Closing the result closes data.
+func limitRange(count int64, data io.Reader, length int64) io.Reader {
+    if length < 0 {
+        return NewSafeReader(count, data, nil)
+    }
+
+    return NewSafeReader(count, io.LimitReader(data, length), data)
+}
+
+// skipRange serves a range from a reader over a whole entry of size count by
+// discarding everything before offset.
+func skipRange(count int64, data io.Reader, offset, length int64) (int64, io.Reader, error) {
+    c, err := rangeLength(count, offset, length)
+    if err != nil {
+        AsReadCloser(data).Close()
+        return GetLengthUnknown, nil, err
+    }
+
+    _, err = io.CopyN(ioutil.Discard, data, offset)
+    if err != nil {
+        AsReadCloser(data).Close()
+        if err == io.EOF {
+            err = ErrInvalidRange
+        }
+        return GetLengthUnknown, nil, err
+    }
+
+    return c, limitRange(c, data, length), nil
+}
+
+// sleepContext waits for d to elapse, returning early with ctx's error if ctx
+// is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
 func init() {
     Log = log.NullLogger
 }